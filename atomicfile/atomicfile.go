@@ -0,0 +1,38 @@
+// Package atomicfile replaces files so that readers and crashed runs never
+// see them half written.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Write writes data to a temporary file in the directory of path and
+// renames it over path. The directory must exist.
+func Write(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package atomicfile_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/atomicfile"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("replaces the file and leaves no temporary file behind", func() {
+		path := filepath.Join(dir, "state.json")
+		Expect(os.WriteFile(path, []byte("old"), 0644)).To(Succeed())
+
+		Expect(atomicfile.Write(path, []byte("new"))).To(Succeed())
+
+		Expect(os.ReadFile(path)).To(Equal([]byte("new")))
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("fails when the directory does not exist", func() {
+		err := atomicfile.Write(filepath.Join(dir, "missing", "state.json"), []byte("new"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("leaves the file alone when it cannot be replaced", func() {
+		path := filepath.Join(dir, "report.json")
+		Expect(os.Mkdir(path, 0755)).To(Succeed())
+
+		Expect(atomicfile.Write(path, []byte("new"))).NotTo(Succeed())
+
+		Expect(path).To(BeADirectory())
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+})
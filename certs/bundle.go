@@ -0,0 +1,318 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec G505 - Windows identifies certificates by their SHA-1 thumbprint
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Bundle struct {
+	now func() time.Time
+}
+
+func NewBundle() Bundle {
+	return Bundle{
+		now: time.Now,
+	}
+}
+
+// Certificate describes a certificate found in the certificate directory.
+type Certificate struct {
+	File       string    `json:"file"`
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	SHA256     string    `json:"sha256_fingerprint"`
+	Thumbprint string    `json:"thumbprint"`
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// Problem describes why a single file in the certificate directory
+// cannot be imported into the image.
+type Problem struct {
+	File   string
+	Reason string
+}
+
+// ValidationError lists every file in the certificate directory that
+// failed validation.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	reasons := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", p.File, p.Reason))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// Validate parses every file in certDirectory as PEM or DER encoded
+// certificates. Each certificate must be an unexpired CA certificate,
+// otherwise a *ValidationError naming all offending files is returned.
+func (b Bundle) Validate(certDirectory string) error {
+	validationErr := &ValidationError{}
+	err := eachCertFile(certDirectory, func(file string, certificates []*x509.Certificate, err error) error {
+		if err != nil {
+			validationErr.Problems = append(validationErr.Problems, Problem{File: file, Reason: err.Error()})
+			return nil
+		}
+
+		for _, reason := range b.validate(certificates) {
+			validationErr.Problems = append(validationErr.Problems, Problem{File: file, Reason: reason})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(validationErr.Problems) > 0 {
+		return validationErr
+	}
+
+	return nil
+}
+
+// Inspect returns the certificates found in certDirectory, ordered by file name.
+func (b Bundle) Inspect(certDirectory string) ([]Certificate, error) {
+	var certificates []Certificate
+	err := eachCert(certDirectory, func(file string, cert *x509.Certificate) {
+		certificates = append(certificates, Certificate{
+			File:       file,
+			Subject:    cert.Subject.String(),
+			Issuer:     cert.Issuer.String(),
+			SHA256:     fmt.Sprintf("%x", sha256.Sum256(cert.Raw)),
+			Thumbprint: Thumbprint(cert),
+			NotAfter:   cert.NotAfter.UTC(),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
+
+// Certificates returns the certificates in certDirectory ordered by file
+// name, leaving out any certificate that was already found in an earlier
+// file.
+func (b Bundle) Certificates(certDirectory string) ([]*x509.Certificate, error) {
+	seen := map[[sha256.Size]byte]bool{}
+	var certificates []*x509.Certificate
+	err := eachCert(certDirectory, func(file string, cert *x509.Certificate) {
+		fingerprint := sha256.Sum256(cert.Raw)
+		if seen[fingerprint] {
+			return
+		}
+		seen[fingerprint] = true
+		certificates = append(certificates, cert)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
+
+// Thumbprint returns the upper case hex SHA-1 hash Windows uses to identify a
+// certificate in a certificate store.
+func Thumbprint(cert *x509.Certificate) string {
+	// #nosec G401 - the thumbprint is an identifier, not a security control
+	return fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+}
+
+// NormalizeThumbprint returns thumbprint in the form Thumbprint returns,
+// accepting lower case and the spaces or colons certificate viewers put
+// between bytes.
+func NormalizeThumbprint(thumbprint string) (string, error) {
+	normalized := strings.ToUpper(strings.NewReplacer(" ", "", ":", "").Replace(thumbprint))
+	if len(normalized) != 2*sha1.Size || strings.Trim(normalized, "0123456789ABCDEF") != "" {
+		return "", fmt.Errorf("invalid thumbprint %q: must be 40 hex digits", thumbprint)
+	}
+	return normalized, nil
+}
+
+// Digest returns a stable sha256 digest of the certificates in certDirectory.
+// It depends only on the set of certificates, not on file names, ordering,
+// duplicates or whether they are PEM or DER encoded.
+func (b Bundle) Digest(certDirectory string) (string, error) {
+	fingerprints := map[[sha256.Size]byte]bool{}
+	err := eachCert(certDirectory, func(file string, cert *x509.Certificate) {
+		fingerprints[sha256.Sum256(cert.Raw)] = true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sorted := make([][sha256.Size]byte, 0, len(fingerprints))
+	for fp := range fingerprints {
+		sorted = append(sorted, fp)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i][:], sorted[j][:]) < 0 })
+
+	hash := sha256.New()
+	for _, fp := range sorted {
+		hash.Write(fp[:])
+	}
+
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// eachCertFile calls fn with the name of every entry in certDirectory, in
+// name order, and the certificates parsed from it or why it could not be
+// read or parsed. It stops at the first error fn returns.
+func eachCertFile(certDirectory string, fn func(file string, certificates []*x509.Certificate, err error) error) error {
+	entries, err := os.ReadDir(certDirectory)
+	if err != nil {
+		return fmt.Errorf("read certificate directory: %s", err)
+	}
+
+	for _, entry := range entries {
+		var certificates []*x509.Certificate
+		var fileErr error
+		if entry.IsDir() {
+			fileErr = errDirectory
+		} else {
+			var data []byte
+			data, fileErr = os.ReadFile(filepath.Join(certDirectory, entry.Name()))
+			if fileErr == nil {
+				certificates, fileErr = parse(data)
+			}
+		}
+
+		err = fn(entry.Name(), certificates, fileErr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eachCert calls fn with every certificate in certDirectory and the name of
+// its file. Subdirectories are skipped, and a file that cannot be read or
+// parsed fails the whole directory.
+func eachCert(certDirectory string, fn func(file string, cert *x509.Certificate)) error {
+	return eachCertFile(certDirectory, func(file string, certificates []*x509.Certificate, err error) error {
+		if errors.Is(err, errDirectory) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		for _, cert := range certificates {
+			fn(file, cert)
+		}
+		return nil
+	})
+}
+
+var errDirectory = errors.New("is a directory")
+
+// validate returns why certificates cannot be imported, if at all.
+func (b Bundle) validate(certificates []*x509.Certificate) []string {
+	now := b.now()
+
+	var reasons []string
+	for _, cert := range certificates {
+		subject := cert.Subject.String()
+		if !cert.BasicConstraintsValid || !cert.IsCA {
+			reasons = append(reasons, fmt.Sprintf("%q is not a CA certificate", subject))
+		}
+		if now.After(cert.NotAfter) {
+			reasons = append(reasons, fmt.Sprintf("%q expired on %s", subject, cert.NotAfter.UTC().Format(time.RFC3339)))
+		}
+		if now.Before(cert.NotBefore) {
+			reasons = append(reasons, fmt.Sprintf("%q is not valid before %s", subject, cert.NotBefore.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	return reasons
+}
+
+// parse decodes PEM data containing one or more CERTIFICATE or PKCS7
+// blocks, falling back to DER encoded certificates or PKCS#7 when no PEM
+// block is present. Private keys are rejected so that they never end up in
+// an image by mistake.
+func parse(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		return parseDER(data)
+	}
+
+	var certificates []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse certificate: %s", err)
+			}
+			certificates = append(certificates, cert)
+		case block.Type == "PKCS7":
+			bundle, err := parsePKCS7(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse PKCS#7: %s", err)
+			}
+			certificates = append(certificates, bundle...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			return nil, errPrivateKey
+		default:
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return certificates, nil
+}
+
+var errPrivateKey = errors.New("contains a private key")
+
+func parseDER(data []byte) ([]*x509.Certificate, error) {
+	certificates, err := x509.ParseCertificates(data)
+	if err != nil {
+		if bundle, p7Err := parsePKCS7(data); p7Err == nil {
+			certificates, err = bundle, nil
+		} else if isPrivateKey(data) {
+			return nil, errPrivateKey
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("not a PEM, DER or PKCS#7 encoded certificate: %s", err)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certificates, nil
+}
+
+func isPrivateKey(der []byte) bool {
+	if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return true
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return true
+	}
+	_, err := x509.ParseECPrivateKey(der)
+	return err == nil
+}
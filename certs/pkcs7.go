@@ -0,0 +1,54 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+)
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// signedData is the degenerate PKCS#7 SignedData of .p7b files, which only
+// carries certificates.
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// parsePKCS7 returns the certificates of a DER encoded PKCS#7 SignedData
+// structure.
+func parsePKCS7(der []byte) ([]*x509.Certificate, error) {
+	var info contentInfo
+	rest, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after PKCS#7 content")
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("PKCS#7 content type %s is not signed data", info.ContentType)
+	}
+
+	// The content is wrapped in an explicit [0] tag.
+	if info.Content.Class != asn1.ClassContextSpecific || info.Content.Tag != 0 {
+		return nil, fmt.Errorf("PKCS#7 content is not tagged [0]")
+	}
+
+	var signed signedData
+	_, err = asn1.Unmarshal(info.Content.Bytes, &signed)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificates(signed.Certificates.Bytes)
+}
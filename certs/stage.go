@@ -0,0 +1,190 @@
+package certs
+
+import (
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// StagingDirPrefix starts the name of every staging directory.
+	StagingDirPrefix = "cert-injector-certs-"
+
+	// StdinSource reads the certificates from standard input.
+	StdinSource = "-"
+
+	// EnvSourcePrefix reads the certificates from the environment variable
+	// named after it, such as env:TRUSTED_CERTS.
+	EnvSourcePrefix = "env:"
+)
+
+// Stager gathers certificates from directories, bundle files, standard input
+// and environment variables into a single directory.
+type Stager struct {
+	stdin   io.Reader
+	tempDir string
+	bundle  Bundle
+}
+
+func NewStager(stdin io.Reader, tempDir string) Stager {
+	return Stager{
+		stdin:   stdin,
+		tempDir: tempDir,
+		bundle:  NewBundle(),
+	}
+}
+
+// Staging is a staging directory and where its certificates came from.
+type Staging struct {
+	Dir string
+
+	// Sources maps each staged file name to the input its certificate was
+	// first found in: a file path, stdin or env:NAME.
+	Sources map[string]string
+}
+
+type input struct {
+	name string
+	data []byte
+}
+
+// Stage reads the certificates of every source and writes them, one PEM
+// encoded certificate per file named <sha256 fingerprint>.crt, to a new
+// directory in the temp directory. Duplicate certificates are written once,
+// so the same certificates always stage to the same files. A source is a
+// directory of certificate files, a file holding PEM, DER or PKCS#7 encoded
+// certificates, StdinSource or an EnvSourcePrefix variable. Inputs that
+// cannot be parsed, hold a private key or hold a certificate Validate would
+// reject are returned together as a *ValidationError naming the input. The
+// caller removes the returned directory.
+func (s Stager) Stage(sources []string) (Staging, error) {
+	if len(sources) == 0 {
+		return Staging{}, fmt.Errorf("no certificate sources")
+	}
+
+	var inputs []input
+	validationErr := &ValidationError{}
+	readStdin := false
+
+	for _, source := range sources {
+		switch {
+		case source == StdinSource:
+			if readStdin {
+				return Staging{}, fmt.Errorf("stdin can only be given once")
+			}
+			readStdin = true
+
+			data, err := io.ReadAll(s.stdin)
+			if err != nil {
+				return Staging{}, fmt.Errorf("read stdin: %s", err)
+			}
+			inputs = append(inputs, input{name: "stdin", data: data})
+
+		case strings.HasPrefix(source, EnvSourcePrefix):
+			name := strings.TrimPrefix(source, EnvSourcePrefix)
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return Staging{}, fmt.Errorf("environment variable %s is not set", name)
+			}
+			inputs = append(inputs, input{name: source, data: []byte(value)})
+
+		default:
+			fromPath, problems, err := readPath(source)
+			if err != nil {
+				return Staging{}, err
+			}
+			inputs = append(inputs, fromPath...)
+			validationErr.Problems = append(validationErr.Problems, problems...)
+		}
+	}
+
+	files := map[string][]byte{}
+	staged := map[string]string{}
+
+	for _, in := range inputs {
+		certificates, err := parse(in.data)
+		if err != nil {
+			validationErr.Problems = append(validationErr.Problems, Problem{File: in.name, Reason: err.Error()})
+			continue
+		}
+
+		// Once staged, a certificate is only known by its fingerprint, so
+		// it is validated here where its input can still be named.
+		for _, reason := range s.bundle.validate(certificates) {
+			validationErr.Problems = append(validationErr.Problems, Problem{File: in.name, Reason: reason})
+		}
+
+		for _, cert := range certificates {
+			name := fmt.Sprintf("%x.crt", sha256.Sum256(cert.Raw))
+			files[name] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			if _, ok := staged[name]; !ok {
+				staged[name] = in.name
+			}
+		}
+	}
+
+	if len(validationErr.Problems) > 0 {
+		return Staging{}, validationErr
+	}
+
+	dir, err := os.MkdirTemp(s.tempDir, StagingDirPrefix)
+	if err != nil {
+		return Staging{}, fmt.Errorf("create staging directory: %s", err)
+	}
+
+	for name, block := range files {
+		err = os.WriteFile(filepath.Join(dir, name), block, 0644)
+		if err != nil {
+			os.RemoveAll(dir)
+			return Staging{}, fmt.Errorf("stage %s: %s", staged[name], err)
+		}
+	}
+
+	return Staging{Dir: dir, Sources: staged}, nil
+}
+
+// readPath reads a certificate file, or every file of a certificate
+// directory in name order.
+func readPath(path string) ([]input, []Problem, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read certificate source: %s", err)
+	}
+
+	if !info.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read certificate source: %s", err)
+		}
+		return []input{{name: path, data: data}}, nil, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read certificate directory: %s", err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var inputs []input
+	var problems []Problem
+	for _, entry := range entries {
+		if entry.IsDir() {
+			problems = append(problems, Problem{File: filepath.Join(path, entry.Name()), Reason: "is a directory"})
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, nil, fmt.Errorf("read certificate directory: %s", err)
+		}
+		inputs = append(inputs, input{name: filepath.Join(path, entry.Name()), data: data})
+	}
+
+	return inputs, problems, nil
+}
@@ -0,0 +1,446 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/certs"
+	"code.cloudfoundry.org/cert-injector/command"
+	"code.cloudfoundry.org/cert-injector/container"
+	"code.cloudfoundry.org/cert-injector/gc"
+	"code.cloudfoundry.org/cert-injector/ids"
+	"code.cloudfoundry.org/cert-injector/injector"
+	"code.cloudfoundry.org/cert-injector/layout"
+	"code.cloudfoundry.org/cert-injector/lock"
+	"code.cloudfoundry.org/cert-injector/state"
+	"code.cloudfoundry.org/cert-injector/winlayer"
+)
+
+// Version is set at build time with -ldflags "-X code.cloudfoundry.org/cert-injector/cli.Version=<version>".
+var Version = "dev"
+
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// stepExitCodes tell which step of the pipeline failed. Failures that cannot
+// be attributed to a step exit with exitFailure.
+var stepExitCodes = map[injector.Step]int{
+	injector.StepValidate:    10,
+	injector.StepSnapshot:    11,
+	injector.StepRemoveLayer: 12,
+	injector.StepGrootCreate: 13,
+	injector.StepConfigWrite: 14,
+	injector.StepWincRun:     15,
+	injector.StepDiffExport:  16,
+	injector.StepAddLayer:    17,
+	injector.StepGrootDelete: 18,
+	injector.StepLayerBuild:  19,
+	injector.StepPull:        20,
+	injector.StepPush:        21,
+}
+
+// failureExitCode returns the exit code for err.
+func failureExitCode(err error) int {
+	var stepErr *injector.StepError
+	if errors.As(err, &stepErr) {
+		if code, ok := stepExitCodes[stepErr.Step]; ok {
+			return code
+		}
+	}
+	return exitFailure
+}
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+const usage = `usage: cert-injector <command> [flags]
+       cert-injector [--force] <driver_store> <cert_directory> <image_uri>...
+
+commands:
+  inject    replace the custom certificate layer of one or more images
+  remove    remove the custom certificate layer from one or more images
+  verify    check that certificates can be injected, or that images trust them
+  list      list the certificates of one or more sources
+  gc        delete volumes and temp files left behind by earlier runs
+  version   print the version
+
+Run 'cert-injector <command> -h' for the flags of a command.
+`
+
+type commandFunc func(ctx context.Context, args []string, stdout, stderr io.Writer) int
+
+var commands = map[string]commandFunc{
+	"inject":  inject,
+	"remove":  remove,
+	"verify":  verify,
+	"list":    list,
+	"gc":      collectGarbage,
+	"version": version,
+}
+
+// Run executes the command line given by args, which excludes the program
+// name, and returns the process exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitSuccess
+	}
+
+	// Interrupting the run kills any tool that is still running.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if command, ok := commands[args[0]]; ok {
+		return command(ctx, args[1:], stdout, stderr)
+	}
+
+	// Before subcommands existed the only usage was <driver_store> <cert_directory> <image_uri>...
+	return inject(ctx, args, stdout, stderr)
+}
+
+func version(_ context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("version", stderr)
+	output := addOutputFlag(fs)
+	if err := parse(fs, args, output); err != nil {
+		return exitUsage
+	}
+
+	if *output == outputJSON {
+		return writeJSON(stdout, stderr, map[string]string{"version": Version})
+	}
+
+	fmt.Fprintln(stdout, Version)
+	return exitSuccess
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+func addOutputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", outputText, "output format: text or json")
+}
+
+// parse parses args and validates the output format.
+func parse(fs *flag.FlagSet, args []string, output *string) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *output != outputText && *output != outputJSON {
+		err = fmt.Errorf("invalid output format %q: must be %s or %s", *output, outputText, outputJSON)
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+
+	return nil
+}
+
+func addLogFormatFlag(fs *flag.FlagSet) *string {
+	return fs.String("log-format", logFormatJSON, "log format: json or text")
+}
+
+// newLogger returns a logger that writes events to w in the given format.
+func newLogger(w io.Writer, format string) (*slog.Logger, error) {
+	switch format {
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be %s or %s", format, logFormatJSON, logFormatText)
+	}
+}
+
+// defaultStateFile records the volumes that runs failed to delete.
+var defaultStateFile = filepath.Join(os.TempDir(), "cert-injector", "state.json")
+
+func addStateFileFlag(fs *flag.FlagSet) *string {
+	return fs.String("state-file", defaultStateFile, "file recording volumes that could not be deleted, so later runs can retry")
+}
+
+// defaultLockDir holds the lock files that keep overlapping runs from
+// changing the same driver store or image.
+var defaultLockDir = filepath.Join(os.TempDir(), "cert-injector", "locks")
+
+type lockFlags struct {
+	dir     *string
+	timeout *time.Duration
+}
+
+func addLockFlags(fs *flag.FlagSet) lockFlags {
+	return lockFlags{
+		dir:     fs.String("lock-dir", defaultLockDir, "directory of the lock files that keep overlapping runs apart"),
+		timeout: fs.Duration("lock-timeout", 5*time.Minute, "how long to wait for another run to release a driver store or image"),
+	}
+}
+
+func (f lockFlags) driverStore(ctx context.Context, driverStore string) (*lock.Lock, error) {
+	return lock.NewLocker(*f.dir).Acquire(ctx, "driver store "+filepath.Clean(driverStore), *f.timeout)
+}
+
+func (f lockFlags) image(ctx context.Context, uri string) (*lock.Lock, error) {
+	return lock.NewLocker(*f.dir).Acquire(ctx, "image "+uri, *f.timeout)
+}
+
+func (f lockFlags) tempPaths() *tempPathLocks {
+	return &tempPathLocks{locker: lock.NewLocker(*f.dir)}
+}
+
+// tempPathLocks holds the lock of every temp path a run creates until the
+// run ends, so that gc leaves them alone however long the run takes.
+type tempPathLocks struct {
+	locker lock.Locker
+	mu     sync.Mutex
+	held   []*lock.Lock
+}
+
+func (t *tempPathLocks) hold(path string) error {
+	l, err := t.locker.Acquire(context.Background(), gc.TempPathLockKey(path), 0)
+	if err != nil {
+		return fmt.Errorf("lock %s: %s", path, err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.held = append(t.held, l)
+	return nil
+}
+
+func (t *tempPathLocks) Release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, l := range t.held {
+		l.Release()
+	}
+	t.held = nil
+}
+
+// lockedIds hands out bundle directories and diff output files that are
+// locked until the run ends.
+type lockedIds struct {
+	ids.Generator
+	locks *tempPathLocks
+}
+
+func (l lockedIds) BundleDir(containerId string) (string, error) {
+	dir, err := l.Generator.BundleDir(containerId)
+	if err != nil {
+		return "", err
+	}
+
+	err = l.locks.hold(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func (l lockedIds) DiffOutputFile(containerId string) (string, error) {
+	path, err := l.Generator.DiffOutputFile(containerId)
+	if err != nil {
+		return "", err
+	}
+
+	err = l.locks.hold(path)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+const (
+	layerBuilderContainer = "container"
+	layerBuilderNative    = "native"
+)
+
+// newLayerBuilder returns the layer builder to give the injector, which is
+// nil when the layer is built by running a container.
+func newLayerBuilder(name string) (injector.LayerBuilder, error) {
+	switch name {
+	case layerBuilderContainer:
+		return nil, nil
+	case layerBuilderNative:
+		return winlayer.NewBuilder(), nil
+	default:
+		return nil, fmt.Errorf("invalid layer builder %q: must be %s or %s", name, layerBuilderContainer, layerBuilderNative)
+	}
+}
+
+const (
+	layoutWriterHydrate = "hydrate"
+	layoutWriterNative  = "native"
+)
+
+func addLayoutWriterFlag(fs *flag.FlagSet) *string {
+	return fs.String("layout-writer", layoutWriterHydrate, "how to remove and add image layers: hydrate runs hydrate, native edits the OCI image layout directly")
+}
+
+// layoutStages returns the stages that remove and add image layers, which
+// are left unset when hydrate does it.
+func layoutStages(name string) (injector.Stages, error) {
+	switch name {
+	case layoutWriterHydrate:
+		return injector.Stages{}, nil
+	case layoutWriterNative:
+		return injector.Stages{LayerRemover: layout.NewLayout(), LayerAdder: layout.NewLayout()}, nil
+	default:
+		return injector.Stages{}, fmt.Errorf("invalid layout writer %q: must be %s or %s", name, layoutWriterHydrate, layoutWriterNative)
+	}
+}
+
+// containerTools are the tools that build a layer by running a container.
+var containerTools = []string{"groot", "winc", "diff-exporter"}
+
+// unusedTools names the tools that do not have to be installed for stages
+// and layerBuilder.
+func unusedTools(stages injector.Stages, layerBuilder injector.LayerBuilder) []string {
+	var unused []string
+	if layerBuilder != nil {
+		unused = append(unused, containerTools...)
+	}
+	if stages.LayerRemover != nil && stages.LayerAdder != nil {
+		unused = append(unused, "hydrate")
+	}
+	return unused
+}
+
+func newInjector(tools injector.Tools, stateFile string, tempLocks *tempPathLocks, logger *slog.Logger, options injector.Options) injector.Injector {
+	return injector.NewInjector(
+		command.NewCmd(),
+		container.NewConfig(),
+		certs.NewBundle(),
+		layout.NewLayout(),
+		lockedIds{Generator: ids.NewGenerator(), locks: tempLocks},
+		state.NewFile(stateFile),
+		tools,
+		logger,
+		options,
+	)
+}
+
+func writeJSON(stdout, stderr io.Writer, v interface{}) int {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		fmt.Fprintf(stderr, "json encode output: %s\n", err)
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// stringSlice is a flag that may be given more than once.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+const certsFlagUsage = "certificates to %s: a directory, a file of one or more certificates, - for stdin or env:NAME (repeatable)"
+
+// stageCerts gathers the certificates of sources into a temporary directory
+// of one certificate per file. The caller removes it. The directory is
+// locked until the run ends if tempLocks is not nil.
+func stageCerts(sources []string, tempLocks *tempPathLocks) (certs.Staging, error) {
+	staging, err := certs.NewStager(os.Stdin, os.TempDir()).Stage(sources)
+	if err != nil || tempLocks == nil {
+		return staging, err
+	}
+
+	err = tempLocks.hold(staging.Dir)
+	if err != nil {
+		os.RemoveAll(staging.Dir)
+		return certs.Staging{}, err
+	}
+	return staging, nil
+}
+
+// timeoutsFlag sets per step timeouts from step=duration values.
+type timeoutsFlag map[injector.Step]time.Duration
+
+func (t timeoutsFlag) String() string {
+	var values []string
+	for step, timeout := range t {
+		values = append(values, fmt.Sprintf("%s=%s", step, timeout))
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+func (t timeoutsFlag) Set(value string) error {
+	name, duration, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected step=duration")
+	}
+
+	step := injector.Step(name)
+	if _, ok := injector.DefaultTimeouts()[step]; !ok {
+		return fmt.Errorf("unknown step %q", name)
+	}
+
+	timeout, err := time.ParseDuration(duration)
+	if err != nil {
+		return err
+	}
+
+	t[step] = timeout
+	return nil
+}
+
+func addTimeoutFlag(fs *flag.FlagSet) timeoutsFlag {
+	timeouts := timeoutsFlag(injector.DefaultTimeouts())
+	fs.Var(timeouts, "timeout", "step=duration timeout for a tool, 0 to disable (repeatable, default "+timeouts.String()+")")
+	return timeouts
+}
+
+// syncWriter serializes writes from concurrent injections.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
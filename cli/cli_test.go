@@ -0,0 +1,941 @@
+package cli_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/cli"
+	"code.cloudfoundry.org/cert-injector/injector"
+	"code.cloudfoundry.org/cert-injector/internal/testfixtures"
+	"code.cloudfoundry.org/cert-injector/layout"
+	"code.cloudfoundry.org/cert-injector/lock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Run", func() {
+	var (
+		stdout  *bytes.Buffer
+		stderr  *bytes.Buffer
+		tempDir string
+	)
+
+	BeforeEach(func() {
+		stdout = &bytes.Buffer{}
+		stderr = &bytes.Buffer{}
+
+		var err error
+		tempDir, err = os.MkdirTemp("", "cert-injector-cli-test-*")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tempDir)).To(Succeed())
+	})
+
+	It("prints usage and fails without arguments", func() {
+		Expect(cli.Run(nil, stdout, stderr)).To(Equal(2))
+		Expect(stderr.String()).To(ContainSubstring("usage: cert-injector <command> [flags]"))
+	})
+
+	It("prints usage on help", func() {
+		Expect(cli.Run([]string{"--help"}, stdout, stderr)).To(Equal(0))
+		Expect(stdout.String()).To(ContainSubstring("usage: cert-injector <command> [flags]"))
+	})
+
+	Describe("version", func() {
+		It("prints the version", func() {
+			Expect(cli.Run([]string{"version"}, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(Equal("dev\n"))
+		})
+
+		It("prints the version as json", func() {
+			Expect(cli.Run([]string{"version", "--output", "json"}, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(MatchJSON(`{"version": "dev"}`))
+		})
+
+		It("rejects unknown output formats", func() {
+			Expect(cli.Run([]string{"version", "--output", "yaml"}, stdout, stderr)).To(Equal(2))
+			Expect(stderr.String()).To(ContainSubstring(`invalid output format "yaml"`))
+		})
+	})
+
+	Context("with a certificate directory", func() {
+		var certDirectory string
+
+		BeforeEach(func() {
+			certDirectory = filepath.Join(tempDir, "certs")
+			Expect(os.Mkdir(certDirectory, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(certDirectory, "ca.pem"), testfixtures.ToPEM(testfixtures.GenerateCA("some-ca")), 0644)).To(Succeed())
+		})
+
+		Describe("list", func() {
+			It("prints a table of the certificates", func() {
+				Expect(cli.Run([]string{"list", "--certs", certDirectory}, stdout, stderr)).To(Equal(0))
+				Expect(stdout.String()).To(ContainSubstring("FILE"))
+				Expect(stdout.String()).To(MatchRegexp(regexp.QuoteMeta(filepath.Join(certDirectory, "ca.pem")) + `\s+CN=some-ca\s+CN=some-ca\s+[0-9A-F]{40}`))
+			})
+
+			It("prints the certificates as json", func() {
+				Expect(cli.Run([]string{"list", "--certs", certDirectory, "--output", "json"}, stdout, stderr)).To(Equal(0))
+
+				var certificates []map[string]interface{}
+				Expect(json.Unmarshal(stdout.Bytes(), &certificates)).To(Succeed())
+				Expect(certificates).To(HaveLen(1))
+				Expect(certificates[0]).To(HaveKeyWithValue("file", filepath.Join(certDirectory, "ca.pem")))
+				Expect(certificates[0]).To(HaveKeyWithValue("subject", "CN=some-ca"))
+				Expect(certificates[0]).To(HaveKey("sha256_fingerprint"))
+			})
+
+			It("lists the certificates of a bundle file and an environment variable", func() {
+				bundleFile := filepath.Join(tempDir, "bundle.pem")
+				Expect(os.WriteFile(bundleFile, testfixtures.ToPEM(testfixtures.GenerateCA("first"), testfixtures.GenerateCA("second")), 0644)).To(Succeed())
+				GinkgoT().Setenv("TRUSTED_CERTS", string(testfixtures.ToPEM(testfixtures.GenerateCA("third"))))
+
+				Expect(cli.Run([]string{"list", "--certs", bundleFile, "--certs", "env:TRUSTED_CERTS"}, stdout, stderr)).To(Equal(0), stderr.String())
+				Expect(stdout.String()).To(MatchRegexp(regexp.QuoteMeta(bundleFile) + `\s+CN=first`))
+				Expect(stdout.String()).To(MatchRegexp(regexp.QuoteMeta(bundleFile) + `\s+CN=second`))
+				Expect(stdout.String()).To(MatchRegexp(`env:TRUSTED_CERTS\s+CN=third`))
+			})
+
+			It("requires --certs", func() {
+				Expect(cli.Run([]string{"list"}, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring("list requires --certs"))
+			})
+		})
+
+		Describe("verify", func() {
+			It("reports valid certificates", func() {
+				Expect(cli.Run([]string{"verify", "--certs", certDirectory}, stdout, stderr)).To(Equal(0))
+				Expect(stdout.String()).To(HavePrefix("certificates are valid, digest sha256:"))
+			})
+
+			It("reports every problem and fails", func() {
+				Expect(os.WriteFile(filepath.Join(certDirectory, "bad.pem"), []byte("garbage"), 0644)).To(Succeed())
+
+				Expect(cli.Run([]string{"verify", "--certs", certDirectory, "--output", "json"}, stdout, stderr)).To(Equal(1))
+
+				var result map[string]interface{}
+				Expect(json.Unmarshal(stdout.Bytes(), &result)).To(Succeed())
+				Expect(result).To(HaveKeyWithValue("valid", false))
+				Expect(result["problems"]).To(HaveLen(1))
+			})
+
+			Context("with --image", func() {
+				var imageUri string
+
+				BeforeEach(func() {
+					imageDir := filepath.Join(tempDir, "image")
+					Expect(os.Mkdir(imageDir, 0755)).To(Succeed())
+					testfixtures.WriteImage(imageDir, "base-layer")
+					imageUri = layout.URI(imageDir)
+
+					args := append([]string{"inject", "--layout-writer", "native", "--layer-builder", "native", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, fakeToolFlags(filepath.Join(tempDir, "calls.log"))...)
+					Expect(cli.Run(args, io.Discard, stderr)).To(Equal(0), stderr.String())
+				})
+
+				It("reports that the image trusts every certificate", func() {
+					Expect(cli.Run([]string{"verify", "--certs", certDirectory, "--image", imageUri}, stdout, stderr)).To(Equal(0), stderr.String())
+					Expect(stdout.String()).To(MatchRegexp(regexp.QuoteMeta(imageUri) + ` trusts 1 of 1 certificates\n  present [0-9A-F]{40}\n`))
+				})
+
+				It("reports the missing certificates and fails", func() {
+					Expect(os.WriteFile(filepath.Join(certDirectory, "other.pem"), testfixtures.ToPEM(testfixtures.GenerateCA("other-ca")), 0644)).To(Succeed())
+
+					Expect(cli.Run([]string{"verify", "--certs", certDirectory, "--image", imageUri, "--output", "json"}, stdout, stderr)).To(Equal(1))
+
+					var result struct {
+						Valid  bool `json:"valid"`
+						Images []struct {
+							Image   string   `json:"image"`
+							Trusted bool     `json:"trusted"`
+							Present []string `json:"present"`
+							Missing []string `json:"missing"`
+						} `json:"images"`
+					}
+					Expect(json.Unmarshal(stdout.Bytes(), &result)).To(Succeed())
+					Expect(result.Valid).To(BeTrue())
+					Expect(result.Images).To(HaveLen(1))
+					Expect(result.Images[0].Image).To(Equal(imageUri))
+					Expect(result.Images[0].Trusted).To(BeFalse())
+					Expect(result.Images[0].Present).To(HaveLen(1))
+					Expect(result.Images[0].Missing).To(HaveLen(1))
+				})
+
+				It("fails when the top layer is not a certificate layer", func() {
+					otherDir := filepath.Join(tempDir, "other-image")
+					Expect(os.Mkdir(otherDir, 0755)).To(Succeed())
+					testfixtures.WriteImage(otherDir, "base-layer")
+					otherUri := layout.URI(otherDir)
+
+					Expect(cli.Run([]string{"verify", "--certs", certDirectory, "--image", imageUri, "--image", otherUri}, stdout, stderr)).To(Equal(1))
+					Expect(stdout.String()).To(ContainSubstring(imageUri + " trusts 1 of 1 certificates"))
+					Expect(stdout.String()).To(ContainSubstring(otherUri + ": read layer: "))
+				})
+			})
+		})
+
+		Describe("inject", func() {
+			var (
+				logFile   string
+				toolFlags []string
+				imageUri  string
+			)
+
+			BeforeEach(func() {
+				logFile = filepath.Join(tempDir, "calls.log")
+				toolFlags = fakeToolFlags(logFile)
+
+				imageDir := filepath.Join(tempDir, "image")
+				Expect(os.Mkdir(imageDir, 0755)).To(Succeed())
+				testfixtures.WriteImage(imageDir, "base-layer")
+				imageUri = layout.URI(imageDir)
+			})
+
+			It("injects the certificates into every image using named flags", func() {
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--output", "json"}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				Expect(stdout.String()).To(MatchJSON(`[{"image": "` + imageUri + `", "status": "success"}]`))
+
+				calls := fakeToolCalls(logFile)
+				Expect(calls).To(HaveLen(6))
+				Expect(calls[0]).To(Equal([]string{"remove-layer", "-ociImage", imageUri}))
+				Expect(calls[1][:4]).To(Equal([]string{"--driver-store", "some-driver-store", "create", imageUri}))
+				Expect(calls[4][:4]).To(Equal([]string{"add-layer", "-ociImage", imageUri, "-layer"}))
+			})
+
+			It("stages the certificates of every source into one directory", func() {
+				bundleFile := filepath.Join(tempDir, "bundle.pem")
+				Expect(os.WriteFile(bundleFile, testfixtures.ToPEM(testfixtures.GenerateCA("first"), testfixtures.GenerateCA("second")), 0644)).To(Succeed())
+				GinkgoT().Setenv("TRUSTED_CERTS", string(testfixtures.ToPEM(testfixtures.GenerateCA("third"))))
+				reportFile := filepath.Join(tempDir, "report.json")
+				runTempDir := filepath.Join(tempDir, "tmp")
+				Expect(os.Mkdir(runTempDir, 0755)).To(Succeed())
+				GinkgoT().Setenv("TMPDIR", runTempDir)
+
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--certs", bundleFile, "--certs", "env:TRUSTED_CERTS", "--image", imageUri, "--report", reportFile}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				var r struct {
+					Certificates []struct {
+						File string `json:"file"`
+					} `json:"certificates"`
+				}
+				data, err := os.ReadFile(reportFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(json.Unmarshal(data, &r)).To(Succeed())
+				Expect(r.Certificates).To(HaveLen(4))
+
+				staged, err := filepath.Glob(filepath.Join(runTempDir, "cert-injector-certs-*"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(staged).To(BeEmpty())
+			})
+
+			It("fails with the validate exit code when a source cannot be parsed", func() {
+				GinkgoT().Setenv("TRUSTED_CERTS", "garbage")
+
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", "env:TRUSTED_CERTS", "--image", imageUri}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(10))
+				Expect(stderr.String()).To(ContainSubstring("TRUSTED_CERTS: not a PEM, DER or PKCS#7 encoded certificate"))
+				Expect(logFile).NotTo(BeAnExistingFile())
+			})
+
+			It("writes a report of the run with --report", func() {
+				reportFile := filepath.Join(tempDir, "report.json")
+				missingUri := layout.URI(filepath.Join(tempDir, "missing"))
+				args := append([]string{"inject", "--keep-going", "--report", reportFile, "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--image", missingUri}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(11))
+
+				data, err := os.ReadFile(reportFile)
+				Expect(err).NotTo(HaveOccurred())
+
+				var report struct {
+					Version      string `json:"version"`
+					Certificates []struct {
+						Subject  string `json:"subject"`
+						Issuer   string `json:"issuer"`
+						SHA256   string `json:"sha256_fingerprint"`
+						NotAfter string `json:"not_after"`
+					} `json:"certificates"`
+					Images []struct {
+						Image        string           `json:"image"`
+						Status       string           `json:"status"`
+						Step         string           `json:"step"`
+						Error        string           `json:"error"`
+						BundleDigest string           `json:"bundle_digest"`
+						LayerDigest  string           `json:"layer_digest"`
+						TimingsMs    map[string]int64 `json:"timings_ms"`
+					} `json:"images"`
+				}
+				Expect(json.Unmarshal(data, &report)).To(Succeed())
+				Expect(report.Version).To(Equal("dev"))
+
+				Expect(report.Certificates).To(HaveLen(1))
+				Expect(report.Certificates[0].Subject).To(Equal("CN=some-ca"))
+				Expect(report.Certificates[0].Issuer).To(Equal("CN=some-ca"))
+				Expect(report.Certificates[0].SHA256).To(MatchRegexp(`^[0-9a-f]{64}$`))
+				Expect(report.Certificates[0].NotAfter).NotTo(BeEmpty())
+
+				Expect(report.Images).To(HaveLen(2))
+				Expect(report.Images[0].Image).To(Equal(imageUri))
+				Expect(report.Images[0].Status).To(Equal("success"))
+				Expect(report.Images[0].BundleDigest).To(HavePrefix("sha256:"))
+				Expect(report.Images[0].LayerDigest).To(HavePrefix("sha256:"))
+				Expect(report.Images[0].TimingsMs).To(HaveKey("winc-run"))
+				Expect(report.Images[0].TimingsMs).To(HaveKey("add-layer"))
+
+				Expect(report.Images[1].Image).To(Equal(missingUri))
+				Expect(report.Images[1].Status).To(Equal("failed"))
+				Expect(report.Images[1].Step).To(Equal("snapshot"))
+				Expect(report.Images[1].Error).To(ContainSubstring("snapshot image"))
+			})
+
+			It("reports a volume that groot failed to delete and deletes it on the next run", func() {
+				stateFile := filepath.Join(tempDir, "state", "state.json")
+				retryConfig := filepath.Join(tempDir, "retries.json")
+				Expect(os.WriteFile(retryConfig, []byte(`{}`), 0644)).To(Succeed())
+				args := append([]string{"inject", "--force", "--state-file", stateFile, "--retry-config", retryConfig, "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+
+				GinkgoT().Setenv("CERT_INJECTOR_FAKE_TOOL_FAIL", "delete")
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(18))
+				Expect(stderr.String()).To(MatchRegexp(`cert-injector failed: groot delete layer-\w+ failed: exit status 1`))
+
+				var s struct {
+					LeakedCount int `json:"leaked_count"`
+					Leaks       []struct {
+						DriverStore string `json:"driver_store"`
+						ContainerId string `json:"container_id"`
+					} `json:"leaks"`
+				}
+				data, err := os.ReadFile(stateFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(json.Unmarshal(data, &s)).To(Succeed())
+				Expect(s.LeakedCount).To(Equal(1))
+				Expect(s.Leaks).To(HaveLen(1))
+				Expect(s.Leaks[0].DriverStore).To(Equal("some-driver-store"))
+				leaked := s.Leaks[0].ContainerId
+
+				By("deleting the leaked volume before injecting again")
+				os.Unsetenv("CERT_INJECTOR_FAKE_TOOL_FAIL")
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				calls := fakeToolCalls(logFile)
+				Expect(calls[6]).To(Equal([]string{"--driver-store", "some-driver-store", "delete", leaked}))
+
+				data, err = os.ReadFile(stateFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(json.Unmarshal(data, &s)).To(Succeed())
+				Expect(s.LeakedCount).To(Equal(1))
+				Expect(s.Leaks).To(BeEmpty())
+			})
+
+			Describe("--layer-builder", func() {
+				It("writes the layer without running a container when native", func() {
+					args := append([]string{"inject", "--layer-builder", "native", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+					calls := fakeToolCalls(logFile)
+					Expect(calls).To(HaveLen(2))
+					Expect(calls[0]).To(Equal([]string{"remove-layer", "-ociImage", imageUri}))
+					Expect(calls[1][:4]).To(Equal([]string{"add-layer", "-ociImage", imageUri, "-layer"}))
+				})
+
+				It("plans only the hydrate steps when native", func() {
+					args := append([]string{"inject", "--dry-run", "--layer-builder", "native", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+					Expect(stdout.String()).To(MatchRegexp(`2\. \[add-layer\] \S+ add-layer -ociImage ` + regexp.QuoteMeta(imageUri) + ` -layer <diff-output-file>`))
+					Expect(stdout.String()).To(ContainSubstring("layer written to <diff-output-file> without running a container"))
+					Expect(stdout.String()).NotTo(ContainSubstring("winc-run"))
+				})
+
+				It("rejects an unknown builder", func() {
+					args := append([]string{"inject", "--layer-builder", "magic", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+					Expect(stderr.String()).To(ContainSubstring(`invalid layer builder "magic": must be container or native`))
+				})
+			})
+
+			Describe("--layout-writer", func() {
+				It("edits the image without any tool installed when native", func() {
+					missing := filepath.Join(tempDir, "missing.exe")
+					noTools := []string{"--groot-bin", missing, "--winc-bin", missing, "--diff-exporter-bin", missing, "--hydrate-bin", missing}
+
+					args := append([]string{"inject", "--layout-writer", "native", "--layer-builder", "native", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, noTools...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+					digest, err := layout.NewLayout().LayerAnnotation(imageUri, injector.BundleDigestAnnotation)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(digest).To(HavePrefix("sha256:"))
+
+					By("removing the layer again")
+					args = append([]string{"remove", "--layout-writer", "native", "--image", imageUri}, noTools...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+					layerDigest, err := layout.NewLayout().LayerDigest(imageUri)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(layerDigest).To(Equal(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("base-layer")))))
+				})
+
+				It("checks only hydrate for a plain remove", func() {
+					missing := filepath.Join(tempDir, "missing.exe")
+					args := []string{"remove", "--image", imageUri, "--groot-bin", missing, "--winc-bin", missing, "--diff-exporter-bin", missing, "--hydrate-bin", os.Args[0]}
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+					Expect(fakeToolCalls(logFile)).To(Equal([][]string{{"remove-layer", "-ociImage", imageUri}}))
+
+					By("still checking every tool when a layer is built to purge certificates")
+					args = append(args, "--driver-store", "some-driver-store", "--purge-thumbprint", "0123456789ABCDEF0123456789ABCDEF01234567")
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(1))
+					Expect(stderr.String()).To(ContainSubstring("groot: "))
+				})
+
+				It("keeps purged certificates deleted when certificates are injected again", func() {
+					const thumbprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+					inject := append([]string{"inject", "--layout-writer", "native", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(inject, stdout, stderr)).To(Equal(0), stderr.String())
+
+					purge := append([]string{"remove", "--layout-writer", "native", "--driver-store", "some-driver-store", "--image", imageUri, "--purge-thumbprint", thumbprint}, toolFlags...)
+					Expect(cli.Run(purge, stdout, stderr)).To(Equal(0), stderr.String())
+
+					layers, err := layout.NewLayout().CustomLayers(imageUri)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(layers).To(HaveLen(1))
+					Expect(layers[0]).To(HaveKeyWithValue(injector.RemovedThumbprintsAnnotation, thumbprint))
+					Expect(layers[0]).NotTo(HaveKey(injector.BundleDigestAnnotation))
+
+					Expect(cli.Run(inject, stdout, stderr)).To(Equal(0), stderr.String())
+
+					layers, err = layout.NewLayout().CustomLayers(imageUri)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(layers).To(HaveLen(1))
+					Expect(layers[0]).To(HaveKeyWithValue(injector.RemovedThumbprintsAnnotation, thumbprint))
+					Expect(layers[0]).To(HaveKeyWithValue(injector.BundleDigestAnnotation, HavePrefix("sha256:")))
+
+					By("refusing to inject with the native layer builder, which cannot delete certificates")
+					native := append([]string{"inject", "--force", "--layout-writer", "native", "--layer-builder", "native", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(native, stdout, stderr)).To(Equal(19))
+					Expect(stderr.String()).To(ContainSubstring("deletes certificates " + thumbprint))
+				})
+
+				It("restores the image when the layer deleting purged certificates cannot be built", func() {
+					inject := append([]string{"inject", "--layout-writer", "native", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(inject, stdout, stderr)).To(Equal(0), stderr.String())
+
+					layerDigest, err := layout.NewLayout().LayerDigest(imageUri)
+					Expect(err).NotTo(HaveOccurred())
+					layers, err := layout.NewLayout().CustomLayers(imageUri)
+					Expect(err).NotTo(HaveOccurred())
+
+					GinkgoT().Setenv("CERT_INJECTOR_FAKE_TOOL_FAIL", "run")
+					purge := append([]string{"remove", "--layout-writer", "native", "--driver-store", "some-driver-store", "--image", imageUri, "--purge-thumbprint", "0123456789ABCDEF0123456789ABCDEF01234567"}, toolFlags...)
+					Expect(cli.Run(purge, stdout, stderr)).To(Equal(15))
+
+					restoredDigest, err := layout.NewLayout().LayerDigest(imageUri)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(restoredDigest).To(Equal(layerDigest))
+					restored, err := layout.NewLayout().CustomLayers(imageUri)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(restored).To(Equal(layers))
+					Expect(restored[0]).To(HaveKeyWithValue(injector.BundleDigestAnnotation, HavePrefix("sha256:")))
+				})
+
+				It("rejects an unknown writer", func() {
+					args := append([]string{"inject", "--layout-writer", "magic", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+					Expect(stderr.String()).To(ContainSubstring(`invalid layout writer "magic": must be hydrate or native`))
+				})
+			})
+
+			Describe("docker:// images", func() {
+				const dockerUri = "docker://127.0.0.1:1/windows:1809"
+
+				It("exits with the code of the pull step when the registry cannot be reached", func() {
+					args := append([]string{"inject", "--pull-dir", filepath.Join(tempDir, "images"), "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", dockerUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(20))
+					Expect(stderr.String()).To(ContainSubstring("pull " + dockerUri + " failed: GET http://127.0.0.1:1/v2/windows/manifests/1809"))
+					Expect(fakeToolCalls(logFile)).To(BeEmpty())
+				})
+
+				It("plans the pull and push around the local copy", func() {
+					server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						Expect(req.URL.Path).To(Equal("/v2/windows/manifests/1809"))
+						w.Header().Set("Content-Type", layout.MediaTypeDockerManifest)
+						fmt.Fprintf(w, `{"schemaVersion":2,"mediaType":%q,"layers":[]}`, layout.MediaTypeDockerManifest)
+					}))
+					DeferCleanup(server.Close)
+					servedUri := "docker://" + strings.TrimPrefix(server.URL, "http://") + "/windows:1809"
+
+					args := append([]string{"inject", "--dry-run", "--layer-builder", "native", "--pull-dir", filepath.Join(tempDir, "images"), "--push-tag", "1809-certs", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", servedUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+					Expect(stdout.String()).To(ContainSubstring(servedUri + " would trust certificates"))
+					Expect(stdout.String()).To(MatchRegexp(`1\. \[pull\] registry\.Client ` + regexp.QuoteMeta(servedUri) + ` \S+127\.0\.0\.1_\d+_windows_1809-`))
+					Expect(stdout.String()).To(MatchRegexp(`4\. \[push\] registry\.Client \S+ ` + regexp.QuoteMeta(servedUri) + ` 1809-certs`))
+				})
+
+				It("fails to plan when the registry cannot be reached", func() {
+					args := append([]string{"inject", "--dry-run", "--layer-builder", "native", "--pull-dir", filepath.Join(tempDir, "images"), "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", dockerUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(1))
+					Expect(stderr.String()).To(ContainSubstring("resolve " + dockerUri + " failed: GET http://127.0.0.1:1/v2/windows/manifests/1809"))
+				})
+			})
+
+			Describe("--dry-run", func() {
+				It("prints the planned commands and config without running anything", func() {
+					args := append([]string{"inject", "--dry-run", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+					Expect(fakeToolCalls(logFile)).To(BeEmpty())
+					Expect(stdout.String()).To(ContainSubstring(imageUri + " would trust certificates sha256:"))
+					Expect(stdout.String()).To(MatchRegexp(`1\. \[remove-layer\] \S+ remove-layer -ociImage ` + regexp.QuoteMeta(imageUri)))
+					Expect(stdout.String()).To(MatchRegexp(`3\. \[winc-run\] \S+ run -b <bundle-dir> layer-\w+`))
+					Expect(stdout.String()).To(MatchRegexp(`6\. \[groot-delete\] \S+ --driver-store some-driver-store delete layer-\w+`))
+					Expect(stdout.String()).To(ContainSubstring(`"path": "<volume-path>"`))
+					Expect(stdout.String()).To(ContainSubstring("Import-Certificate"))
+				})
+
+				It("generates the config from the given groot output", func() {
+					grootOutput := filepath.Join(tempDir, "groot-output.json")
+					Expect(os.WriteFile(grootOutput, []byte(`{"ociVersion":"1.0.2","root":{"path":"\\\\?\\Volume{1234}\\"}}`), 0644)).To(Succeed())
+
+					args := append([]string{"inject", "--dry-run", "--groot-output", grootOutput, "--output", "json", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+					var plans []struct {
+						Image    string `json:"image"`
+						Skip     bool   `json:"skip"`
+						Commands []struct {
+							Step string `json:"step"`
+						} `json:"commands"`
+						Config struct {
+							Root struct {
+								Path string `json:"path"`
+							} `json:"root"`
+							Mounts []struct {
+								Source string `json:"source"`
+							} `json:"mounts"`
+						} `json:"config"`
+					}
+					Expect(json.Unmarshal(stdout.Bytes(), &plans)).To(Succeed())
+					Expect(plans).To(HaveLen(1))
+					Expect(plans[0].Image).To(Equal(imageUri))
+					Expect(plans[0].Commands).To(HaveLen(6))
+					Expect(plans[0].Config.Root.Path).To(Equal(`\\?\Volume{1234}\`))
+					Expect(plans[0].Config.Mounts[0].Source).To(Equal("<certs-dir>"))
+					Expect(fakeToolCalls(logFile)).To(BeEmpty())
+				})
+
+				It("reports images that would be skipped", func() {
+					args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+					stdout.Reset()
+
+					Expect(cli.Run(append(args, "--dry-run"), stdout, stderr)).To(Equal(0), stderr.String())
+					Expect(stdout.String()).To(ContainSubstring(imageUri + " already trusts certificates sha256:"))
+					Expect(fakeToolCalls(logFile)).To(HaveLen(6))
+				})
+			})
+
+			It("keeps supporting positional arguments", func() {
+				args := append(toolFlags, "some-driver-store", certDirectory, imageUri)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				Expect(fakeToolCalls(logFile)).To(HaveLen(6))
+
+				By("skipping the image the second time since the certificates have not changed")
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+				Expect(fakeToolCalls(logFile)).To(HaveLen(6))
+				Expect(stdout.String()).To(ContainSubstring("skipping"))
+
+				By("rebuilding the layer with --force")
+				Expect(cli.Run(append([]string{"--force"}, args...), stdout, stderr)).To(Equal(0), stderr.String())
+				Expect(fakeToolCalls(logFile)).To(HaveLen(12))
+			})
+
+			It("logs pipeline steps as JSON by default", func() {
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				var event map[string]interface{}
+				line, _, _ := strings.Cut(stdout.String(), "\n")
+				Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+				Expect(event).To(HaveKeyWithValue("image", imageUri))
+				Expect(event).To(HaveKeyWithValue("step", "validate"))
+				Expect(event).To(HaveKeyWithValue("duration_ms", BeNumerically(">=", 0)))
+			})
+
+			It("logs pipeline steps as text with --log-format text", func() {
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--log-format", "text"}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+				Expect(stdout.String()).To(MatchRegexp(`level=INFO msg="step completed" image=\S+ container_id=layer-\w+ attempt=1 step=winc-run duration_ms=\d+ exit_code=0`))
+			})
+
+			It("rejects an invalid log format", func() {
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--log-format", "xml"}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring(`invalid log format "xml"`))
+			})
+
+			It("retries and then fails when a tool keeps failing", func() {
+				GinkgoT().Setenv("CERT_INJECTOR_FAKE_TOOL_FAIL", "run")
+				retryConfig := filepath.Join(tempDir, "retries.json")
+				Expect(os.WriteFile(retryConfig, []byte(`{"winc-run": {"max_attempts": 2, "initial_backoff": "1ms", "retryable_stderr": ["unhappy"]}}`), 0644)).To(Succeed())
+
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--retry-config", retryConfig, "--output", "json"}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(15))
+				Expect(stderr.String()).To(ContainSubstring(`"msg":"retrying step"`))
+				Expect(stderr.String()).To(ContainSubstring("cert-injector failed: winc run failed"))
+
+				var results []map[string]interface{}
+				Expect(json.Unmarshal(stdout.Bytes(), &results)).To(Succeed())
+				Expect(results[0]).To(HaveKeyWithValue("retries", map[string]interface{}{"winc-run": 1.0}))
+				Expect(results[0]).To(HaveKeyWithValue("exit_code", 1.0))
+			})
+
+			It("rejects an invalid retry config", func() {
+				retryConfig := filepath.Join(tempDir, "retries.json")
+				Expect(os.WriteFile(retryConfig, []byte(`{"winc-run": {"initial_backoff": "soon"}}`), 0644)).To(Succeed())
+
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--retry-config", retryConfig}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring("retry config for winc-run: initial_backoff"))
+			})
+
+			It("injects into several images at once with --parallelism", func() {
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--parallelism", "3"}, toolFlags...)
+				uris := []string{imageUri}
+				for _, name := range []string{"second", "third"} {
+					dir := filepath.Join(tempDir, name)
+					Expect(os.Mkdir(dir, 0755)).To(Succeed())
+					testfixtures.WriteImage(dir, "base-layer")
+					uris = append(uris, layout.URI(dir))
+				}
+				for _, uri := range append(uris, imageUri) {
+					args = append(args, "--image", uri)
+				}
+
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				calls := fakeToolCalls(logFile)
+				Expect(calls).To(HaveLen(18))
+
+				containerIds := map[string]bool{}
+				imagesCreated := map[string]bool{}
+				for _, call := range calls {
+					if call[2] == "create" {
+						containerIds[call[4]] = true
+						imagesCreated[call[3]] = true
+					}
+				}
+				Expect(containerIds).To(HaveLen(3))
+				Expect(imagesCreated).To(HaveLen(3))
+			})
+
+			It("rejects a parallelism below one", func() {
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--parallelism", "0"}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring("--parallelism must be at least 1"))
+			})
+
+			Context("when one of several images fails", func() {
+				var (
+					missingUri string
+					args       []string
+				)
+
+				BeforeEach(func() {
+					missingUri = layout.URI(filepath.Join(tempDir, "missing"))
+					args = append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", missingUri, "--image", imageUri}, toolFlags...)
+				})
+
+				It("stops at the first failure by default", func() {
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(11))
+					Expect(fakeToolCalls(logFile)).To(BeEmpty())
+				})
+
+				It("tries every image with --keep-going and prints a summary", func() {
+					Expect(cli.Run(append(args, "--keep-going"), stdout, stderr)).To(Equal(11))
+					Expect(fakeToolCalls(logFile)).To(HaveLen(6))
+
+					Expect(stdout.String()).To(MatchRegexp(`IMAGE\s+STATUS\s+STEP\s+RETRIES\s+ERROR`))
+					Expect(stdout.String()).To(MatchRegexp(regexp.QuoteMeta(missingUri) + `\s+failed\s+snapshot\s+-\s+snapshot image`))
+					Expect(stdout.String()).To(MatchRegexp(regexp.QuoteMeta(imageUri) + `\s+success\s+-\s+-\s+-`))
+				})
+
+				It("reports each result as json", func() {
+					Expect(cli.Run(append(args, "--keep-going", "--output", "json"), stdout, stderr)).To(Equal(11))
+
+					var results []map[string]string
+					Expect(json.Unmarshal(stdout.Bytes(), &results)).To(Succeed())
+					Expect(results).To(HaveLen(2))
+					Expect(results[0]).To(HaveKeyWithValue("status", "failed"))
+					Expect(results[0]).To(HaveKeyWithValue("step", "snapshot"))
+					Expect(results[0]["error"]).To(ContainSubstring("snapshot image"))
+					Expect(results[1]).To(Equal(map[string]string{"image": imageUri, "status": "success"}))
+				})
+			})
+
+			It("kills a tool that exceeds its timeout", func() {
+				noRetries := filepath.Join(tempDir, "retries.json")
+				Expect(os.WriteFile(noRetries, []byte(`{"winc-run": {"max_attempts": 1}}`), 0644)).To(Succeed())
+				GinkgoT().Setenv("CERT_INJECTOR_FAKE_TOOL_HANG", "run")
+
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--timeout", "winc-run=200ms", "--retry-config", noRetries}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(15))
+				Expect(stderr.String()).To(ContainSubstring("winc run failed: timed out after 200ms"))
+			})
+
+			Context("when another run holds a lock", func() {
+				var lockDir string
+
+				BeforeEach(func() {
+					lockDir = filepath.Join(tempDir, "locks")
+				})
+
+				It("fails naming the process that holds the driver store", func() {
+					held, err := lock.NewLocker(lockDir).Acquire(context.Background(), "driver store some-driver-store", 0)
+					Expect(err).NotTo(HaveOccurred())
+					defer held.Release()
+
+					args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--lock-dir", lockDir, "--lock-timeout", "0"}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(1))
+					Expect(stderr.String()).To(ContainSubstring(fmt.Sprintf("timed out after 0s waiting for the lock on driver store some-driver-store held by process %d", os.Getpid())))
+					Expect(logFile).NotTo(BeAnExistingFile())
+				})
+
+				It("fails only the image that is held", func() {
+					otherDir := filepath.Join(tempDir, "other-image")
+					Expect(os.Mkdir(otherDir, 0755)).To(Succeed())
+					testfixtures.WriteImage(otherDir, "base-layer")
+					otherUri := layout.URI(otherDir)
+
+					held, err := lock.NewLocker(lockDir).Acquire(context.Background(), "image "+otherUri, 0)
+					Expect(err).NotTo(HaveOccurred())
+					defer held.Release()
+
+					args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--image", otherUri, "--keep-going", "--output", "json", "--lock-dir", lockDir, "--lock-timeout", "0"}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(1))
+
+					var results []map[string]string
+					Expect(json.Unmarshal(stdout.Bytes(), &results)).To(Succeed())
+					Expect(results).To(HaveLen(2))
+					Expect(results[0]).To(HaveKeyWithValue("status", "success"))
+					Expect(results[1]).To(HaveKeyWithValue("status", "failed"))
+					Expect(results[1]["error"]).To(ContainSubstring("waiting for the lock on image " + otherUri))
+				})
+
+				It("waits for the lock to be released", func() {
+					held, err := lock.NewLocker(lockDir).Acquire(context.Background(), "image "+imageUri, 0)
+					Expect(err).NotTo(HaveOccurred())
+					time.AfterFunc(300*time.Millisecond, func() { held.Release() })
+
+					args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--lock-dir", lockDir, "--lock-timeout", "10s"}, toolFlags...)
+					Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+				})
+			})
+
+			It("rejects timeouts for unknown steps", func() {
+				args := append([]string{"inject", "--driver-store", "some-driver-store", "--certs", certDirectory, "--image", imageUri, "--timeout", "banana=1m"}, toolFlags...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring(`unknown step "banana"`))
+			})
+
+			It("requires a driver store, certificates and images", func() {
+				Expect(cli.Run([]string{"inject", "--certs", certDirectory}, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring("inject requires --driver-store, --certs and at least one --image"))
+			})
+		})
+
+		Describe("tool paths", func() {
+			var (
+				logFile  string
+				imageUri string
+			)
+
+			BeforeEach(func() {
+				logFile = filepath.Join(tempDir, "calls.log")
+				GinkgoT().Setenv("CERT_INJECTOR_FAKE_TOOL_LOG", logFile)
+
+				imageDir := filepath.Join(tempDir, "image")
+				Expect(os.Mkdir(imageDir, 0755)).To(Succeed())
+				testfixtures.WriteImage(imageDir, "base-layer")
+				imageUri = layout.URI(imageDir)
+			})
+
+			It("reads the tool paths from a config file", func() {
+				configFile := filepath.Join(tempDir, "tools.json")
+				config := fmt.Sprintf(`{"groot": %q, "winc": %q, "diff_exporter": %q, "hydrate": %q}`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+				Expect(os.WriteFile(configFile, []byte(config), 0644)).To(Succeed())
+
+				Expect(cli.Run([]string{"remove", "--tools-config", configFile, "--image", imageUri}, stdout, stderr)).To(Equal(0), stderr.String())
+				Expect(fakeToolCalls(logFile)).To(HaveLen(1))
+			})
+
+			It("prefers environment variables over the config file", func() {
+				configFile := filepath.Join(tempDir, "tools.json")
+				Expect(os.WriteFile(configFile, []byte(`{"hydrate": "/missing/hydrate.exe"}`), 0644)).To(Succeed())
+				for _, env := range []string{"CERT_INJECTOR_GROOT_BIN", "CERT_INJECTOR_WINC_BIN", "CERT_INJECTOR_DIFF_EXPORTER_BIN", "CERT_INJECTOR_HYDRATE_BIN"} {
+					GinkgoT().Setenv(env, os.Args[0])
+				}
+
+				Expect(cli.Run([]string{"remove", "--tools-config", configFile, "--image", imageUri}, stdout, stderr)).To(Equal(0), stderr.String())
+				Expect(fakeToolCalls(logFile)).To(HaveLen(1))
+			})
+
+			It("fails before running anything when a tool is missing", func() {
+				args := append(fakeToolFlags(logFile), "--hydrate-bin", filepath.Join(tempDir, "missing.exe"))
+				Expect(cli.Run(append([]string{"remove", "--image", imageUri}, args...), stdout, stderr)).To(Equal(1))
+
+				Expect(stderr.String()).To(ContainSubstring("invalid tools: hydrate: " + filepath.Join(tempDir, "missing.exe") + " does not exist"))
+				Expect(fakeToolCalls(logFile)).To(BeEmpty())
+			})
+		})
+
+		Describe("gc", func() {
+			var (
+				logFile     string
+				driverStore string
+				gcTempDir   string
+				stateFile   string
+				args        []string
+			)
+
+			BeforeEach(func() {
+				logFile = filepath.Join(tempDir, "calls.log")
+				driverStore = filepath.Join(tempDir, "driver-store")
+				gcTempDir = filepath.Join(tempDir, "tmp")
+				stateFile = filepath.Join(tempDir, "state.json")
+				GinkgoT().Setenv("TMPDIR", gcTempDir)
+
+				old := time.Now().Add(-2 * time.Hour)
+				for _, path := range []string{
+					filepath.Join(driverStore, "volumes", "layer-00000000000000ff"),
+					filepath.Join(gcTempDir, "layer-00000000000000ff-123"),
+				} {
+					Expect(os.MkdirAll(path, 0755)).To(Succeed())
+					Expect(os.Chtimes(path, old, old)).To(Succeed())
+				}
+				diffOutput := filepath.Join(gcTempDir, "diff-output-layer-00000000000000ff-456")
+				Expect(os.WriteFile(diffOutput, []byte("layer"), 0644)).To(Succeed())
+				Expect(os.Chtimes(diffOutput, old, old)).To(Succeed())
+				Expect(os.WriteFile(stateFile, []byte(`{"leaked_count":1,"leaks":[{"driver_store":"`+filepath.ToSlash(driverStore)+`","container_id":"layer-leaked"}]}`), 0644)).To(Succeed())
+
+				args = append([]string{"gc", "--driver-store", filepath.ToSlash(driverStore), "--state-file", stateFile}, fakeToolFlags(logFile)...)
+			})
+
+			It("lists the leftovers without deleting anything with --dry-run", func() {
+				Expect(cli.Run(append(args, "--dry-run"), stdout, stderr)).To(Equal(0), stderr.String())
+
+				Expect(stdout.String()).To(ContainSubstring("would delete volume layer-leaked\n"))
+				Expect(stdout.String()).To(ContainSubstring("would delete volume layer-00000000000000ff\n"))
+				Expect(stdout.String()).To(ContainSubstring("would remove " + filepath.Join(gcTempDir, "diff-output-layer-00000000000000ff-456")))
+				Expect(stdout.String()).To(ContainSubstring("found 2 volumes and 2 temp paths"))
+				Expect(fakeToolCalls(logFile)).To(BeEmpty())
+				Expect(filepath.Join(gcTempDir, "layer-00000000000000ff-123")).To(BeADirectory())
+			})
+
+			It("deletes the leftovers and reports what it reclaimed", func() {
+				Expect(cli.Run(append(args, "--output", "json"), stdout, stderr)).To(Equal(0), stderr.String())
+
+				Expect(stdout.String()).To(MatchJSON(`{
+					"dry_run": false,
+					"volumes": ["layer-leaked", "layer-00000000000000ff"],
+					"paths": [` + fmt.Sprintf("%q, %q", filepath.Join(gcTempDir, "diff-output-layer-00000000000000ff-456"), filepath.Join(gcTempDir, "layer-00000000000000ff-123")) + `],
+					"bytes": 5
+				}`))
+				Expect(fakeToolCalls(logFile)).To(Equal([][]string{
+					{"delete", "layer-leaked"},
+					{"--driver-store", filepath.ToSlash(driverStore), "delete", "layer-leaked"},
+					{"delete", "layer-00000000000000ff"},
+					{"--driver-store", filepath.ToSlash(driverStore), "delete", "layer-00000000000000ff"},
+				}))
+				Expect(filepath.Join(gcTempDir, "layer-00000000000000ff-123")).NotTo(BeAnExistingFile())
+
+				data, err := os.ReadFile(stateFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("layer-leaked"))
+			})
+
+			It("requires a driver store", func() {
+				Expect(cli.Run([]string{"gc"}, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring("gc requires --driver-store"))
+			})
+		})
+
+		Describe("remove", func() {
+			var (
+				logFile  string
+				firstUri string
+			)
+
+			BeforeEach(func() {
+				logFile = filepath.Join(tempDir, "calls.log")
+
+				firstDir := filepath.Join(tempDir, "first")
+				Expect(os.Mkdir(firstDir, 0755)).To(Succeed())
+				testfixtures.WriteImage(firstDir, "base-layer")
+				firstUri = layout.URI(firstDir)
+			})
+
+			It("removes the certificate layer from every image", func() {
+				secondDir := filepath.Join(tempDir, "second")
+				Expect(os.Mkdir(secondDir, 0755)).To(Succeed())
+				testfixtures.WriteImage(secondDir, "base-layer")
+				secondUri := layout.URI(secondDir)
+
+				args := append([]string{"remove", "--image", firstUri, "--image", secondUri}, fakeToolFlags(logFile)...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				Expect(fakeToolCalls(logFile)).To(Equal([][]string{
+					{"remove-layer", "-ociImage", firstUri},
+					{"remove-layer", "-ociImage", secondUri},
+				}))
+				Expect(stdout.String()).To(ContainSubstring("removed certificate layer from " + secondUri))
+			})
+
+			It("adds a layer deleting the given thumbprints with --purge-thumbprint", func() {
+				args := append([]string{"remove", "--image", firstUri, "--driver-store", "some-driver-store", "--purge-thumbprint", "01:23:45:67:89:ab:cd:ef:01:23:45:67:89:ab:cd:ef:01:23:45:67"}, fakeToolFlags(logFile)...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(0), stderr.String())
+
+				calls := fakeToolCalls(logFile)
+				Expect(calls).To(HaveLen(6))
+				Expect(calls[0]).To(Equal([]string{"remove-layer", "-ociImage", firstUri}))
+				Expect(calls[1][:4]).To(Equal([]string{"--driver-store", "some-driver-store", "create", firstUri}))
+				Expect(calls[4][:3]).To(Equal([]string{"add-layer", "-ociImage", firstUri}))
+				Expect(stdout.String()).To(ContainSubstring("added a layer to " + firstUri + " that deletes certificates 0123456789ABCDEF0123456789ABCDEF01234567"))
+			})
+
+			It("rejects invalid thumbprints and a missing driver store", func() {
+				args := append([]string{"remove", "--image", firstUri, "--driver-store", "some-driver-store", "--purge-thumbprint", "abc"}, fakeToolFlags(logFile)...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring(`invalid thumbprint "abc"`))
+
+				args = append([]string{"remove", "--image", firstUri, "--purge-thumbprint", "0123456789ABCDEF0123456789ABCDEF01234567"}, fakeToolFlags(logFile)...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(2))
+				Expect(stderr.String()).To(ContainSubstring("--purge-thumbprint requires --driver-store"))
+			})
+
+			It("exits with the code of the remove-layer step when hydrate fails", func() {
+				GinkgoT().Setenv("CERT_INJECTOR_FAKE_TOOL_FAIL", "remove-layer")
+				retryConfig := filepath.Join(tempDir, "retries.json")
+				Expect(os.WriteFile(retryConfig, []byte(`{}`), 0644)).To(Succeed())
+
+				args := append([]string{"remove", "--image", firstUri, "--retry-config", retryConfig}, fakeToolFlags(logFile)...)
+				Expect(cli.Run(args, stdout, stderr)).To(Equal(12))
+				Expect(stderr.String()).To(ContainSubstring("cert-injector failed: hydrate remove-layer -ociImage " + firstUri + " failed: exit status 1"))
+			})
+		})
+	})
+})
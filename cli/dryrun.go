@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"code.cloudfoundry.org/cert-injector/injector"
+)
+
+type planCommand struct {
+	Step       string   `json:"step"`
+	Executable string   `json:"executable"`
+	Args       []string `json:"args"`
+}
+
+type planResult struct {
+	Image    string          `json:"image"`
+	Digest   string          `json:"digest"`
+	Skip     bool            `json:"skip"`
+	Commands []planCommand   `json:"commands,omitempty"`
+	Config   json.RawMessage `json:"config,omitempty"`
+}
+
+// dryRunAll prints the plan of every image. Nothing is run and no image is
+// changed.
+func dryRunAll(inj injector.Injector, driverStore, certDirectory string, images []string, grootOutputFile, output string, stdout, stderr io.Writer) int {
+	var grootOutput string
+	if grootOutputFile != "" {
+		data, err := os.ReadFile(grootOutputFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "cert-injector failed: read groot output: %s\n", err)
+			return exitFailure
+		}
+		grootOutput = string(data)
+	}
+
+	var plans []planResult
+	for _, uri := range images {
+		plan, err := inj.Plan(driverStore, uri, certDirectory, grootOutput)
+		if err != nil {
+			fmt.Fprintf(stderr, "cert-injector failed: %s: %s\n", uri, err)
+			return exitFailure
+		}
+
+		result := planResult{Image: plan.Image, Digest: plan.Digest, Skip: plan.Skip, Config: plan.Config}
+		for _, c := range plan.Commands {
+			result.Commands = append(result.Commands, planCommand{Step: string(c.Step), Executable: c.Executable, Args: c.Args})
+		}
+		plans = append(plans, result)
+
+		if output == outputText {
+			writePlan(stdout, plan)
+		}
+	}
+
+	if output == outputJSON {
+		return writeJSON(stdout, stderr, plans)
+	}
+	return exitSuccess
+}
+
+func writePlan(w io.Writer, plan injector.Plan) {
+	if plan.Skip {
+		fmt.Fprintf(w, "%s already trusts certificates %s, would skip\n", plan.Image, plan.Digest)
+		return
+	}
+
+	fmt.Fprintf(w, "%s would trust certificates %s:\n", plan.Image, plan.Digest)
+	for n, c := range plan.Commands {
+		fmt.Fprintf(w, "  %d. [%s] %s\n", n+1, c.Step, c)
+	}
+
+	if len(plan.Config) == 0 {
+		fmt.Fprintf(w, "  layer written to %s without running a container\n", injector.PlaceholderDiffOutputFile)
+		return
+	}
+
+	fmt.Fprintf(w, "  config.json written to %s:\n    %s\n", injector.PlaceholderBundleDir, indentConfig(plan.Config))
+}
+
+// indentConfig formats config for reading, keeping the placeholders legible.
+func indentConfig(config []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(config, &v); err != nil {
+		return string(config)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("    ", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return string(config)
+	}
+	return buf.String()
+}
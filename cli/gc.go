@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/command"
+	"code.cloudfoundry.org/cert-injector/gc"
+	"code.cloudfoundry.org/cert-injector/injector"
+	"code.cloudfoundry.org/cert-injector/state"
+)
+
+type gcResult struct {
+	DryRun  bool     `json:"dry_run"`
+	Volumes []string `json:"volumes"`
+	Paths   []string `json:"paths"`
+	Bytes   int64    `json:"bytes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func collectGarbage(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("gc", stderr)
+	driverStore := fs.String("driver-store", "", "groot driver store")
+	dryRun := fs.Bool("dry-run", false, "print what would be reclaimed without deleting anything")
+	minAge := fs.Duration("min-age", time.Hour, "leave volumes and temp paths modified more recently than this alone")
+	stateFile := addStateFileFlag(fs)
+	locks := addLockFlags(fs)
+	toolFlags := addToolFlags(fs)
+	output := addOutputFlag(fs)
+
+	if err := parse(fs, args, output); err != nil {
+		return exitUsage
+	}
+
+	if *driverStore == "" {
+		fmt.Fprintln(stderr, "gc requires --driver-store")
+		return exitUsage
+	}
+
+	tools, err := toolFlags.resolveAndCheck()
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+
+	collector := gc.NewCollector(command.NewCmd(), state.NewFile(*stateFile), tools, gc.Options{
+		TempDir: os.TempDir(),
+		LockDir: *locks.dir,
+		MinAge:  *minAge,
+		Timeout: injector.DefaultTimeouts()[injector.StepGrootDelete],
+	})
+
+	// A run in progress would see its volumes deleted from under it.
+	storeLock, err := locks.driverStore(ctx, *driverStore)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+	defer storeLock.Release()
+
+	leftovers, err := collector.Find(*driverStore)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+
+	result := gcResult{DryRun: *dryRun, Volumes: leftovers.Volumes, Paths: leftovers.Paths}
+	if !*dryRun {
+		var report gc.Report
+		report, err = collector.Collect(ctx, *driverStore, leftovers)
+		result.Volumes, result.Paths, result.Bytes = report.Volumes, report.Paths, report.Bytes
+		if err != nil {
+			result.Error = err.Error()
+			fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		}
+	}
+
+	if *output == outputJSON {
+		if result.Volumes == nil {
+			result.Volumes = []string{}
+		}
+		if result.Paths == nil {
+			result.Paths = []string{}
+		}
+		if code := writeJSON(stdout, stderr, result); code != exitSuccess {
+			return code
+		}
+	} else {
+		writeGCSummary(stdout, result)
+	}
+
+	if err != nil {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+func writeGCSummary(w io.Writer, result gcResult) {
+	deleteVerb, removeVerb := "deleted", "removed"
+	if result.DryRun {
+		deleteVerb, removeVerb = "would delete", "would remove"
+	}
+
+	for _, volume := range result.Volumes {
+		fmt.Fprintf(w, "%s volume %s\n", deleteVerb, volume)
+	}
+	for _, path := range result.Paths {
+		fmt.Fprintf(w, "%s %s\n", removeVerb, path)
+	}
+
+	if result.DryRun {
+		fmt.Fprintf(w, "found %d volumes and %d temp paths\n", len(result.Volumes), len(result.Paths))
+		return
+	}
+	fmt.Fprintf(w, "reclaimed %d volumes and %d temp paths (%d bytes)\n", len(result.Volumes), len(result.Paths), result.Bytes)
+}
@@ -0,0 +1,94 @@
+package cli_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	fakeToolLogEnv  = "CERT_INJECTOR_FAKE_TOOL_LOG"
+	fakeToolFailEnv = "CERT_INJECTOR_FAKE_TOOL_FAIL"
+	fakeToolHangEnv = "CERT_INJECTOR_FAKE_TOOL_HANG"
+)
+
+// TestMain lets the test binary stand in for groot, winc, diff-exporter and
+// hydrate, so the CLI can be exercised end to end on any platform.
+func TestMain(m *testing.M) {
+	if logFile := os.Getenv(fakeToolLogEnv); logFile != "" {
+		os.Exit(fakeTool(logFile, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func TestCli(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CLI Suite")
+}
+
+func fakeTool(logFile string, args []string) int {
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 3
+	}
+	line, _ := json.Marshal(args)
+	fmt.Fprintln(f, string(line))
+	f.Close()
+
+	if fail := os.Getenv(fakeToolFailEnv); fail != "" && slices.Contains(args, fail) {
+		fmt.Fprintf(os.Stderr, "%s is unhappy\n", fail)
+		return 1
+	}
+
+	if hang := os.Getenv(fakeToolHangEnv); hang != "" && slices.Contains(args, hang) {
+		time.Sleep(time.Minute)
+	}
+
+	switch {
+	case slices.Contains(args, "create"):
+		fmt.Print(`{"ociVersion":"1.0.2"}`)
+	case slices.Contains(args, "-outputFile"):
+		output := args[slices.Index(args, "-outputFile")+1]
+		if err := os.WriteFile(output, []byte("layer"), 0644); err != nil {
+			return 3
+		}
+	}
+
+	return 0
+}
+
+// fakeToolFlags points every tool at the test binary and records calls in logFile.
+func fakeToolFlags(logFile string) []string {
+	GinkgoT().Setenv(fakeToolLogEnv, logFile)
+
+	return []string{
+		"--groot-bin", os.Args[0],
+		"--winc-bin", os.Args[0],
+		"--diff-exporter-bin", os.Args[0],
+		"--hydrate-bin", os.Args[0],
+	}
+}
+
+// fakeToolCalls returns the arguments of every recorded tool invocation.
+func fakeToolCalls(logFile string) [][]string {
+	data, err := os.ReadFile(logFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	Expect(err).NotTo(HaveOccurred())
+
+	var calls [][]string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var args []string
+		Expect(json.Unmarshal([]byte(line), &args)).To(Succeed())
+		calls = append(calls, args)
+	}
+	return calls
+}
@@ -0,0 +1,333 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/injector"
+	"code.cloudfoundry.org/cert-injector/registry"
+)
+
+// Environment variables holding the credentials for docker:// images.
+const (
+	registryUsernameEnv = "CERT_INJECTOR_REGISTRY_USERNAME"
+	registryPasswordEnv = "CERT_INJECTOR_REGISTRY_PASSWORD"
+)
+
+type injectResult struct {
+	Image   string         `json:"image"`
+	Status  string         `json:"status"`
+	Step    string         `json:"step,omitempty"`
+	Retries map[string]int `json:"retries,omitempty"`
+	Error   string         `json:"error,omitempty"`
+
+	// ExitCode is the exit code of the tool that failed, if it exited on its own.
+	ExitCode int `json:"exit_code,omitempty"`
+
+	result injector.Result
+	err    error
+}
+
+func inject(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("inject", stderr)
+	driverStore := fs.String("driver-store", "", "groot driver store")
+	var certSources stringSlice
+	fs.Var(&certSources, "certs", fmt.Sprintf(certsFlagUsage, "trust"))
+	var images stringSlice
+	fs.Var(&images, "image", "oci:/// or docker:// uri of an image to inject the certificates into (repeatable)")
+	pullDir := fs.String("pull-dir", filepath.Join(os.TempDir(), "cert-injector", "images"), "directory docker:// images are pulled into before the certificates are injected")
+	pushTag := fs.String("push-tag", "", fmt.Sprintf("tag to push docker:// images to once the certificates are injected, they are only changed in --pull-dir without it (credentials from env %s and %s)", registryUsernameEnv, registryPasswordEnv))
+	force := fs.Bool("force", false, "rebuild the certificate layer even if the image already has one for the same certificates")
+	transactional := fs.Bool("transactional", true, "restore the image if injection fails after the old layer was removed")
+	keepGoing := fs.Bool("keep-going", false, "try every image even if one fails, then print a summary")
+	parallelism := fs.Int("parallelism", 1, "number of images to inject at the same time")
+	layerBuilder := fs.String("layer-builder", layerBuilderContainer, "how to build the certificate layer: container runs winc and diff-exporter, native writes it directly")
+	layoutWriter := addLayoutWriterFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "print the commands and container config that would be used without running anything")
+	stateFile := addStateFileFlag(fs)
+	locks := addLockFlags(fs)
+	reportFile := fs.String("report", "", "write a JSON report of the run to this file")
+	grootOutputFile := fs.String("groot-output", "", "file with the output of groot create to generate the container config from in --dry-run mode")
+	toolFlags := addToolFlags(fs)
+	timeouts := addTimeoutFlag(fs)
+	retryConfig := fs.String("retry-config", "", "JSON file with the retry policy of each step")
+	output := addOutputFlag(fs)
+	logFormat := addLogFormatFlag(fs)
+
+	if err := parse(fs, args, output); err != nil {
+		return exitUsage
+	}
+
+	positional := fs.Args()
+	if *driverStore == "" && len(certSources) == 0 && len(images) == 0 {
+		// There can be multiple image uris because groot.cached_image_uris is an array.
+		if len(positional) < 3 {
+			fmt.Fprint(stderr, usage)
+			return exitUsage
+		}
+		*driverStore = positional[0]
+		certSources = positional[1:2]
+		images = positional[2:]
+	} else if len(positional) > 0 {
+		fmt.Fprintf(stderr, "unexpected arguments: %v\n", positional)
+		return exitUsage
+	}
+
+	if *driverStore == "" || len(certSources) == 0 || len(images) == 0 {
+		fmt.Fprintln(stderr, "inject requires --driver-store, --certs and at least one --image")
+		return exitUsage
+	}
+
+	builder, err := newLayerBuilder(*layerBuilder)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	stages, err := layoutStages(*layoutWriter)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	if *parallelism < 1 {
+		fmt.Fprintln(stderr, "--parallelism must be at least 1")
+		return exitUsage
+	}
+
+	// Injecting the same image twice at once would race in hydrate.
+	images = unique(images)
+
+	stdout = &syncWriter{w: stdout}
+	stderr = &syncWriter{w: stderr}
+
+	// Log events go to stderr when stdout is reserved for JSON output.
+	logOut := stdout
+	if *output == outputJSON {
+		logOut = stderr
+	}
+
+	logger, err := newLogger(logOut, *logFormat)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	tools, err := toolFlags.resolveAndCheck(unusedTools(stages, builder)...)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+
+	retries, err := loadRetries(*retryConfig)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitUsage
+	}
+
+	tempLocks := locks.tempPaths()
+	defer tempLocks.Release()
+
+	staging, err := stageCerts(certSources, tempLocks)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return stepExitCodes[injector.StepValidate]
+	}
+	certDirectory := staging.Dir
+	defer os.RemoveAll(certDirectory)
+
+	inj := newInjector(tools, *stateFile, tempLocks, logger, injector.Options{
+		Transactional: *transactional,
+		Force:         *force,
+		Timeouts:      timeouts,
+		Retries:       retries,
+		LayerBuilder:  builder,
+		Stages:        stages,
+		Registry:      registry.NewClient(os.Getenv(registryUsernameEnv), os.Getenv(registryPasswordEnv)),
+		PullDirectory: *pullDir,
+		PushTag:       *pushTag,
+	})
+
+	if *dryRun {
+		return dryRunAll(inj, *driverStore, certDirectory, images, *grootOutputFile, *output, stdout, stderr)
+	}
+
+	// Overlapping runs, such as a retried pre-start, would otherwise race
+	// in hydrate and groot.
+	storeLock, err := locks.driverStore(ctx, *driverStore)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+	defer storeLock.Release()
+
+	// A layer builder needs no groot, so the volumes leaked by earlier runs
+	// are left to the next run that builds a container or to gc.
+	if builder == nil {
+		deleted, err := inj.CleanupLeaks(ctx, *driverStore)
+		if err != nil {
+			logger.Warn("deleting volumes leaked by earlier runs failed", "error", err)
+		}
+		if deleted > 0 {
+			logger.Info("deleted volumes leaked by earlier runs", "count", deleted)
+		}
+	}
+
+	startedAt := time.Now()
+	results := injectAll(ctx, inj, locks, *driverStore, certDirectory, images, *parallelism, *keepGoing, stderr)
+
+	if *output == outputJSON {
+		if code := writeJSON(stdout, stderr, results); code != exitSuccess {
+			return code
+		}
+	} else if *keepGoing {
+		writeSummary(stdout, results)
+	}
+
+	if *reportFile != "" {
+		err := writeReport(*reportFile, certDirectory, startedAt, results)
+		if err != nil {
+			fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+			return exitFailure
+		}
+	}
+
+	return resultsExitCode(results)
+}
+
+// resultsExitCode returns the exit code of the step that failed when every
+// failed image failed at the same step, and exitFailure when they differ.
+func resultsExitCode(results []injectResult) int {
+	code := exitSuccess
+	for _, r := range results {
+		if r.Status != string(injector.StatusFailed) {
+			continue
+		}
+		c := failureExitCode(r.err)
+		if code != exitSuccess && code != c {
+			return exitFailure
+		}
+		code = c
+	}
+	return code
+}
+
+// injectAll injects into at most parallelism images at a time. Unless
+// keepGoing is set, the first failure stops any image that has not started
+// yet. Results are returned in the order of images, leaving out images that
+// were never started.
+func injectAll(ctx context.Context, inj injector.Injector, locks lockFlags, driverStore, certDirectory string, images []string, parallelism int, keepGoing bool, stderr io.Writer) []injectResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]injectResult, len(images))
+	started := make([]bool, len(images))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for idx, uri := range images {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		started[idx] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := injectLocked(ctx, inj, locks, driverStore, uri, certDirectory)
+			results[idx] = injectResult{Image: result.Image, Status: string(result.Status), Step: string(result.Step), result: result}
+			for step, retries := range result.Retries {
+				if results[idx].Retries == nil {
+					results[idx].Retries = map[string]int{}
+				}
+				results[idx].Retries[string(step)] = retries
+			}
+			if err != nil {
+				results[idx].Error = err.Error()
+				results[idx].err = err
+				var stepErr *injector.StepError
+				if errors.As(err, &stepErr) && stepErr.ExitCode > 0 {
+					results[idx].ExitCode = stepErr.ExitCode
+				}
+				fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+				if !keepGoing {
+					cancel()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	var attempted []injectResult
+	for idx, r := range results {
+		if started[idx] {
+			attempted = append(attempted, r)
+		}
+	}
+	return attempted
+}
+
+// injectLocked injects into uri while holding its image lock, so that a run
+// using another driver store cannot change the image at the same time.
+func injectLocked(ctx context.Context, inj injector.Injector, locks lockFlags, driverStore, uri, certDirectory string) (injector.Result, error) {
+	imageLock, err := locks.image(ctx, uri)
+	if err != nil {
+		return injector.Result{Image: uri, Status: injector.StatusFailed}, err
+	}
+	defer imageLock.Release()
+
+	return inj.InjectCert(ctx, driverStore, uri, certDirectory)
+}
+
+func unique(values []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func writeSummary(w io.Writer, results []injectResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tSTATUS\tSTEP\tRETRIES\tERROR")
+	for _, r := range results {
+		var retries []string
+		for step, n := range r.Retries {
+			retries = append(retries, fmt.Sprintf("%s=%d", step, n))
+		}
+		sort.Strings(retries)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Image, r.Status, dash(r.Step), dash(strings.Join(retries, ",")), dash(oneLine(r.Error)))
+	}
+	tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func oneLine(s string) string {
+	return strings.ReplaceAll(strings.TrimSpace(s), "\n", "; ")
+}
@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/certs"
+)
+
+func list(_ context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("list", stderr)
+	var certSources stringSlice
+	fs.Var(&certSources, "certs", fmt.Sprintf(certsFlagUsage, "list"))
+	output := addOutputFlag(fs)
+
+	if err := parse(fs, args, output); err != nil {
+		return exitUsage
+	}
+
+	if len(certSources) == 0 {
+		fmt.Fprintln(stderr, "list requires --certs")
+		return exitUsage
+	}
+
+	staging, err := stageCerts(certSources, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+	defer os.RemoveAll(staging.Dir)
+
+	certificates, err := certs.NewBundle().Inspect(staging.Dir)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+
+	// Name the certificates after where they came from rather than the
+	// files they were staged to.
+	for n, c := range certificates {
+		if source, ok := staging.Sources[c.File]; ok {
+			certificates[n].File = source
+		}
+	}
+
+	if *output == outputJSON {
+		if certificates == nil {
+			certificates = []certs.Certificate{}
+		}
+		return writeJSON(stdout, stderr, certificates)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSUBJECT\tISSUER\tTHUMBPRINT\tEXPIRES")
+	for _, c := range certificates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.File, c.Subject, c.Issuer, c.Thumbprint, c.NotAfter.Format(time.RFC3339))
+	}
+	w.Flush()
+
+	return exitSuccess
+}
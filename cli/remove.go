@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"code.cloudfoundry.org/cert-injector/certs"
+	"code.cloudfoundry.org/cert-injector/injector"
+)
+
+func remove(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("remove", stderr)
+	var images stringSlice
+	fs.Var(&images, "image", "oci:/// uri of an image to remove the certificate layer from (repeatable)")
+	var purgeThumbprints stringSlice
+	fs.Var(&purgeThumbprints, "purge-thumbprint", "SHA-1 thumbprint of a certificate to delete from Cert:\\LocalMachine\\Root with a new layer (repeatable)")
+	driverStore := fs.String("driver-store", "", "groot driver store, required with --purge-thumbprint")
+	layoutWriter := addLayoutWriterFlag(fs)
+	toolFlags := addToolFlags(fs)
+	timeouts := addTimeoutFlag(fs)
+	retryConfig := fs.String("retry-config", "", "JSON file with the retry policy of each step")
+	logFormat := addLogFormatFlag(fs)
+	stateFile := addStateFileFlag(fs)
+	locks := addLockFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	logger, err := newLogger(stdout, *logFormat)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	images = append(images, fs.Args()...)
+	if len(images) == 0 {
+		fmt.Fprintln(stderr, "remove requires at least one --image")
+		return exitUsage
+	}
+
+	var thumbprints []string
+	for _, t := range purgeThumbprints {
+		thumbprint, err := certs.NormalizeThumbprint(t)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		thumbprints = append(thumbprints, thumbprint)
+	}
+
+	if len(thumbprints) > 0 && *driverStore == "" {
+		fmt.Fprintln(stderr, "--purge-thumbprint requires --driver-store")
+		return exitUsage
+	}
+
+	stages, err := layoutStages(*layoutWriter)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	unused := unusedTools(stages, nil)
+	if len(thumbprints) == 0 {
+		// Removing the layers builds none.
+		unused = append(unused, containerTools...)
+	}
+
+	tools, err := toolFlags.resolveAndCheck(unused...)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitFailure
+	}
+
+	retries, err := loadRetries(*retryConfig)
+	if err != nil {
+		fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+		return exitUsage
+	}
+
+	tempLocks := locks.tempPaths()
+	defer tempLocks.Release()
+
+	inj := newInjector(tools, *stateFile, tempLocks, logger, injector.Options{Timeouts: timeouts, Retries: retries, Stages: stages})
+
+	if len(thumbprints) > 0 {
+		storeLock, err := locks.driverStore(ctx, *driverStore)
+		if err != nil {
+			fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+			return exitFailure
+		}
+		defer storeLock.Release()
+	}
+
+	for _, uri := range images {
+		err := removeLocked(ctx, inj, locks, *driverStore, uri, thumbprints, stdout)
+		if err != nil {
+			fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+			return failureExitCode(err)
+		}
+	}
+
+	return exitSuccess
+}
+
+// removeLocked removes the certificate layers from uri, replacing them with a
+// layer deleting thumbprints if any are given, while holding the image lock.
+func removeLocked(ctx context.Context, inj injector.Injector, locks lockFlags, driverStore, uri string, thumbprints []string, stdout io.Writer) error {
+	imageLock, err := locks.image(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer imageLock.Release()
+
+	if len(thumbprints) == 0 {
+		err = inj.RemoveCert(ctx, uri)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "removed certificate layer from %s\n", uri)
+		return nil
+	}
+
+	err = inj.PurgeCerts(ctx, driverStore, uri, thumbprints)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "removed certificate layer from %s\n", uri)
+	fmt.Fprintf(stdout, "added a layer to %s that deletes certificates %s\n", uri, strings.Join(thumbprints, ", "))
+
+	return nil
+}
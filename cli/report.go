@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/atomicfile"
+	"code.cloudfoundry.org/cert-injector/certs"
+)
+
+type report struct {
+	Version      string              `json:"version"`
+	StartedAt    time.Time           `json:"started_at"`
+	FinishedAt   time.Time           `json:"finished_at"`
+	Certificates []certs.Certificate `json:"certificates"`
+	Images       []reportImage       `json:"images"`
+}
+
+type reportImage struct {
+	Image        string           `json:"image"`
+	Status       string           `json:"status"`
+	Step         string           `json:"step,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	BundleDigest string           `json:"bundle_digest,omitempty"`
+	LayerDigest  string           `json:"layer_digest,omitempty"`
+	Retries      map[string]int   `json:"retries,omitempty"`
+	TimingsMs    map[string]int64 `json:"timings_ms,omitempty"`
+}
+
+// writeReport records which certificates were injected into which images.
+// Images that were never started are left out.
+func writeReport(path, certDirectory string, startedAt time.Time, results []injectResult) error {
+	r := report{
+		Version:      Version,
+		StartedAt:    startedAt.UTC(),
+		FinishedAt:   time.Now().UTC(),
+		Certificates: []certs.Certificate{},
+		Images:       []reportImage{},
+	}
+
+	certificates, err := certs.NewBundle().Inspect(certDirectory)
+	if err != nil {
+		return fmt.Errorf("write report: %s", err)
+	}
+	if certificates != nil {
+		r.Certificates = certificates
+	}
+
+	for _, result := range results {
+		image := reportImage{
+			Image:        result.Image,
+			Status:       result.Status,
+			Step:         result.Step,
+			Error:        result.Error,
+			BundleDigest: result.result.Digest,
+			LayerDigest:  result.result.LayerDigest,
+			Retries:      result.Retries,
+		}
+		for step, duration := range result.result.Timings {
+			if image.TimingsMs == nil {
+				image.TimingsMs = map[string]int64{}
+			}
+			image.TimingsMs[string(step)] = duration.Milliseconds()
+		}
+		r.Images = append(r.Images, image)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("write report: %s", err)
+	}
+
+	// Write through a temporary file so a reader never sees half a report.
+	err = atomicfile.Write(path, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("write report: %s", err)
+	}
+
+	return nil
+}
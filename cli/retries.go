@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/injector"
+)
+
+type retryConfig struct {
+	MaxAttempts        int      `json:"max_attempts"`
+	InitialBackoff     string   `json:"initial_backoff"`
+	MaxBackoff         string   `json:"max_backoff"`
+	Jitter             float64  `json:"jitter"`
+	RetryableExitCodes []int    `json:"retryable_exit_codes"`
+	RetryableStderr    []string `json:"retryable_stderr"`
+}
+
+// loadRetries returns the default retry policies with the policies of the
+// steps in the JSON file at path, if any, replacing them.
+func loadRetries(path string) (map[injector.Step]injector.RetryPolicy, error) {
+	retries := injector.DefaultRetries()
+	if path == "" {
+		return retries, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read retry config: %s", err)
+	}
+
+	var configs map[string]retryConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("json unmarshal retry config: %s", err)
+	}
+
+	for name, config := range configs {
+		step := injector.Step(name)
+		if _, ok := injector.DefaultTimeouts()[step]; !ok {
+			return nil, fmt.Errorf("retry config: unknown step %q", name)
+		}
+
+		policy, err := config.policy()
+		if err != nil {
+			return nil, fmt.Errorf("retry config for %s: %s", name, err)
+		}
+		retries[step] = policy
+	}
+
+	return retries, nil
+}
+
+func (c retryConfig) policy() (injector.RetryPolicy, error) {
+	policy := injector.RetryPolicy{
+		MaxAttempts:        c.MaxAttempts,
+		Jitter:             c.Jitter,
+		RetryableExitCodes: c.RetryableExitCodes,
+	}
+
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return injector.RetryPolicy{}, fmt.Errorf("jitter must be between 0 and 1")
+	}
+
+	var err error
+	if c.InitialBackoff != "" {
+		policy.InitialBackoff, err = time.ParseDuration(c.InitialBackoff)
+		if err != nil {
+			return injector.RetryPolicy{}, fmt.Errorf("initial_backoff: %s", err)
+		}
+	}
+
+	if c.MaxBackoff != "" {
+		policy.MaxBackoff, err = time.ParseDuration(c.MaxBackoff)
+		if err != nil {
+			return injector.RetryPolicy{}, fmt.Errorf("max_backoff: %s", err)
+		}
+	}
+
+	for _, pattern := range c.RetryableStderr {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return injector.RetryPolicy{}, fmt.Errorf("retryable_stderr: %s", err)
+		}
+		policy.RetryableStderr = append(policy.RetryableStderr, re)
+	}
+
+	return policy, nil
+}
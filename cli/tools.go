@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"code.cloudfoundry.org/cert-injector/injector"
+)
+
+// Environment variables that override the tool paths from the config file.
+const (
+	grootBinEnv        = "CERT_INJECTOR_GROOT_BIN"
+	wincBinEnv         = "CERT_INJECTOR_WINC_BIN"
+	diffExporterBinEnv = "CERT_INJECTOR_DIFF_EXPORTER_BIN"
+	hydrateBinEnv      = "CERT_INJECTOR_HYDRATE_BIN"
+)
+
+type toolFlags struct {
+	configFile string
+	flags      injector.Tools
+}
+
+func addToolFlags(fs *flag.FlagSet) *toolFlags {
+	f := &toolFlags{}
+	defaults := injector.DefaultTools()
+
+	fs.StringVar(&f.configFile, "tools-config", "", "JSON file with groot, winc, diff_exporter and hydrate paths")
+	fs.StringVar(&f.flags.Groot, "groot-bin", "", fmt.Sprintf("path to the groot executable (env %s, default %s)", grootBinEnv, defaults.Groot))
+	fs.StringVar(&f.flags.Winc, "winc-bin", "", fmt.Sprintf("path to the winc executable (env %s, default %s)", wincBinEnv, defaults.Winc))
+	fs.StringVar(&f.flags.DiffExporter, "diff-exporter-bin", "", fmt.Sprintf("path to the diff-exporter executable (env %s, default %s)", diffExporterBinEnv, defaults.DiffExporter))
+	fs.StringVar(&f.flags.Hydrate, "hydrate-bin", "", fmt.Sprintf("path to the hydrate executable (env %s, default %s)", hydrateBinEnv, defaults.Hydrate))
+
+	return f
+}
+
+// resolve layers the tool paths from lowest to highest precedence: defaults,
+// config file, environment variables and flags.
+func (f *toolFlags) resolve() (injector.Tools, error) {
+	tools := injector.DefaultTools()
+
+	if f.configFile != "" {
+		data, err := os.ReadFile(f.configFile)
+		if err != nil {
+			return injector.Tools{}, fmt.Errorf("read tools config: %s", err)
+		}
+
+		var fromFile injector.Tools
+		err = json.Unmarshal(data, &fromFile)
+		if err != nil {
+			return injector.Tools{}, fmt.Errorf("json unmarshal tools config: %s", err)
+		}
+		tools = tools.Merge(fromFile)
+	}
+
+	tools = tools.Merge(injector.Tools{
+		Groot:        os.Getenv(grootBinEnv),
+		Winc:         os.Getenv(wincBinEnv),
+		DiffExporter: os.Getenv(diffExporterBinEnv),
+		Hydrate:      os.Getenv(hydrateBinEnv),
+	})
+
+	return tools.Merge(f.flags), nil
+}
+
+// resolveAndCheck resolves the tool paths and verifies that every tool but
+// the unused ones can be executed.
+func (f *toolFlags) resolveAndCheck(unused ...string) (injector.Tools, error) {
+	tools, err := f.resolve()
+	if err != nil {
+		return injector.Tools{}, err
+	}
+
+	return tools, tools.Check(unused...)
+}
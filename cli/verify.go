@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"code.cloudfoundry.org/cert-injector/certs"
+	"code.cloudfoundry.org/cert-injector/layout"
+	"code.cloudfoundry.org/cert-injector/registry"
+	"code.cloudfoundry.org/cert-injector/winlayer"
+)
+
+type verifyResult struct {
+	Valid    bool                `json:"valid"`
+	Digest   string              `json:"digest,omitempty"`
+	Problems []certs.Problem     `json:"problems,omitempty"`
+	Images   []imageVerification `json:"images,omitempty"`
+}
+
+// imageVerification tells which of the certificates the top layer of an
+// image adds to the root store.
+type imageVerification struct {
+	Image   string   `json:"image"`
+	Trusted bool     `json:"trusted"`
+	Present []string `json:"present,omitempty"`
+	Missing []string `json:"missing,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func verify(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("verify", stderr)
+	var certSources stringSlice
+	fs.Var(&certSources, "certs", fmt.Sprintf(certsFlagUsage, "check"))
+	var images stringSlice
+	fs.Var(&images, "image", "oci:/// or docker:// uri of an image whose top layer must trust the certificates (repeatable)")
+	output := addOutputFlag(fs)
+
+	if err := parse(fs, args, output); err != nil {
+		return exitUsage
+	}
+
+	if len(certSources) == 0 {
+		fmt.Fprintln(stderr, "verify requires --certs")
+		return exitUsage
+	}
+
+	bundle := certs.NewBundle()
+
+	result := verifyResult{Valid: true}
+	staging, err := stageCerts(certSources, nil)
+	certDirectory := staging.Dir
+	if err == nil {
+		defer os.RemoveAll(certDirectory)
+		err = bundle.Validate(certDirectory)
+	}
+	if err != nil {
+		var validationErr *certs.ValidationError
+		if !errors.As(err, &validationErr) {
+			fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+			return exitFailure
+		}
+		result.Valid = false
+		result.Problems = validationErr.Problems
+	} else {
+		result.Digest, err = bundle.Digest(certDirectory)
+		if err != nil {
+			fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+			return exitFailure
+		}
+
+		if len(images) > 0 {
+			expected, err := bundle.Certificates(certDirectory)
+			if err != nil {
+				fmt.Fprintf(stderr, "cert-injector failed: %s\n", err)
+				return exitFailure
+			}
+
+			for _, uri := range images {
+				result.Images = append(result.Images, verifyImage(ctx, uri, expected))
+			}
+		}
+	}
+
+	if *output == outputJSON {
+		if code := writeJSON(stdout, stderr, result); code != exitSuccess {
+			return code
+		}
+	} else if result.Valid {
+		fmt.Fprintf(stdout, "certificates are valid, digest %s\n", result.Digest)
+		for _, v := range result.Images {
+			writeImageVerification(stdout, v)
+		}
+	} else {
+		for _, p := range result.Problems {
+			fmt.Fprintf(stdout, "%s: %s\n", p.File, p.Reason)
+		}
+	}
+
+	if !result.Valid {
+		return exitFailure
+	}
+	for _, v := range result.Images {
+		if !v.Trusted {
+			return exitFailure
+		}
+	}
+	return exitSuccess
+}
+
+// verifyImage checks that the top layer of uri adds every expected
+// certificate to the root store.
+func verifyImage(ctx context.Context, uri string, expected []*x509.Certificate) imageVerification {
+	v := imageVerification{Image: uri}
+
+	trusted, err := imageThumbprints(ctx, uri)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+
+	for _, cert := range expected {
+		thumbprint := certs.Thumbprint(cert)
+		if slices.Contains(trusted, thumbprint) {
+			v.Present = append(v.Present, thumbprint)
+		} else {
+			v.Missing = append(v.Missing, thumbprint)
+		}
+	}
+	v.Trusted = len(v.Missing) == 0
+
+	return v
+}
+
+// imageThumbprints returns the thumbprints the top layer of uri adds to the
+// root store. docker:// images are pulled into a temporary layout first.
+func imageThumbprints(ctx context.Context, uri string) ([]string, error) {
+	if strings.HasPrefix(uri, registry.Scheme) {
+		dir, err := os.MkdirTemp("", "cert-injector-verify-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		err = registry.NewClient(os.Getenv(registryUsernameEnv), os.Getenv(registryPasswordEnv)).Pull(ctx, uri, dir)
+		if err != nil {
+			return nil, fmt.Errorf("pull %s failed: %s", uri, err)
+		}
+		uri = layout.URI(dir)
+	}
+
+	layerFile, err := layout.NewLayout().LayerFile(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return winlayer.Thumbprints(layerFile)
+}
+
+func writeImageVerification(w io.Writer, v imageVerification) {
+	if v.Error != "" {
+		fmt.Fprintf(w, "%s: %s\n", v.Image, v.Error)
+		return
+	}
+
+	fmt.Fprintf(w, "%s trusts %d of %d certificates\n", v.Image, len(v.Present), len(v.Present)+len(v.Missing))
+	for _, thumbprint := range v.Present {
+		fmt.Fprintf(w, "  present %s\n", thumbprint)
+	}
+	for _, thumbprint := range v.Missing {
+		fmt.Fprintf(w, "  missing %s\n", thumbprint)
+	}
+}
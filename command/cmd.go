@@ -2,9 +2,15 @@ package command
 
 import (
 	"bytes"
+	"context"
 	"os/exec"
+	"time"
 )
 
+// waitDelay bounds how long Run waits for output pipes to close after the
+// process tree was killed, in case a grandchild inherited them.
+const waitDelay = 10 * time.Second
+
 type Cmd struct {
 }
 
@@ -12,14 +18,22 @@ func NewCmd() *Cmd {
 	return &Cmd{}
 }
 
-func (c *Cmd) Run(executable string, args ...string) (string, string, error) {
+// Run runs executable and returns its stdout and stderr. When ctx is done
+// before the executable exits, the executable and every process it started
+// are killed.
+func (c *Cmd) Run(ctx context.Context, executable string, args ...string) (string, string, error) {
 	var command *exec.Cmd
 	var outbuff, errbuff bytes.Buffer
 	var err error
 
-	command = exec.Command(executable, args...)
+	command = exec.CommandContext(ctx, executable, args...)
 	command.Stdout = &outbuff
 	command.Stderr = &errbuff
+	command.WaitDelay = waitDelay
+	newProcessGroup(command)
+	command.Cancel = func() error {
+		return killProcessTree(command)
+	}
 	err = command.Run()
 
 	return outbuff.String(), errbuff.String(), err
@@ -0,0 +1,82 @@
+package command_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/command"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cmd", func() {
+	var cmd *command.Cmd
+
+	BeforeEach(func() {
+		cmd = command.NewCmd()
+	})
+
+	It("returns stdout and stderr of the executable", func() {
+		GinkgoT().Setenv(helperEnv, "echo")
+
+		stdout, stderr, err := cmd.Run(context.Background(), os.Args[0], "some-stdout", "some-stderr", "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stdout).To(Equal("some-stdout"))
+		Expect(stderr).To(Equal("some-stderr"))
+	})
+
+	It("returns the exit error when the executable fails", func() {
+		GinkgoT().Setenv(helperEnv, "echo")
+
+		_, stderr, err := cmd.Run(context.Background(), os.Args[0], "", "it broke", "3")
+		var exitErr *exec.ExitError
+		Expect(err).To(BeAssignableToTypeOf(exitErr))
+		Expect(err.(*exec.ExitError).ExitCode()).To(Equal(3))
+		Expect(stderr).To(Equal("it broke"))
+	})
+
+	It("kills the executable when the context is done", func() {
+		GinkgoT().Setenv(helperEnv, "sleep")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, _, err := cmd.Run(ctx, os.Args[0])
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 30*time.Second))
+	})
+
+	It("kills the processes the executable started when the context is done", func() {
+		GinkgoT().Setenv(helperEnv, "tree")
+		pidFile := filepath.Join(GinkgoT().TempDir(), "grandchild.pid")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := cmd.Run(ctx, os.Args[0], pidFile)
+			done <- err
+		}()
+
+		var pid int
+		Eventually(func() error {
+			data, err := os.ReadFile(pidFile)
+			if err != nil {
+				return err
+			}
+			pid, err = strconv.Atoi(string(data))
+			return err
+		}, 30*time.Second).Should(Succeed())
+		Expect(processExists(pid)).To(BeTrue())
+
+		cancel()
+		Eventually(done, 30*time.Second).Should(Receive(HaveOccurred()))
+		Eventually(func() bool { return processExists(pid) }, 10*time.Second).Should(BeFalse())
+	})
+})
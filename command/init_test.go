@@ -0,0 +1,48 @@
+package command_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const helperEnv = "CERT_INJECTOR_COMMAND_HELPER"
+
+// TestMain lets the test binary act as the executable being run.
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "sleep":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	case "tree":
+		// Start a grandchild and write its pid to os.Args[1] before sleeping.
+		child := exec.Command(os.Args[0])
+		child.Env = append(os.Environ(), helperEnv+"=sleep")
+		if err := child.Start(); err != nil {
+			os.Exit(1)
+		}
+		if err := os.WriteFile(os.Args[1], []byte(strconv.Itoa(child.Process.Pid)), 0644); err != nil {
+			os.Exit(1)
+		}
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	default:
+		fmt.Fprint(os.Stdout, os.Args[1])
+		fmt.Fprint(os.Stderr, os.Args[2])
+		code, _ := strconv.Atoi(os.Args[3])
+		os.Exit(code)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Command Suite")
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package command
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup starts the command in its own process group so the whole
+// tree can be signalled at once.
+func newProcessGroup(command *exec.Cmd) {
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessTree(command *exec.Cmd) error {
+	return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package command_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// processExists reports whether pid is running. A zombie waiting to be
+// reaped by init does not count.
+func processExists(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+	return len(fields) == 0 || string(fields[0]) != "Z"
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package command
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func newProcessGroup(command *exec.Cmd) {}
+
+// killProcessTree uses taskkill, since killing a process on windows leaves
+// its children running.
+func killProcessTree(command *exec.Cmd) error {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(command.Process.Pid)).Run()
+	if err != nil {
+		return command.Process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package command_test
+
+import "syscall"
+
+// stillActive is the exit code GetExitCodeProcess reports for a running process.
+const stillActive = 259
+
+// processExists reports whether pid is running.
+func processExists(pid int) bool {
+	handle, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(handle, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
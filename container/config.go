@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 )
@@ -17,39 +19,99 @@ func NewConfig() Config {
 	return Config{}
 }
 
-// Write creates the container runtime config.json file,
+// Write creates the container runtime config.json file in bundleDir
+// with the contents returned by Generate.
+func (c Config) Write(bundleDir, grootOutput, certDirectory string, thumbprints []string) error {
+	marshalledConfig, err := c.Generate(grootOutput, certDirectory, thumbprints)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(bundleDir, "config.json"), marshalledConfig, 0644)
+	if err != nil {
+		return fmt.Errorf("Write config.json failed: %s", err)
+	}
+
+	return nil
+}
+
+// Generate returns the container runtime config,
 // using the output of groot for the Root.Path field and the Windows.LayerFolders field.
 // The Process field contains a command that will add
 // the user-provided certificates to the container.
 // The certDirectory is the directory containing certificates that will be bind-mounted
-// into the container
-func (c Config) Write(bundleDir, grootOutput, certDirectory string) error {
+// into the container. An empty certDirectory imports and mounts nothing.
+// The certificates with the given SHA-1 thumbprints are then deleted from
+// Cert:\LocalMachine\Root, so a purged CA stays distrusted even when it is
+// part of certDirectory. An empty list of thumbprints only imports.
+func (c Config) Generate(grootOutput, certDirectory string, thumbprints []string) ([]byte, error) {
+	var scripts []string
+	var mounts []oci.Mount
+
+	if certDirectory != "" {
+		scripts = append(scripts, ImportCertificatePs)
+		mounts = append(mounts, oci.Mount{
+			Destination: "c:\\trusted_certs",
+			Source:      certDirectory,
+		})
+	}
+
+	if len(thumbprints) > 0 {
+		removal, err := RemoveCertificatesPs(thumbprints)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, removal)
+	}
+
+	if len(scripts) == 0 {
+		return nil, fmt.Errorf("no certificates to import or remove")
+	}
+
+	return generate(grootOutput, strings.Join(scripts, "; "), mounts)
+}
+
+// RemoveCertificatesPs returns a PowerShell command that deletes the
+// certificates with the given thumbprints from Cert:\LocalMachine\Root.
+// Certificates that are not in the store are skipped.
+func RemoveCertificatesPs(thumbprints []string) (string, error) {
+	if len(thumbprints) == 0 {
+		return "", fmt.Errorf("no thumbprints to remove")
+	}
+
+	quoted := make([]string, 0, len(thumbprints))
+	for _, thumbprint := range thumbprints {
+		// Thumbprints end up in a script, so only accept what a SHA-1 hash looks like.
+		if !thumbprintPattern.MatchString(thumbprint) {
+			return "", fmt.Errorf("invalid thumbprint %q", thumbprint)
+		}
+		quoted = append(quoted, "'"+thumbprint+"'")
+	}
+
+	return fmt.Sprintf(`$ErrorActionPreference = "Stop"; trap { $host.SetShouldExit(1) }; foreach ($thumbprint in @(%s)) { $path = "Cert:\LocalMachine\Root\$thumbprint"; if (Test-Path $path) { Remove-Item -Path $path } }`, strings.Join(quoted, ",")), nil
+}
+
+var thumbprintPattern = regexp.MustCompile(`^[0-9A-Fa-f]{40}$`)
+
+func generate(grootOutput, script string, mounts []oci.Mount) ([]byte, error) {
 	config := oci.Spec{}
 
 	err := json.Unmarshal([]byte(grootOutput), &config)
 	if err != nil {
-		return fmt.Errorf("json unmarshal groot output: %s", err)
+		return nil, fmt.Errorf("json unmarshal groot output: %s", err)
 	}
 
 	config.Process = &oci.Process{
-		Args: []string{"powershell.exe", "-Command", ImportCertificatePs},
+		Args: []string{"powershell.exe", "-Command", script},
 		Cwd:  `C:\`,
 	}
 
-	config.Mounts = []oci.Mount{{
-		Destination: "c:\\trusted_certs",
-		Source:      certDirectory,
-	}}
+	config.Mounts = mounts
 
 	marshalledConfig, err := json.Marshal(config)
 	if err != nil {
-		return fmt.Errorf("JSON marshal config failed: %s", err)
-	}
-
-	err = os.WriteFile(filepath.Join(bundleDir, "config.json"), marshalledConfig, 0644)
-	if err != nil {
-		return fmt.Errorf("Write config.json failed: %s", err)
+		return nil, fmt.Errorf("JSON marshal config failed: %s", err)
 	}
 
-	return nil
+	return marshalledConfig, nil
 }
@@ -36,7 +36,7 @@ var _ = Describe("Config", func() {
 	})
 
 	It("the config.json contains a process spec to import the certificates, and bind-mounts the certificates into the container", func() {
-		err = conf.Write(bundleDir, grootOutput, certDirectory)
+		err = conf.Write(bundleDir, grootOutput, certDirectory, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		data, err := os.ReadFile(path)
@@ -49,9 +49,88 @@ var _ = Describe("Config", func() {
 		Expect(cont.Process.Args).To(ConsistOf("powershell.exe", "-Command", container.ImportCertificatePs))
 	})
 
+	Describe("Generate", func() {
+		It("returns the config that Write would write without touching the disk", func() {
+			data, err := conf.Generate(grootOutput, certDirectory, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).NotTo(BeAnExistingFile())
+
+			Expect(conf.Write(bundleDir, grootOutput, certDirectory, nil)).To(Succeed())
+			written, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(Equal(written))
+
+			cont := oci.Spec{}
+			Expect(json.Unmarshal(data, &cont)).To(Succeed())
+			Expect(cont.Mounts).To(Equal([]oci.Mount{{Destination: "c:\\trusted_certs", Source: certDirectory}}))
+		})
+	})
+
+	Context("when there is no certificate directory", func() {
+		var thumbprints []string
+
+		BeforeEach(func() {
+			thumbprints = []string{"0123456789ABCDEF0123456789ABCDEF01234567", "89abcdef0123456789abcdef0123456789abcdef"}
+		})
+
+		It("writes a config that deletes the certificates from the root store without any mounts", func() {
+			Expect(conf.Write(bundleDir, grootOutput, "", thumbprints)).To(Succeed())
+
+			data, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			cont := oci.Spec{}
+			Expect(json.Unmarshal(data, &cont)).To(Succeed())
+			Expect(cont.Version).To(Equal("2.2.2"))
+			Expect(cont.Mounts).To(BeEmpty())
+
+			script, err := container.RemoveCertificatesPs(thumbprints)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cont.Process.Args).To(ConsistOf("powershell.exe", "-Command", script))
+			Expect(script).To(ContainSubstring(`@('0123456789ABCDEF0123456789ABCDEF01234567','89abcdef0123456789abcdef0123456789abcdef')`))
+			Expect(script).To(ContainSubstring(`Remove-Item -Path $path`))
+		})
+
+		It("rejects anything that is not a thumbprint", func() {
+			err := conf.Write(bundleDir, grootOutput, "", []string{"'; Remove-Item -Recurse C:\\; '"})
+			Expect(err).To(MatchError(ContainSubstring("invalid thumbprint")))
+			Expect(path).NotTo(BeAnExistingFile())
+		})
+
+		It("requires at least one thumbprint", func() {
+			err := conf.Write(bundleDir, grootOutput, "", nil)
+			Expect(err).To(MatchError("no certificates to import or remove"))
+			Expect(path).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("when thumbprints are given with the certificate directory", func() {
+		It("writes a config that imports the certificates and then deletes the purged ones", func() {
+			thumbprints := []string{"0123456789ABCDEF0123456789ABCDEF01234567"}
+			Expect(conf.Write(bundleDir, grootOutput, certDirectory, thumbprints)).To(Succeed())
+
+			data, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			cont := oci.Spec{}
+			Expect(json.Unmarshal(data, &cont)).To(Succeed())
+			Expect(cont.Mounts).To(Equal([]oci.Mount{{Destination: "c:\\trusted_certs", Source: certDirectory}}))
+
+			removal, err := container.RemoveCertificatesPs(thumbprints)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cont.Process.Args).To(ConsistOf("powershell.exe", "-Command", container.ImportCertificatePs+"; "+removal))
+		})
+
+		It("rejects anything that is not a thumbprint", func() {
+			err := conf.Write(bundleDir, grootOutput, certDirectory, []string{"not-a-thumbprint"})
+			Expect(err).To(MatchError(ContainSubstring("invalid thumbprint")))
+			Expect(path).NotTo(BeAnExistingFile())
+		})
+	})
+
 	Context("when the groot output is invalid json", func() {
 		It("returns  helpful error message", func() {
-			err = conf.Write(bundleDir, "$$$", certDirectory)
+			err = conf.Write(bundleDir, "$$$", certDirectory, nil)
 			Expect(err).To(MatchError("json unmarshal groot output: invalid character '$' looking for beginning of value"))
 		})
 	})
@@ -0,0 +1,59 @@
+package fakes
+
+type Bundle struct {
+	ValidateCall struct {
+		CallCount int
+		Receives  []ValidateCallReceive
+		Returns   []ValidateCallReturn
+	}
+	DigestCall struct {
+		CallCount int
+		Receives  []DigestCallReceive
+		Returns   []DigestCallReturn
+	}
+}
+
+type ValidateCallReceive struct {
+	CertDirectory string
+}
+
+type ValidateCallReturn struct {
+	Error error
+}
+
+type DigestCallReceive struct {
+	CertDirectory string
+}
+
+type DigestCallReturn struct {
+	Digest string
+	Error  error
+}
+
+func (b *Bundle) Validate(certDirectory string) error {
+	b.ValidateCall.CallCount++
+
+	b.ValidateCall.Receives = append(b.ValidateCall.Receives, ValidateCallReceive{
+		CertDirectory: certDirectory,
+	})
+
+	if len(b.ValidateCall.Returns) < b.ValidateCall.CallCount {
+		return nil
+	}
+
+	return b.ValidateCall.Returns[b.ValidateCall.CallCount-1].Error
+}
+
+func (b *Bundle) Digest(certDirectory string) (string, error) {
+	b.DigestCall.CallCount++
+
+	b.DigestCall.Receives = append(b.DigestCall.Receives, DigestCallReceive{
+		CertDirectory: certDirectory,
+	})
+
+	if len(b.DigestCall.Returns) < b.DigestCall.CallCount {
+		return "", nil
+	}
+
+	return b.DigestCall.Returns[b.DigestCall.CallCount-1].Digest, b.DigestCall.Returns[b.DigestCall.CallCount-1].Error
+}
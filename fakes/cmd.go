@@ -1,5 +1,7 @@
 package fakes
 
+import "context"
+
 type Cmd struct {
 	RunCall struct {
 		CallCount int
@@ -9,7 +11,7 @@ type Cmd struct {
 	}
 }
 
-type RunCallOnCall func(executable string, args ...string) (string, string, error)
+type RunCallOnCall func(ctx context.Context, executable string, args ...string) (string, string, error)
 
 type RunCallReceive struct {
 	Executable string
@@ -22,7 +24,7 @@ type RunCallReturn struct {
 	Error  error
 }
 
-func (c *Cmd) Run(executable string, args ...string) (string, string, error) {
+func (c *Cmd) Run(ctx context.Context, executable string, args ...string) (string, string, error) {
 	c.RunCall.CallCount++
 
 	c.RunCall.Receives = append(c.RunCall.Receives, RunCallReceive{
@@ -30,8 +32,10 @@ func (c *Cmd) Run(executable string, args ...string) (string, string, error) {
 		Args:       args,
 	})
 
-	if onCall := c.RunCall.OnCall[c.RunCall.CallCount-1]; onCall != nil {
-		return onCall(executable, args...)
+	if len(c.RunCall.OnCall) >= c.RunCall.CallCount {
+		if onCall := c.RunCall.OnCall[c.RunCall.CallCount-1]; onCall != nil {
+			return onCall(ctx, executable, args...)
+		}
 	}
 
 	if len(c.RunCall.Returns) < c.RunCall.CallCount {
@@ -6,25 +6,32 @@ type Config struct {
 		Receives  []WriteCallReceive
 		Returns   []WriteCallReturn
 	}
+	GenerateCall struct {
+		CallCount int
+		Receives  []GenerateCallReceive
+		Returns   []GenerateCallReturn
+	}
 }
 
 type WriteCallReceive struct {
 	BundleDir   string
 	GrootOutput string
 	CertData    string
+	Thumbprints []string
 }
 
 type WriteCallReturn struct {
 	Error error
 }
 
-func (c *Config) Write(bundleDir string, grootOutput string, certData string) error {
+func (c *Config) Write(bundleDir string, grootOutput string, certData string, thumbprints []string) error {
 	c.WriteCall.CallCount++
 
 	c.WriteCall.Receives = append(c.WriteCall.Receives, WriteCallReceive{
 		BundleDir:   bundleDir,
 		GrootOutput: grootOutput,
 		CertData:    certData,
+		Thumbprints: thumbprints,
 	})
 
 	if len(c.WriteCall.Returns) < c.WriteCall.CallCount {
@@ -33,3 +40,30 @@ func (c *Config) Write(bundleDir string, grootOutput string, certData string) er
 
 	return c.WriteCall.Returns[c.WriteCall.CallCount-1].Error
 }
+
+type GenerateCallReceive struct {
+	GrootOutput string
+	CertData    string
+	Thumbprints []string
+}
+
+type GenerateCallReturn struct {
+	Config []byte
+	Error  error
+}
+
+func (c *Config) Generate(grootOutput string, certData string, thumbprints []string) ([]byte, error) {
+	c.GenerateCall.CallCount++
+
+	c.GenerateCall.Receives = append(c.GenerateCall.Receives, GenerateCallReceive{
+		GrootOutput: grootOutput,
+		CertData:    certData,
+		Thumbprints: thumbprints,
+	})
+
+	if len(c.GenerateCall.Returns) < c.GenerateCall.CallCount {
+		return nil, nil
+	}
+
+	return c.GenerateCall.Returns[c.GenerateCall.CallCount-1].Config, c.GenerateCall.Returns[c.GenerateCall.CallCount-1].Error
+}
@@ -0,0 +1,71 @@
+package fakes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Ids hands out predictable names under Dir, so tests can assert exact
+// container ids and paths.
+type Ids struct {
+	Dir string
+
+	ContainerIdCall struct {
+		CallCount int
+		Returns   []ContainerIdCallReturn
+	}
+	BundleDirCall struct {
+		CallCount int
+		Receives  []BundleDirCallReceive
+	}
+	DiffOutputFileCall struct {
+		CallCount int
+		Receives  []DiffOutputFileCallReceive
+	}
+}
+
+type ContainerIdCallReturn struct {
+	Error error
+}
+
+type BundleDirCallReceive struct {
+	ContainerId string
+}
+
+type DiffOutputFileCallReceive struct {
+	ContainerId string
+}
+
+func (i *Ids) ContainerId() (string, error) {
+	i.ContainerIdCall.CallCount++
+
+	if len(i.ContainerIdCall.Returns) >= i.ContainerIdCall.CallCount {
+		if err := i.ContainerIdCall.Returns[i.ContainerIdCall.CallCount-1].Error; err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("layer-%d", i.ContainerIdCall.CallCount), nil
+}
+
+func (i *Ids) BundleDir(containerId string) (string, error) {
+	i.BundleDirCall.CallCount++
+
+	i.BundleDirCall.Receives = append(i.BundleDirCall.Receives, BundleDirCallReceive{
+		ContainerId: containerId,
+	})
+
+	bundleDir := filepath.Join(i.Dir, containerId)
+	return bundleDir, os.MkdirAll(bundleDir, 0755)
+}
+
+func (i *Ids) DiffOutputFile(containerId string) (string, error) {
+	i.DiffOutputFileCall.CallCount++
+
+	i.DiffOutputFileCall.Receives = append(i.DiffOutputFileCall.Receives, DiffOutputFileCallReceive{
+		ContainerId: containerId,
+	})
+
+	return filepath.Join(i.Dir, "diff-output-"+containerId), nil
+}
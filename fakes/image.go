@@ -0,0 +1,224 @@
+package fakes
+
+type Image struct {
+	SnapshotCall struct {
+		CallCount int
+		Receives  []SnapshotCallReceive
+		Returns   []SnapshotCallReturn
+	}
+	RestoreCall struct {
+		CallCount int
+		Receives  []RestoreCallReceive
+		Returns   []RestoreCallReturn
+	}
+	DiscardCall struct {
+		CallCount int
+		Receives  []DiscardCallReceive
+	}
+	LayerAnnotationCall struct {
+		CallCount int
+		Receives  []LayerAnnotationCallReceive
+		Returns   []LayerAnnotationCallReturn
+	}
+	AnnotateLayerCall struct {
+		CallCount int
+		Receives  []AnnotateLayerCallReceive
+		Returns   []AnnotateLayerCallReturn
+	}
+	LayerDigestCall struct {
+		CallCount int
+		Receives  []LayerDigestCallReceive
+		Returns   []LayerDigestCallReturn
+	}
+	CustomLayersCall struct {
+		CallCount int
+		Receives  []CustomLayersCallReceive
+		Returns   []CustomLayersCallReturn
+	}
+	ManifestDigestCall struct {
+		CallCount int
+		Receives  []ManifestDigestCallReceive
+		Returns   []ManifestDigestCallReturn
+	}
+}
+
+type SnapshotCallReceive struct {
+	URI string
+}
+
+type SnapshotCallReturn struct {
+	Snapshot string
+	Error    error
+}
+
+type RestoreCallReceive struct {
+	URI      string
+	Snapshot string
+}
+
+type RestoreCallReturn struct {
+	Error error
+}
+
+type DiscardCallReceive struct {
+	Snapshot string
+}
+
+type LayerAnnotationCallReceive struct {
+	URI string
+	Key string
+}
+
+type LayerAnnotationCallReturn struct {
+	Value string
+	Error error
+}
+
+type AnnotateLayerCallReceive struct {
+	URI   string
+	Key   string
+	Value string
+}
+
+type AnnotateLayerCallReturn struct {
+	Error error
+}
+
+type LayerDigestCallReceive struct {
+	URI string
+}
+
+type LayerDigestCallReturn struct {
+	Digest string
+	Error  error
+}
+
+type CustomLayersCallReceive struct {
+	URI string
+}
+
+type CustomLayersCallReturn struct {
+	Layers []map[string]string
+	Error  error
+}
+
+type ManifestDigestCallReceive struct {
+	URI string
+}
+
+type ManifestDigestCallReturn struct {
+	Digest string
+	Error  error
+}
+
+func (s *Image) Snapshot(uri string) (string, error) {
+	s.SnapshotCall.CallCount++
+
+	s.SnapshotCall.Receives = append(s.SnapshotCall.Receives, SnapshotCallReceive{
+		URI: uri,
+	})
+
+	if len(s.SnapshotCall.Returns) < s.SnapshotCall.CallCount {
+		return "", nil
+	}
+
+	return s.SnapshotCall.Returns[s.SnapshotCall.CallCount-1].Snapshot, s.SnapshotCall.Returns[s.SnapshotCall.CallCount-1].Error
+}
+
+func (s *Image) Restore(uri, snapshot string) error {
+	s.RestoreCall.CallCount++
+
+	s.RestoreCall.Receives = append(s.RestoreCall.Receives, RestoreCallReceive{
+		URI:      uri,
+		Snapshot: snapshot,
+	})
+
+	if len(s.RestoreCall.Returns) < s.RestoreCall.CallCount {
+		return nil
+	}
+
+	return s.RestoreCall.Returns[s.RestoreCall.CallCount-1].Error
+}
+
+func (s *Image) Discard(snapshot string) error {
+	s.DiscardCall.CallCount++
+
+	s.DiscardCall.Receives = append(s.DiscardCall.Receives, DiscardCallReceive{
+		Snapshot: snapshot,
+	})
+
+	return nil
+}
+
+func (s *Image) LayerAnnotation(uri, key string) (string, error) {
+	s.LayerAnnotationCall.CallCount++
+
+	s.LayerAnnotationCall.Receives = append(s.LayerAnnotationCall.Receives, LayerAnnotationCallReceive{
+		URI: uri,
+		Key: key,
+	})
+
+	if len(s.LayerAnnotationCall.Returns) < s.LayerAnnotationCall.CallCount {
+		return "", nil
+	}
+
+	return s.LayerAnnotationCall.Returns[s.LayerAnnotationCall.CallCount-1].Value, s.LayerAnnotationCall.Returns[s.LayerAnnotationCall.CallCount-1].Error
+}
+
+func (s *Image) AnnotateLayer(uri, key, value string) error {
+	s.AnnotateLayerCall.CallCount++
+
+	s.AnnotateLayerCall.Receives = append(s.AnnotateLayerCall.Receives, AnnotateLayerCallReceive{
+		URI:   uri,
+		Key:   key,
+		Value: value,
+	})
+
+	if len(s.AnnotateLayerCall.Returns) < s.AnnotateLayerCall.CallCount {
+		return nil
+	}
+
+	return s.AnnotateLayerCall.Returns[s.AnnotateLayerCall.CallCount-1].Error
+}
+
+func (s *Image) LayerDigest(uri string) (string, error) {
+	s.LayerDigestCall.CallCount++
+
+	s.LayerDigestCall.Receives = append(s.LayerDigestCall.Receives, LayerDigestCallReceive{
+		URI: uri,
+	})
+
+	if len(s.LayerDigestCall.Returns) < s.LayerDigestCall.CallCount {
+		return "", nil
+	}
+
+	return s.LayerDigestCall.Returns[s.LayerDigestCall.CallCount-1].Digest, s.LayerDigestCall.Returns[s.LayerDigestCall.CallCount-1].Error
+}
+
+func (s *Image) CustomLayers(uri string) ([]map[string]string, error) {
+	s.CustomLayersCall.CallCount++
+
+	s.CustomLayersCall.Receives = append(s.CustomLayersCall.Receives, CustomLayersCallReceive{
+		URI: uri,
+	})
+
+	if len(s.CustomLayersCall.Returns) < s.CustomLayersCall.CallCount {
+		return nil, nil
+	}
+
+	return s.CustomLayersCall.Returns[s.CustomLayersCall.CallCount-1].Layers, s.CustomLayersCall.Returns[s.CustomLayersCall.CallCount-1].Error
+}
+
+func (s *Image) ManifestDigest(uri string) (string, error) {
+	s.ManifestDigestCall.CallCount++
+
+	s.ManifestDigestCall.Receives = append(s.ManifestDigestCall.Receives, ManifestDigestCallReceive{
+		URI: uri,
+	})
+
+	if len(s.ManifestDigestCall.Returns) < s.ManifestDigestCall.CallCount {
+		return "", nil
+	}
+
+	return s.ManifestDigestCall.Returns[s.ManifestDigestCall.CallCount-1].Digest, s.ManifestDigestCall.Returns[s.ManifestDigestCall.CallCount-1].Error
+}
@@ -0,0 +1,38 @@
+package fakes
+
+import "context"
+
+type LayerAdder struct {
+	AddLayerCall struct {
+		CallCount int
+		Receives  []AddLayerCallReceive
+		Returns   []AddLayerCallReturn
+	}
+}
+
+type AddLayerCallReceive struct {
+	URI       string
+	LayerFile string
+}
+
+type AddLayerCallReturn struct {
+	Stdout string
+	Stderr string
+	Error  error
+}
+
+func (l *LayerAdder) AddLayer(ctx context.Context, uri, layerFile string) (string, string, error) {
+	l.AddLayerCall.CallCount++
+
+	l.AddLayerCall.Receives = append(l.AddLayerCall.Receives, AddLayerCallReceive{
+		URI:       uri,
+		LayerFile: layerFile,
+	})
+
+	if len(l.AddLayerCall.Returns) < l.AddLayerCall.CallCount {
+		return "", "", nil
+	}
+
+	r := l.AddLayerCall.Returns[l.AddLayerCall.CallCount-1]
+	return r.Stdout, r.Stderr, r.Error
+}
@@ -0,0 +1,39 @@
+package fakes
+
+import "os"
+
+type LayerBuilder struct {
+	BuildLayerCall struct {
+		CallCount int
+		Receives  []BuildLayerCallReceive
+		Returns   []BuildLayerCallReturn
+	}
+}
+
+type BuildLayerCallReceive struct {
+	OutputFile    string
+	CertDirectory string
+}
+
+type BuildLayerCallReturn struct {
+	Error error
+}
+
+// BuildLayer writes a stand-in layer to outputFile unless it is set up to
+// fail.
+func (l *LayerBuilder) BuildLayer(outputFile, certDirectory string) error {
+	l.BuildLayerCall.CallCount++
+
+	l.BuildLayerCall.Receives = append(l.BuildLayerCall.Receives, BuildLayerCallReceive{
+		OutputFile:    outputFile,
+		CertDirectory: certDirectory,
+	})
+
+	if len(l.BuildLayerCall.Returns) >= l.BuildLayerCall.CallCount {
+		if err := l.BuildLayerCall.Returns[l.BuildLayerCall.CallCount-1].Error; err != nil {
+			return err
+		}
+	}
+
+	return os.WriteFile(outputFile, []byte("some-layer-data"), 0644)
+}
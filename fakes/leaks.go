@@ -0,0 +1,85 @@
+package fakes
+
+type Leaks struct {
+	AddLeakCall struct {
+		CallCount int
+		Receives  []LeakCallReceive
+		Returns   []AddLeakCallReturn
+	}
+	RemoveLeakCall struct {
+		CallCount int
+		Receives  []LeakCallReceive
+		Returns   []RemoveLeakCallReturn
+	}
+	LeaksCall struct {
+		CallCount int
+		Receives  []LeaksCallReceive
+		Returns   []LeaksCallReturn
+	}
+}
+
+type LeakCallReceive struct {
+	DriverStore string
+	ContainerId string
+}
+
+type AddLeakCallReturn struct {
+	Error error
+}
+
+type RemoveLeakCallReturn struct {
+	Error error
+}
+
+type LeaksCallReceive struct {
+	DriverStore string
+}
+
+type LeaksCallReturn struct {
+	ContainerIds []string
+	Error        error
+}
+
+func (l *Leaks) AddLeak(driverStore, containerId string) error {
+	l.AddLeakCall.CallCount++
+
+	l.AddLeakCall.Receives = append(l.AddLeakCall.Receives, LeakCallReceive{
+		DriverStore: driverStore,
+		ContainerId: containerId,
+	})
+
+	if len(l.AddLeakCall.Returns) < l.AddLeakCall.CallCount {
+		return nil
+	}
+
+	return l.AddLeakCall.Returns[l.AddLeakCall.CallCount-1].Error
+}
+
+func (l *Leaks) RemoveLeak(driverStore, containerId string) error {
+	l.RemoveLeakCall.CallCount++
+
+	l.RemoveLeakCall.Receives = append(l.RemoveLeakCall.Receives, LeakCallReceive{
+		DriverStore: driverStore,
+		ContainerId: containerId,
+	})
+
+	if len(l.RemoveLeakCall.Returns) < l.RemoveLeakCall.CallCount {
+		return nil
+	}
+
+	return l.RemoveLeakCall.Returns[l.RemoveLeakCall.CallCount-1].Error
+}
+
+func (l *Leaks) Leaks(driverStore string) ([]string, error) {
+	l.LeaksCall.CallCount++
+
+	l.LeaksCall.Receives = append(l.LeaksCall.Receives, LeaksCallReceive{
+		DriverStore: driverStore,
+	})
+
+	if len(l.LeaksCall.Returns) < l.LeaksCall.CallCount {
+		return nil, nil
+	}
+
+	return l.LeaksCall.Returns[l.LeaksCall.CallCount-1].ContainerIds, l.LeaksCall.Returns[l.LeaksCall.CallCount-1].Error
+}
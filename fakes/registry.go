@@ -0,0 +1,94 @@
+package fakes
+
+import "context"
+
+type Registry struct {
+	PullCall struct {
+		CallCount int
+		Receives  []PullCallReceive
+		Returns   []PullCallReturn
+	}
+	PushCall struct {
+		CallCount int
+		Receives  []PushCallReceive
+		Returns   []PushCallReturn
+	}
+	ResolveCall struct {
+		CallCount int
+		Receives  []ResolveCallReceive
+		Returns   []ResolveCallReturn
+	}
+}
+
+type PullCallReceive struct {
+	URI string
+	Dir string
+}
+
+type PullCallReturn struct {
+	Error error
+}
+
+type PushCallReceive struct {
+	Dir string
+	URI string
+	Tag string
+}
+
+type PushCallReturn struct {
+	Error error
+}
+
+type ResolveCallReceive struct {
+	URI string
+}
+
+type ResolveCallReturn struct {
+	Digest string
+	Error  error
+}
+
+func (r *Registry) Pull(ctx context.Context, uri, dir string) error {
+	r.PullCall.CallCount++
+
+	r.PullCall.Receives = append(r.PullCall.Receives, PullCallReceive{
+		URI: uri,
+		Dir: dir,
+	})
+
+	if len(r.PullCall.Returns) < r.PullCall.CallCount {
+		return nil
+	}
+
+	return r.PullCall.Returns[r.PullCall.CallCount-1].Error
+}
+
+func (r *Registry) Push(ctx context.Context, dir, uri, tag string) error {
+	r.PushCall.CallCount++
+
+	r.PushCall.Receives = append(r.PushCall.Receives, PushCallReceive{
+		Dir: dir,
+		URI: uri,
+		Tag: tag,
+	})
+
+	if len(r.PushCall.Returns) < r.PushCall.CallCount {
+		return nil
+	}
+
+	return r.PushCall.Returns[r.PushCall.CallCount-1].Error
+}
+
+func (r *Registry) Resolve(ctx context.Context, uri string) (string, error) {
+	r.ResolveCall.CallCount++
+
+	r.ResolveCall.Receives = append(r.ResolveCall.Receives, ResolveCallReceive{
+		URI: uri,
+	})
+
+	if len(r.ResolveCall.Returns) < r.ResolveCall.CallCount {
+		return "", nil
+	}
+
+	return r.ResolveCall.Returns[r.ResolveCall.CallCount-1].Digest, r.ResolveCall.Returns[r.ResolveCall.CallCount-1].Error
+}
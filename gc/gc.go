@@ -0,0 +1,291 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/certs"
+	"code.cloudfoundry.org/cert-injector/ids"
+	"code.cloudfoundry.org/cert-injector/injector"
+	"code.cloudfoundry.org/cert-injector/lock"
+)
+
+// tempSuffix is the random part os.MkdirTemp and os.CreateTemp append.
+const tempSuffix = "-[0-9]+"
+
+var (
+	// volumeName matches the container ids of the ids package and the
+	// layer-<number> ids of releases that predate it.
+	volumeName = regexp.MustCompile("^(" + ids.ContainerIdPattern + "|" + ids.ContainerIdPrefix + "-?[0-9]+)$")
+
+	// tempName matches the bundle directories, diff output files and
+	// certificate staging directories of current and earlier releases.
+	tempName = regexp.MustCompile("^(" + strings.Join([]string{
+		ids.ContainerIdPattern + tempSuffix,
+		ids.DiffOutputFilePrefix + ids.ContainerIdPattern + tempSuffix,
+		certs.StagingDirPrefix + "[0-9]+",
+		ids.ContainerIdPrefix + "-?[0-9]+",
+		"diff-output-?[0-9]+",
+	}, "|") + ")$")
+)
+
+// TempPathLockKey names the lock a run holds on a temp path it created for as
+// long as it uses it. Collect skips temp paths whose lock is held.
+func TempPathLockKey(path string) string {
+	return "temp path " + filepath.Clean(path)
+}
+
+type cmd interface {
+	Run(ctx context.Context, executable string, args ...string) (string, string, error)
+}
+
+type leaks interface {
+	RemoveLeak(driverStore, containerId string) error
+	Leaks(driverStore string) ([]string, error)
+}
+
+type Options struct {
+	// TempDir is where bundle directories, diff output files and
+	// certificate staging directories are created.
+	TempDir string
+
+	// LockDir holds the temp path locks of runs in progress. Temp paths
+	// whose lock is held are left alone.
+	LockDir string
+
+	// MinAge protects the leftovers of a run that is still in progress.
+	// Volumes and temp paths modified more recently are left alone, which
+	// also covers a temp path in the moment between its creation and its
+	// lock. Volumes recorded as leaked are collected regardless of age.
+	MinAge time.Duration
+
+	// Timeout bounds each groot and winc run. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// Leftovers are the volumes and temp paths left behind by earlier runs.
+type Leftovers struct {
+	// Volumes are the container ids of groot volumes and winc containers.
+	Volumes []string
+
+	// Paths are bundle directories, diff output files and certificate
+	// staging directories.
+	Paths []string
+}
+
+// Report describes what Collect reclaimed.
+type Report struct {
+	Volumes []string
+	Paths   []string
+
+	// Bytes is the size of the removed temp paths.
+	Bytes int64
+}
+
+type Collector struct {
+	cmd     cmd
+	leaks   leaks
+	tools   injector.Tools
+	options Options
+	now     func() time.Time
+}
+
+func NewCollector(cmd cmd, leaks leaks, tools injector.Tools, options Options) Collector {
+	return Collector{
+		cmd:     cmd,
+		leaks:   leaks,
+		tools:   tools,
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// Find returns the leftovers of earlier runs: volumes recorded as leaked in
+// the state file, volumes in driverStore named like cert-injector container
+// ids, and bundle directories, diff output files and certificate staging
+// directories in the temp directory.
+func (c Collector) Find(driverStore string) (Leftovers, error) {
+	var leftovers Leftovers
+
+	leaked, err := c.leaks.Leaks(driverStore)
+	if err != nil {
+		return leftovers, fmt.Errorf("read leaked volumes failed: %s", err)
+	}
+
+	volumes, err := c.stale(filepath.Join(driverStore, "volumes"), volumeName)
+	if err != nil {
+		return leftovers, fmt.Errorf("list volumes failed: %s", err)
+	}
+	seen := map[string]bool{}
+	for _, id := range append(leaked, baseNames(volumes)...) {
+		if !seen[id] {
+			seen[id] = true
+			leftovers.Volumes = append(leftovers.Volumes, id)
+		}
+	}
+
+	paths, err := c.stale(c.options.TempDir, tempName)
+	if err != nil {
+		return leftovers, fmt.Errorf("list temp directory failed: %s", err)
+	}
+	for _, path := range paths {
+		pathLock, err := c.lockTempPath(path)
+		if err != nil {
+			return leftovers, err
+		}
+		if pathLock == nil {
+			continue
+		}
+		pathLock.Release()
+		leftovers.Paths = append(leftovers.Paths, path)
+	}
+
+	return leftovers, nil
+}
+
+// Collect deletes the containers and volumes and removes the temp paths in
+// leftovers. It carries on past failures and returns them joined.
+func (c Collector) Collect(ctx context.Context, driverStore string, leftovers Leftovers) (Report, error) {
+	var report Report
+	var errs []error
+
+	for _, containerId := range leftovers.Volumes {
+		// Most leaked volumes have no container left, so a failing winc
+		// delete is expected and only groot delete decides the outcome.
+		c.run(ctx, c.tools.Winc, "delete", containerId)
+
+		_, stderr, err := c.run(ctx, c.tools.Groot, "--driver-store", driverStore, "delete", containerId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("groot delete %s failed: %s: %s", containerId, err, strings.TrimSpace(stderr)))
+			continue
+		}
+
+		err = c.leaks.RemoveLeak(driverStore, containerId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("forget leaked volume %s failed: %s", containerId, err))
+		}
+		report.Volumes = append(report.Volumes, containerId)
+	}
+
+	for _, path := range leftovers.Paths {
+		removed, size, err := c.removeTempPath(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if removed {
+			report.Paths = append(report.Paths, path)
+			report.Bytes += size
+		}
+	}
+
+	return report, errors.Join(errs...)
+}
+
+// removeTempPath removes path while holding its lock. It leaves path alone
+// if a run took the lock since Find.
+func (c Collector) removeTempPath(path string) (bool, int64, error) {
+	pathLock, err := c.lockTempPath(path)
+	if err != nil {
+		return false, 0, err
+	}
+	if pathLock == nil {
+		return false, 0, nil
+	}
+	defer pathLock.Release()
+
+	size := diskUsage(path)
+	err = os.RemoveAll(path)
+	if err != nil {
+		return false, 0, fmt.Errorf("remove %s failed: %s", path, err)
+	}
+	return true, size, nil
+}
+
+// lockTempPath takes the lock of path without waiting. It returns a nil lock
+// if a run in progress holds it.
+func (c Collector) lockTempPath(path string) (*lock.Lock, error) {
+	pathLock, err := lock.NewLocker(c.options.LockDir).Acquire(context.Background(), TempPathLockKey(path), 0)
+	var heldErr *lock.HeldError
+	if errors.As(err, &heldErr) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lock %s failed: %s", path, err)
+	}
+	return pathLock, nil
+}
+
+func (c Collector) run(ctx context.Context, executable string, args ...string) (string, string, error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+	return c.cmd.Run(ctx, executable, args...)
+}
+
+// stale returns the entries of dir whose names match name and that were last
+// modified at least MinAge ago. A missing dir has none.
+func (c Collector) stale(dir string, name *regexp.Regexp) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if !name.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			continue
+		}
+		if c.now().Sub(info.ModTime()) < c.options.MinAge {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func baseNames(paths []string) []string {
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
+// diskUsage returns the size of the files under path, ignoring anything
+// that cannot be read.
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
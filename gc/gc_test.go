@@ -0,0 +1,203 @@
+package gc_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/fakes"
+	"code.cloudfoundry.org/cert-injector/gc"
+	"code.cloudfoundry.org/cert-injector/injector"
+	"code.cloudfoundry.org/cert-injector/lock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Collector", func() {
+	var (
+		fakeCmd   *fakes.Cmd
+		fakeLeaks *fakes.Leaks
+
+		driverStore string
+		tempDir     string
+		lockDir     string
+		tools       injector.Tools
+
+		collector gc.Collector
+	)
+
+	touch := func(path string, age time.Duration, data string) {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(os.WriteFile(path, []byte(data), 0644)).To(Succeed())
+		mtime := time.Now().Add(-age)
+		Expect(os.Chtimes(path, mtime, mtime)).To(Succeed())
+	}
+
+	mkdir := func(path string, age time.Duration) {
+		Expect(os.MkdirAll(path, 0755)).To(Succeed())
+		mtime := time.Now().Add(-age)
+		Expect(os.Chtimes(path, mtime, mtime)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		fakeCmd = &fakes.Cmd{}
+		fakeLeaks = &fakes.Leaks{}
+
+		root := GinkgoT().TempDir()
+		driverStore = filepath.Join(root, "driver-store")
+		tempDir = filepath.Join(root, "temp")
+		Expect(os.MkdirAll(tempDir, 0755)).To(Succeed())
+		lockDir = filepath.Join(root, "locks")
+		tools = injector.Tools{Groot: "groot.exe", Winc: "winc.exe"}
+
+		collector = gc.NewCollector(fakeCmd, fakeLeaks, tools, gc.Options{TempDir: tempDir, LockDir: lockDir, MinAge: time.Hour})
+	})
+
+	Describe("Find", func() {
+		BeforeEach(func() {
+			fakeLeaks.LeaksCall.Returns = []fakes.LeaksCallReturn{{ContainerIds: []string{"layer-0000000000000001", "layer-0000000000000002"}}}
+
+			mkdir(filepath.Join(driverStore, "volumes", "layer-0000000000000002"), 2*time.Hour)
+			mkdir(filepath.Join(driverStore, "volumes", "layer-00000000000000ff"), 2*time.Hour)
+			mkdir(filepath.Join(driverStore, "volumes", "layer--12345"), 2*time.Hour)
+			mkdir(filepath.Join(driverStore, "volumes", "layer-00000000000000aa"), time.Minute)
+			mkdir(filepath.Join(driverStore, "volumes", "layer-cake-app"), 2*time.Hour)
+			mkdir(filepath.Join(driverStore, "volumes", "some-app-container"), 2*time.Hour)
+
+			touch(filepath.Join(tempDir, "layer-0123456789abcdef-123", "config.json"), 2*time.Hour, "{}")
+			mkdir(filepath.Join(tempDir, "layer-0123456789abcdef-123"), 2*time.Hour)
+			mkdir(filepath.Join(tempDir, "layer-12345"), 2*time.Hour)
+			touch(filepath.Join(tempDir, "diff-output-layer-0123456789abcdef-456"), 2*time.Hour, "layer")
+			touch(filepath.Join(tempDir, "diff-output12345"), 2*time.Hour, "layer")
+			touch(filepath.Join(tempDir, "diff-output-layer-00000000000000aa-789"), time.Minute, "layer")
+			mkdir(filepath.Join(tempDir, "cert-injector-certs-123"), 2*time.Hour)
+			touch(filepath.Join(tempDir, "layer-notes.txt"), 2*time.Hour, "data")
+			touch(filepath.Join(tempDir, "diff-output-report.json"), 2*time.Hour, "data")
+			mkdir(filepath.Join(tempDir, "cert-injector-certs-backup"), 2*time.Hour)
+			touch(filepath.Join(tempDir, "some-other-file"), 2*time.Hour, "data")
+		})
+
+		It("finds leaked and orphaned volumes and old temp paths", func() {
+			leftovers, err := collector.Find(driverStore)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeLeaks.LeaksCall.Receives[0].DriverStore).To(Equal(driverStore))
+			Expect(leftovers.Volumes).To(Equal([]string{"layer-0000000000000001", "layer-0000000000000002", "layer--12345", "layer-00000000000000ff"}))
+			Expect(leftovers.Paths).To(Equal([]string{
+				filepath.Join(tempDir, "cert-injector-certs-123"),
+				filepath.Join(tempDir, "diff-output-layer-0123456789abcdef-456"),
+				filepath.Join(tempDir, "diff-output12345"),
+				filepath.Join(tempDir, "layer-0123456789abcdef-123"),
+				filepath.Join(tempDir, "layer-12345"),
+			}))
+		})
+
+		It("skips old temp paths a run in progress holds the lock of", func() {
+			held, err := lock.NewLocker(lockDir).Acquire(context.Background(), gc.TempPathLockKey(filepath.Join(tempDir, "layer-0123456789abcdef-123")), 0)
+			Expect(err).NotTo(HaveOccurred())
+			defer held.Release()
+
+			leftovers, err := collector.Find(driverStore)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(leftovers.Paths).NotTo(ContainElement(filepath.Join(tempDir, "layer-0123456789abcdef-123")))
+			Expect(leftovers.Paths).To(HaveLen(4))
+		})
+
+		Context("when the driver store has no volumes directory", func() {
+			BeforeEach(func() {
+				Expect(os.RemoveAll(filepath.Join(driverStore, "volumes"))).To(Succeed())
+			})
+
+			It("only finds the leaked volumes", func() {
+				leftovers, err := collector.Find(driverStore)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(leftovers.Volumes).To(Equal([]string{"layer-0000000000000001", "layer-0000000000000002"}))
+			})
+		})
+
+		Context("when the state file cannot be read", func() {
+			BeforeEach(func() {
+				fakeLeaks.LeaksCall.Returns[0].Error = errors.New("corrupt")
+			})
+
+			It("returns a helpful error", func() {
+				_, err := collector.Find(driverStore)
+				Expect(err).To(MatchError("read leaked volumes failed: corrupt"))
+			})
+		})
+	})
+
+	Describe("Collect", func() {
+		var leftovers gc.Leftovers
+
+		BeforeEach(func() {
+			bundleDir := filepath.Join(tempDir, "layer-1-123")
+			touch(filepath.Join(bundleDir, "config.json"), 0, "{}")
+			diffOutput := filepath.Join(tempDir, "diff-output-layer-1-456")
+			touch(diffOutput, 0, "layer")
+
+			leftovers = gc.Leftovers{
+				Volumes: []string{"layer-1", "layer-2"},
+				Paths:   []string{bundleDir, diffOutput},
+			}
+		})
+
+		It("deletes the containers and volumes and removes the temp paths", func() {
+			report, err := collector.Collect(context.Background(), driverStore, leftovers)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCmd.RunCall.Receives).To(Equal([]fakes.RunCallReceive{
+				{Executable: "winc.exe", Args: []string{"delete", "layer-1"}},
+				{Executable: "groot.exe", Args: []string{"--driver-store", driverStore, "delete", "layer-1"}},
+				{Executable: "winc.exe", Args: []string{"delete", "layer-2"}},
+				{Executable: "groot.exe", Args: []string{"--driver-store", driverStore, "delete", "layer-2"}},
+			}))
+			Expect(fakeLeaks.RemoveLeakCall.Receives).To(Equal([]fakes.LeakCallReceive{
+				{DriverStore: driverStore, ContainerId: "layer-1"},
+				{DriverStore: driverStore, ContainerId: "layer-2"},
+			}))
+
+			Expect(report.Volumes).To(Equal([]string{"layer-1", "layer-2"}))
+			Expect(report.Paths).To(Equal(leftovers.Paths))
+			Expect(report.Bytes).To(Equal(int64(len("{}") + len("layer"))))
+			for _, path := range leftovers.Paths {
+				Expect(path).NotTo(BeAnExistingFile())
+			}
+		})
+
+		Context("when a run took the lock of a temp path since it was found", func() {
+			It("leaves the temp path alone", func() {
+				held, err := lock.NewLocker(lockDir).Acquire(context.Background(), gc.TempPathLockKey(leftovers.Paths[0]), 0)
+				Expect(err).NotTo(HaveOccurred())
+				defer held.Release()
+
+				report, err := collector.Collect(context.Background(), driverStore, leftovers)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(report.Paths).To(Equal([]string{leftovers.Paths[1]}))
+				Expect(leftovers.Paths[0]).To(BeADirectory())
+				Expect(leftovers.Paths[1]).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when winc and groot fail", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.Returns = []fakes.RunCallReturn{
+					{Error: errors.New("container not found")},
+					{Stderr: "volume in use\n", Error: errors.New("exit status 1")},
+					{Error: errors.New("container not found")},
+				}
+			})
+
+			It("ignores winc, keeps going and returns the groot failures", func() {
+				report, err := collector.Collect(context.Background(), driverStore, leftovers)
+				Expect(err).To(MatchError("groot delete layer-1 failed: exit status 1: volume in use"))
+
+				Expect(report.Volumes).To(Equal([]string{"layer-2"}))
+				Expect(fakeLeaks.RemoveLeakCall.Receives).To(Equal([]fakes.LeakCallReceive{{DriverStore: driverStore, ContainerId: "layer-2"}}))
+				Expect(report.Paths).To(HaveLen(2))
+			})
+		})
+	})
+})
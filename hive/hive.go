@@ -0,0 +1,367 @@
+// Package hive reads and writes Windows registry hive files in the regf
+// format, such as the Hives/*_Delta files of a Windows container layer.
+package hive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Value types.
+const (
+	TypeNone   uint32 = 0
+	TypeString uint32 = 1
+	TypeBinary uint32 = 3
+	TypeDWord  uint32 = 4
+)
+
+const (
+	baseBlockSize = 4096
+	binHeaderSize = 32
+
+	// maxDepth bounds how deep Unmarshal follows subkeys.
+	maxDepth = 512
+
+	// maxKeys bounds how many keys Unmarshal reads, so a corrupt hive cannot
+	// make it allocate without limit.
+	maxKeys = 1 << 16
+
+	// maxCellData is the largest value that fits in a single cell. Larger
+	// values are split into segments of a big data record.
+	maxCellData = 16344
+)
+
+const (
+	keyHiveEntry = 0x0004
+	keyNoDelete  = 0x0008
+	keyCompName  = 0x0020
+
+	valueCompName = 0x0001
+
+	inlineData = 0x80000000
+	noCell     = 0xFFFFFFFF
+)
+
+// Key is a registry key with its values and subkeys.
+type Key struct {
+	Name    string
+	Values  []Value
+	Subkeys []*Key
+}
+
+// Value is a named registry value. The default value of a key has an empty
+// name.
+type Value struct {
+	Name string
+	Type uint32
+	Data []byte
+}
+
+// Subkey follows path from k, matching names case-insensitively like the
+// registry does, and returns nil when a key on the way does not exist.
+func (k *Key) Subkey(path ...string) *Key {
+	current := k
+	for _, name := range path {
+		var next *Key
+		for _, subkey := range current.Subkeys {
+			if strings.EqualFold(subkey.Name, name) {
+				next = subkey
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
+// Value returns the value of k with the given name, matched
+// case-insensitively.
+func (k *Key) Value(name string) (Value, bool) {
+	for _, value := range k.Values {
+		if strings.EqualFold(value.Name, name) {
+			return value, true
+		}
+	}
+	return Value{}, false
+}
+
+type reader struct {
+	bins []byte
+
+	// visited holds the offsets of the key nodes and subkey lists read so
+	// far. Each is referenced once in a valid hive, so a revisit means a
+	// cycle or shared cells that could blow up the tree.
+	visited map[uint32]bool
+	keys    int
+}
+
+// Unmarshal parses a regf hive file and returns its root key.
+func Unmarshal(data []byte) (*Key, error) {
+	if len(data) < baseBlockSize || string(data[:4]) != "regf" {
+		return nil, fmt.Errorf("not a registry hive")
+	}
+
+	rootOffset := binary.LittleEndian.Uint32(data[36:])
+	binsSize := binary.LittleEndian.Uint32(data[40:])
+	if uint64(baseBlockSize)+uint64(binsSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("hive bins data of %d bytes exceeds the file", binsSize)
+	}
+
+	r := &reader{bins: data[baseBlockSize : baseBlockSize+binsSize], visited: map[uint32]bool{}}
+	return r.key(rootOffset, 0)
+}
+
+// visit records that the cell at offset was read and fails if it was read
+// before.
+func (r *reader) visit(offset uint32) error {
+	if r.visited[offset] {
+		return fmt.Errorf("cell at %#x is referenced more than once", offset)
+	}
+	r.visited[offset] = true
+	return nil
+}
+
+// cell returns the data of the allocated cell at offset.
+func (r *reader) cell(offset uint32) ([]byte, error) {
+	if uint64(offset)+4 > uint64(len(r.bins)) {
+		return nil, fmt.Errorf("cell offset %#x out of range", offset)
+	}
+
+	size := int32(binary.LittleEndian.Uint32(r.bins[offset:]))
+	if size >= 0 {
+		return nil, fmt.Errorf("cell at %#x is not allocated", offset)
+	}
+
+	end := uint64(offset) + uint64(-int64(size))
+	if end > uint64(len(r.bins)) || -int64(size) < 4 {
+		return nil, fmt.Errorf("cell at %#x has invalid size %d", offset, -size)
+	}
+
+	return r.bins[offset+4 : end], nil
+}
+
+func (r *reader) key(offset uint32, depth int) (*Key, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("keys nested deeper than %d", maxDepth)
+	}
+
+	r.keys++
+	if r.keys > maxKeys {
+		return nil, fmt.Errorf("hive has more than %d keys", maxKeys)
+	}
+
+	err := r.visit(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	nk, err := r.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(nk) < 76 || string(nk[:2]) != "nk" {
+		return nil, fmt.Errorf("cell at %#x is not a key node", offset)
+	}
+
+	flags := binary.LittleEndian.Uint16(nk[2:])
+	subkeyCount := binary.LittleEndian.Uint32(nk[20:])
+	subkeysOffset := binary.LittleEndian.Uint32(nk[28:])
+	valueCount := binary.LittleEndian.Uint32(nk[36:])
+	valuesOffset := binary.LittleEndian.Uint32(nk[40:])
+	nameLength := int(binary.LittleEndian.Uint16(nk[72:]))
+	if 76+nameLength > len(nk) {
+		return nil, fmt.Errorf("key node at %#x has a truncated name", offset)
+	}
+
+	key := &Key{Name: decodeName(nk[76:76+nameLength], flags&keyCompName != 0)}
+
+	if valueCount > 0 {
+		list, err := r.cell(valuesOffset)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", key.Name, err)
+		}
+		if uint64(valueCount)*4 > uint64(len(list)) {
+			return nil, fmt.Errorf("key %s: truncated value list", key.Name)
+		}
+		for n := uint32(0); n < valueCount; n++ {
+			value, err := r.value(binary.LittleEndian.Uint32(list[n*4:]))
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %s", key.Name, err)
+			}
+			key.Values = append(key.Values, value)
+		}
+	}
+
+	if subkeyCount > 0 {
+		offsets, err := r.subkeyList(subkeysOffset, 0)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", key.Name, err)
+		}
+		for _, subkeyOffset := range offsets {
+			subkey, err := r.key(subkeyOffset, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			key.Subkeys = append(key.Subkeys, subkey)
+		}
+	}
+
+	return key, nil
+}
+
+// subkeyList returns the key node offsets of an lf, lh, li or ri list.
+func (r *reader) subkeyList(offset uint32, depth int) ([]uint32, error) {
+	if depth > 1 {
+		return nil, fmt.Errorf("index root nested in an index root")
+	}
+
+	err := r.visit(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := r.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) < 4 {
+		return nil, fmt.Errorf("subkey list at %#x is truncated", offset)
+	}
+
+	count := int(binary.LittleEndian.Uint16(list[2:]))
+	entries := list[4:]
+
+	var stride int
+	switch string(list[:2]) {
+	case "lf", "lh":
+		stride = 8
+	case "li", "ri":
+		stride = 4
+	default:
+		return nil, fmt.Errorf("cell at %#x is not a subkey list", offset)
+	}
+	if count*stride > len(entries) {
+		return nil, fmt.Errorf("subkey list at %#x is truncated", offset)
+	}
+
+	var offsets []uint32
+	for n := 0; n < count; n++ {
+		entry := binary.LittleEndian.Uint32(entries[n*stride:])
+		if string(list[:2]) != "ri" {
+			offsets = append(offsets, entry)
+			continue
+		}
+
+		nested, err := r.subkeyList(entry, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, nested...)
+	}
+
+	return offsets, nil
+}
+
+func (r *reader) value(offset uint32) (Value, error) {
+	vk, err := r.cell(offset)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(vk) < 20 || string(vk[:2]) != "vk" {
+		return Value{}, fmt.Errorf("cell at %#x is not a value", offset)
+	}
+
+	nameLength := int(binary.LittleEndian.Uint16(vk[2:]))
+	size := binary.LittleEndian.Uint32(vk[4:])
+	dataOffset := binary.LittleEndian.Uint32(vk[8:])
+	flags := binary.LittleEndian.Uint16(vk[16:])
+	if 20+nameLength > len(vk) {
+		return Value{}, fmt.Errorf("value at %#x has a truncated name", offset)
+	}
+
+	value := Value{
+		Name: decodeName(vk[20:20+nameLength], flags&valueCompName != 0),
+		Type: binary.LittleEndian.Uint32(vk[12:]),
+	}
+
+	if size&inlineData != 0 {
+		size &^= inlineData
+		if size > 4 {
+			return Value{}, fmt.Errorf("value %s has invalid inline size %d", value.Name, size)
+		}
+		value.Data = append([]byte{}, vk[8:8+size]...)
+		return value, nil
+	}
+
+	if size == 0 {
+		return value, nil
+	}
+
+	data, err := r.cell(dataOffset)
+	if err != nil {
+		return Value{}, fmt.Errorf("value %s: %s", value.Name, err)
+	}
+
+	if size > maxCellData && len(data) >= 8 && string(data[:2]) == "db" {
+		data, err = r.bigData(data)
+		if err != nil {
+			return Value{}, fmt.Errorf("value %s: %s", value.Name, err)
+		}
+	}
+
+	if uint64(size) > uint64(len(data)) {
+		return Value{}, fmt.Errorf("value %s: data of %d bytes is truncated", value.Name, size)
+	}
+	value.Data = append([]byte{}, data[:size]...)
+
+	return value, nil
+}
+
+// bigData joins the segments of a db record.
+func (r *reader) bigData(db []byte) ([]byte, error) {
+	count := int(binary.LittleEndian.Uint16(db[2:]))
+	list, err := r.cell(binary.LittleEndian.Uint32(db[4:]))
+	if err != nil {
+		return nil, err
+	}
+	if count*4 > len(list) {
+		return nil, fmt.Errorf("truncated big data segment list")
+	}
+
+	var data []byte
+	for n := 0; n < count; n++ {
+		segment, err := r.cell(binary.LittleEndian.Uint32(list[n*4:]))
+		if err != nil {
+			return nil, err
+		}
+		if len(segment) > maxCellData {
+			segment = segment[:maxCellData]
+		}
+		data = append(data, segment...)
+	}
+
+	return data, nil
+}
+
+// decodeName decodes a key or value name stored either as Latin-1 or as
+// UTF-16LE.
+func decodeName(raw []byte, compressed bool) string {
+	if compressed {
+		runes := make([]rune, len(raw))
+		for n, b := range raw {
+			runes[n] = rune(b)
+		}
+		return string(runes)
+	}
+
+	units := make([]uint16, len(raw)/2)
+	for n := range units {
+		units[n] = binary.LittleEndian.Uint16(raw[n*2:])
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,208 @@
+package hive_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"code.cloudfoundry.org/cert-injector/hive"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hive", func() {
+	var root *hive.Key
+
+	BeforeEach(func() {
+		root = &hive.Key{
+			Name: "ROOT",
+			Subkeys: []*hive.Key{
+				{
+					Name: "Microsoft",
+					Subkeys: []*hive.Key{
+						{
+							Name: "SystemCertificates",
+							Values: []hive.Value{
+								{Name: "", Type: hive.TypeString, Data: []byte("d\x00\x00\x00")},
+								{Name: "Count", Type: hive.TypeDWord, Data: []byte{7, 0, 0, 0}},
+								{Name: "Blob", Type: hive.TypeBinary, Data: bytes.Repeat([]byte{0xAB}, 3000)},
+								{Name: "Empty", Type: hive.TypeNone},
+							},
+						},
+					},
+				},
+				{Name: "Zürich"},
+				{Name: "証明書"},
+			},
+		}
+	})
+
+	Describe("Marshal", func() {
+		It("writes a hive that Unmarshal reads back", func() {
+			data, err := hive.Marshal(root)
+			Expect(err).NotTo(HaveOccurred())
+
+			parsed, err := hive.Unmarshal(data)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(parsed.Name).To(Equal("ROOT"))
+			Expect(parsed.Subkeys).To(HaveLen(3))
+			Expect(parsed.Subkey("Zürich")).NotTo(BeNil())
+			Expect(parsed.Subkey("証明書")).NotTo(BeNil())
+
+			key := parsed.Subkey("microsoft", "SYSTEMCERTIFICATES")
+			Expect(key).NotTo(BeNil())
+			Expect(key.Values).To(Equal([]hive.Value{
+				{Name: "", Type: hive.TypeString, Data: []byte("d\x00\x00\x00")},
+				{Name: "Count", Type: hive.TypeDWord, Data: []byte{7, 0, 0, 0}},
+				{Name: "Blob", Type: hive.TypeBinary, Data: bytes.Repeat([]byte{0xAB}, 3000)},
+				{Name: "Empty", Type: hive.TypeNone, Data: []byte{}},
+			}))
+
+			value, ok := key.Value("blob")
+			Expect(ok).To(BeTrue())
+			Expect(value.Data).To(HaveLen(3000))
+
+			_, ok = key.Value("missing")
+			Expect(ok).To(BeFalse())
+			Expect(parsed.Subkey("Microsoft", "missing")).To(BeNil())
+		})
+
+		It("writes a valid base block and whole hive bins", func() {
+			data, err := hive.Marshal(root)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(string(data[:4])).To(Equal("regf"))
+			Expect(len(data) % 4096).To(Equal(0))
+			Expect(string(data[4096:4100])).To(Equal("hbin"))
+			Expect(binary.LittleEndian.Uint32(data[40:])).To(Equal(uint32(len(data) - 4096)))
+
+			var sum uint32
+			for n := 0; n < 508; n += 4 {
+				sum ^= binary.LittleEndian.Uint32(data[n:])
+			}
+			Expect(binary.LittleEndian.Uint32(data[508:])).To(Equal(sum))
+		})
+
+		It("writes the same bytes for the same keys", func() {
+			first, err := hive.Marshal(root)
+			Expect(err).NotTo(HaveOccurred())
+
+			second, err := hive.Marshal(root)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(first).To(Equal(second))
+		})
+
+		It("writes keys with more cells than fit in one page", func() {
+			for n := 0; n < 200; n++ {
+				root.Subkeys = append(root.Subkeys, &hive.Key{
+					Name:   fmt.Sprintf("key-%03d", n),
+					Values: []hive.Value{{Name: "Blob", Type: hive.TypeBinary, Data: bytes.Repeat([]byte{byte(n)}, 100)}},
+				})
+			}
+
+			data, err := hive.Marshal(root)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(data)).To(BeNumerically(">", 3*4096))
+
+			parsed, err := hive.Unmarshal(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.Subkeys).To(HaveLen(203))
+
+			value, ok := parsed.Subkey("KEY-150").Value("Blob")
+			Expect(ok).To(BeTrue())
+			Expect(value.Data).To(Equal(bytes.Repeat([]byte{150}, 100)))
+		})
+
+		Context("when two subkeys only differ in case", func() {
+			It("returns an error", func() {
+				root.Subkeys = append(root.Subkeys, &hive.Key{Name: "MICROSOFT"})
+
+				_, err := hive.Marshal(root)
+				Expect(err).To(MatchError(`key ROOT has two subkeys named "MICROSOFT"`))
+			})
+		})
+
+		Context("when two values only differ in case", func() {
+			It("returns an error", func() {
+				root.Values = []hive.Value{{Name: "a"}, {Name: "A"}}
+
+				_, err := hive.Marshal(root)
+				Expect(err).To(MatchError(`key ROOT has two values named "A"`))
+			})
+		})
+
+		Context("when a value does not fit in a cell", func() {
+			It("returns an error", func() {
+				root.Values = []hive.Value{{Name: "big", Type: hive.TypeBinary, Data: make([]byte, 20000)}}
+
+				_, err := hive.Marshal(root)
+				Expect(err).To(MatchError("key ROOT: value big of 20000 bytes is larger than 16344 bytes"))
+			})
+		})
+	})
+
+	Describe("Unmarshal", func() {
+		Context("when the data is not a hive", func() {
+			It("returns an error", func() {
+				_, err := hive.Unmarshal([]byte("not a hive"))
+				Expect(err).To(MatchError("not a registry hive"))
+			})
+		})
+
+		Context("when the hive is truncated", func() {
+			It("returns an error", func() {
+				data, err := hive.Marshal(root)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = hive.Unmarshal(data[:len(data)-4096])
+				Expect(err).To(MatchError(ContainSubstring("exceeds the file")))
+			})
+		})
+
+		Context("when a subkey list points back at a key", func() {
+			It("returns an error instead of following the cycle", func() {
+				data, err := hive.Marshal(&hive.Key{Name: "ROOT", Subkeys: []*hive.Key{{Name: "child"}}})
+				Expect(err).NotTo(HaveOccurred())
+
+				rootOffset := binary.LittleEndian.Uint32(data[36:])
+				list := bytes.Index(data[4096:], []byte("lh"))
+				Expect(list).To(BeNumerically(">", 0))
+				binary.LittleEndian.PutUint32(data[4096+list+4:], rootOffset)
+
+				_, err = hive.Unmarshal(data)
+				Expect(err).To(MatchError(fmt.Sprintf("cell at %#x is referenced more than once", rootOffset)))
+			})
+		})
+
+		Context("when the hive has too many keys", func() {
+			It("returns an error", func() {
+				wide := &hive.Key{Name: "ROOT"}
+				for n := 0; n < 257; n++ {
+					key := &hive.Key{Name: fmt.Sprintf("KEY-%d", n)}
+					for m := 0; m < 256; m++ {
+						key.Subkeys = append(key.Subkeys, &hive.Key{Name: fmt.Sprintf("SUBKEY-%d", m)})
+					}
+					wide.Subkeys = append(wide.Subkeys, key)
+				}
+				data, err := hive.Marshal(wide)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = hive.Unmarshal(data)
+				Expect(err).To(MatchError("hive has more than 65536 keys"))
+			})
+		})
+
+		Context("when the root offset points outside the bins", func() {
+			It("returns an error", func() {
+				data, err := hive.Marshal(root)
+				Expect(err).NotTo(HaveOccurred())
+				binary.LittleEndian.PutUint32(data[36:], 0xFFFFFF)
+
+				_, err = hive.Unmarshal(data)
+				Expect(err).To(MatchError("cell offset 0xffffff out of range"))
+			})
+		})
+	})
+})
@@ -0,0 +1,347 @@
+package hive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// keySecurityDescriptor is the self-relative security descriptor shared by
+// every key Marshal writes. It grants full control to SYSTEM and
+// Administrators and read access to Users, inherited by subkeys, which is
+// how the keys under HKLM\SOFTWARE are secured.
+var keySecurityDescriptor = securityDescriptor()
+
+type writer struct {
+	bins       []byte
+	sk         uint32
+	keyCount   uint32
+	largestKey int
+}
+
+// Marshal writes root and everything below it as a regf hive file. Key and
+// value names are case-insensitive, so names that only differ in case are
+// rejected. Timestamps are left zero so the same keys always produce the
+// same file.
+func Marshal(root *Key) ([]byte, error) {
+	w := &writer{bins: make([]byte, binHeaderSize)}
+
+	count, err := countKeys(root, 0)
+	if err != nil {
+		return nil, err
+	}
+	w.keyCount = count
+
+	w.sk = w.writeSecurity()
+
+	rootOffset, err := w.writeKey(root, noCell, true)
+	if err != nil {
+		return nil, err
+	}
+
+	bins := w.finishBin()
+
+	base := make([]byte, baseBlockSize)
+	copy(base, "regf")
+	binary.LittleEndian.PutUint32(base[4:], 1)  // primary sequence number
+	binary.LittleEndian.PutUint32(base[8:], 1)  // secondary sequence number
+	binary.LittleEndian.PutUint32(base[20:], 1) // major version
+	binary.LittleEndian.PutUint32(base[24:], 5) // minor version
+	binary.LittleEndian.PutUint32(base[28:], 0) // primary file
+	binary.LittleEndian.PutUint32(base[32:], 1) // direct memory load
+	binary.LittleEndian.PutUint32(base[36:], rootOffset)
+	binary.LittleEndian.PutUint32(base[40:], uint32(len(bins)))
+	binary.LittleEndian.PutUint32(base[44:], 1) // clustering factor
+	binary.LittleEndian.PutUint32(base[508:], checksum(base))
+
+	return append(base, bins...), nil
+}
+
+func countKeys(key *Key, depth int) (uint32, error) {
+	if depth > maxDepth {
+		return 0, fmt.Errorf("keys nested deeper than %d", maxDepth)
+	}
+
+	count := uint32(1)
+	for _, subkey := range key.Subkeys {
+		n, err := countKeys(subkey, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// alloc appends an allocated cell holding data and returns its offset.
+func (w *writer) alloc(data []byte) uint32 {
+	size := (len(data) + 4 + 7) &^ 7
+	offset := uint32(len(w.bins))
+
+	cell := make([]byte, size)
+	binary.LittleEndian.PutUint32(cell, uint32(-int32(size)))
+	copy(cell[4:], data)
+	w.bins = append(w.bins, cell...)
+
+	return offset
+}
+
+func (w *writer) writeSecurity() uint32 {
+	offset := uint32(len(w.bins))
+
+	sk := make([]byte, 20+len(keySecurityDescriptor))
+	copy(sk, "sk")
+	// The list of security cells is circular, and this is the only one.
+	binary.LittleEndian.PutUint32(sk[4:], offset)
+	binary.LittleEndian.PutUint32(sk[8:], offset)
+	binary.LittleEndian.PutUint32(sk[12:], w.keyCount)
+	binary.LittleEndian.PutUint32(sk[16:], uint32(len(keySecurityDescriptor)))
+	copy(sk[20:], keySecurityDescriptor)
+
+	return w.alloc(sk)
+}
+
+func (w *writer) writeKey(key *Key, parent uint32, root bool) (uint32, error) {
+	name, compressed := encodeName(key.Name)
+	if len(name) > 0xFFFF {
+		return 0, fmt.Errorf("key name %q is too long", key.Name)
+	}
+
+	flags := uint16(0)
+	if compressed {
+		flags |= keyCompName
+	}
+	if root {
+		flags |= keyHiveEntry | keyNoDelete
+	}
+
+	// The key node is written first so that its subkeys can point back at
+	// it, and filled in once the lists it refers to are written.
+	nk := make([]byte, 76+len(name))
+	offset := w.alloc(nk)
+
+	valuesOffset := uint32(noCell)
+	var largestValueName, largestValueData int
+	if len(key.Values) > 0 {
+		list := make([]byte, 4*len(key.Values))
+		seen := map[string]bool{}
+		for n, value := range key.Values {
+			if seen[strings.ToUpper(value.Name)] {
+				return 0, fmt.Errorf("key %s has two values named %q", key.Name, value.Name)
+			}
+			seen[strings.ToUpper(value.Name)] = true
+
+			vk, err := w.writeValue(value)
+			if err != nil {
+				return 0, fmt.Errorf("key %s: %s", key.Name, err)
+			}
+			binary.LittleEndian.PutUint32(list[n*4:], vk)
+
+			valueName, _ := encodeName(value.Name)
+			largestValueName = max(largestValueName, len(valueName))
+			largestValueData = max(largestValueData, len(value.Data))
+		}
+		valuesOffset = w.alloc(list)
+	}
+
+	subkeysOffset := uint32(noCell)
+	var largestSubkeyName int
+	if len(key.Subkeys) > 0 {
+		subkeys := append([]*Key{}, key.Subkeys...)
+		// Subkey lists are searched by binary search on the upper case name.
+		sort.SliceStable(subkeys, func(i, j int) bool {
+			return strings.ToUpper(subkeys[i].Name) < strings.ToUpper(subkeys[j].Name)
+		})
+
+		list := make([]byte, 4+8*len(subkeys))
+		copy(list, "lh")
+		binary.LittleEndian.PutUint16(list[2:], uint16(len(subkeys)))
+		for n, subkey := range subkeys {
+			if n > 0 && strings.EqualFold(subkeys[n-1].Name, subkey.Name) {
+				return 0, fmt.Errorf("key %s has two subkeys named %q", key.Name, subkey.Name)
+			}
+
+			nkOffset, err := w.writeKey(subkey, offset, false)
+			if err != nil {
+				return 0, err
+			}
+			binary.LittleEndian.PutUint32(list[4+n*8:], nkOffset)
+			binary.LittleEndian.PutUint32(list[8+n*8:], nameHash(subkey.Name))
+
+			subkeyName, _ := encodeName(subkey.Name)
+			largestSubkeyName = max(largestSubkeyName, len(subkeyName))
+		}
+		subkeysOffset = w.alloc(list)
+	}
+
+	copy(nk, "nk")
+	binary.LittleEndian.PutUint16(nk[2:], flags)
+	binary.LittleEndian.PutUint32(nk[16:], parent)
+	binary.LittleEndian.PutUint32(nk[20:], uint32(len(key.Subkeys)))
+	binary.LittleEndian.PutUint32(nk[28:], subkeysOffset)
+	binary.LittleEndian.PutUint32(nk[32:], noCell)
+	binary.LittleEndian.PutUint32(nk[36:], uint32(len(key.Values)))
+	binary.LittleEndian.PutUint32(nk[40:], valuesOffset)
+	binary.LittleEndian.PutUint32(nk[44:], w.sk)
+	binary.LittleEndian.PutUint32(nk[48:], noCell)
+	binary.LittleEndian.PutUint32(nk[52:], uint32(largestSubkeyName))
+	binary.LittleEndian.PutUint32(nk[60:], uint32(largestValueName))
+	binary.LittleEndian.PutUint32(nk[64:], uint32(largestValueData))
+	binary.LittleEndian.PutUint16(nk[72:], uint16(len(name)))
+	copy(nk[76:], name)
+	copy(w.bins[offset+4:], nk)
+
+	return offset, nil
+}
+
+func (w *writer) writeValue(value Value) (uint32, error) {
+	name, compressed := encodeName(value.Name)
+	if len(name) > 0xFFFF {
+		return 0, fmt.Errorf("value name %q is too long", value.Name)
+	}
+	if len(value.Data) > maxCellData {
+		return 0, fmt.Errorf("value %s of %d bytes is larger than %d bytes", value.Name, len(value.Data), maxCellData)
+	}
+
+	vk := make([]byte, 20+len(name))
+	copy(vk, "vk")
+	binary.LittleEndian.PutUint16(vk[2:], uint16(len(name)))
+	binary.LittleEndian.PutUint32(vk[12:], value.Type)
+	if compressed {
+		binary.LittleEndian.PutUint16(vk[16:], valueCompName)
+	}
+	copy(vk[20:], name)
+
+	if len(value.Data) <= 4 {
+		binary.LittleEndian.PutUint32(vk[4:], uint32(len(value.Data))|inlineData)
+		copy(vk[8:12], value.Data)
+	} else {
+		binary.LittleEndian.PutUint32(vk[4:], uint32(len(value.Data)))
+		binary.LittleEndian.PutUint32(vk[8:], w.alloc(value.Data))
+	}
+
+	return w.alloc(vk), nil
+}
+
+// finishBin turns the cells into a single hive bin, padded to a multiple of
+// 4096 bytes with a free cell.
+func (w *writer) finishBin() []byte {
+	size := (len(w.bins) + baseBlockSize - 1) / baseBlockSize * baseBlockSize
+	if size-len(w.bins) > 0 && size-len(w.bins) < 8 {
+		size += baseBlockSize
+	}
+
+	bins := make([]byte, size)
+	copy(bins, w.bins)
+	copy(bins, "hbin")
+	binary.LittleEndian.PutUint32(bins[4:], 0)
+	binary.LittleEndian.PutUint32(bins[8:], uint32(size))
+
+	if free := size - len(w.bins); free > 0 {
+		binary.LittleEndian.PutUint32(bins[len(w.bins):], uint32(free))
+	}
+
+	return bins
+}
+
+// encodeName returns name as Latin-1 when it can be, which the registry
+// calls a compressed name, and as UTF-16LE otherwise.
+func encodeName(name string) ([]byte, bool) {
+	latin1 := make([]byte, 0, len(name))
+	for _, r := range name {
+		if r > 0xFF {
+			units := utf16.Encode([]rune(name))
+			encoded := make([]byte, 2*len(units))
+			for n, unit := range units {
+				binary.LittleEndian.PutUint16(encoded[n*2:], unit)
+			}
+			return encoded, false
+		}
+		latin1 = append(latin1, byte(r))
+	}
+	return latin1, true
+}
+
+// nameHash is the hash stored next to each entry of an lh subkey list.
+func nameHash(name string) uint32 {
+	var hash uint32
+	for _, r := range strings.ToUpper(name) {
+		hash = hash*37 + uint32(r)
+	}
+	return hash
+}
+
+// checksum is the XOR of the first 127 double words of the base block.
+func checksum(base []byte) uint32 {
+	var sum uint32
+	for n := 0; n < 508; n += 4 {
+		sum ^= binary.LittleEndian.Uint32(base[n:])
+	}
+	switch sum {
+	case 0xFFFFFFFF:
+		return 0xFFFFFFFE
+	case 0:
+		return 1
+	}
+	return sum
+}
+
+func securityDescriptor() []byte {
+	const (
+		keyAllAccess = 0x000F003F
+		keyRead      = 0x00020019
+
+		containerInherit = 0x02
+		selfRelative     = 0x8000
+		daclPresent      = 0x0004
+	)
+
+	system := sid(5, 18)
+	administrators := sid(5, 32, 544)
+	users := sid(5, 32, 545)
+
+	ace := func(mask uint32, trustee []byte) []byte {
+		a := make([]byte, 8+len(trustee))
+		a[0] = 0 // ACCESS_ALLOWED_ACE_TYPE
+		a[1] = containerInherit
+		binary.LittleEndian.PutUint16(a[2:], uint16(len(a)))
+		binary.LittleEndian.PutUint32(a[4:], mask)
+		copy(a[8:], trustee)
+		return a
+	}
+	aces := append(append(ace(keyAllAccess, system), ace(keyAllAccess, administrators)...), ace(keyRead, users)...)
+
+	acl := make([]byte, 8, 8+len(aces))
+	acl[0] = 2 // ACL_REVISION
+	binary.LittleEndian.PutUint16(acl[2:], uint16(8+len(aces)))
+	binary.LittleEndian.PutUint16(acl[4:], 3)
+	acl = append(acl, aces...)
+
+	sd := make([]byte, 20)
+	sd[0] = 1 // SECURITY_DESCRIPTOR_REVISION
+	binary.LittleEndian.PutUint16(sd[2:], selfRelative|daclPresent)
+	binary.LittleEndian.PutUint32(sd[4:], uint32(len(sd)))
+	sd = append(sd, administrators...)
+	binary.LittleEndian.PutUint32(sd[8:], uint32(len(sd)))
+	sd = append(sd, system...)
+	binary.LittleEndian.PutUint32(sd[16:], uint32(len(sd)))
+	sd = append(sd, acl...)
+
+	return sd
+}
+
+// sid encodes a security identifier such as S-1-5-32-544.
+func sid(authority uint64, subAuthorities ...uint32) []byte {
+	s := make([]byte, 8+4*len(subAuthorities))
+	s[0] = 1
+	s[1] = byte(len(subAuthorities))
+	for n := 0; n < 6; n++ {
+		s[2+n] = byte(authority >> (8 * (5 - n)))
+	}
+	for n, sub := range subAuthorities {
+		binary.LittleEndian.PutUint32(s[8+4*n:], sub)
+	}
+	return s
+}
@@ -0,0 +1,59 @@
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Prefixes of the names handed out by Generator. They let leftovers of
+// crashed runs be recognised.
+const (
+	ContainerIdPrefix    = "layer-"
+	DiffOutputFilePrefix = "diff-output-"
+
+	// ContainerIdPattern is a regular expression matching exactly the ids
+	// ContainerId returns.
+	ContainerIdPattern = ContainerIdPrefix + "[0-9a-f]{16}"
+)
+
+type Generator struct{}
+
+func NewGenerator() Generator {
+	return Generator{}
+}
+
+// ContainerId returns a container id with 64 bits of cryptographic randomness.
+func (g Generator) ContainerId() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("read random bytes: %s", err)
+	}
+
+	return ContainerIdPrefix + hex.EncodeToString(b), nil
+}
+
+// BundleDir creates a new, uniquely named directory in the temp directory
+// for the container's bundle.
+func (g Generator) BundleDir(containerId string) (string, error) {
+	return os.MkdirTemp("", containerId+"-")
+}
+
+// DiffOutputFile creates a new, uniquely named empty file in the temp
+// directory for diff-exporter to write the layer to.
+func (g Generator) DiffOutputFile(containerId string) (string, error) {
+	f, err := os.CreateTemp("", DiffOutputFilePrefix+containerId+"-*")
+	if err != nil {
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,56 @@
+package ids_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/ids"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Generator", func() {
+	var generator ids.Generator
+
+	BeforeEach(func() {
+		generator = ids.NewGenerator()
+	})
+
+	It("generates random container ids", func() {
+		first, err := generator.ContainerId()
+		Expect(err).NotTo(HaveOccurred())
+		second, err := generator.ContainerId()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first).To(MatchRegexp(`^layer-[0-9a-f]{16}$`))
+		Expect(first).To(MatchRegexp("^" + ids.ContainerIdPattern + "$"))
+		Expect(second).NotTo(Equal(first))
+	})
+
+	It("creates a unique bundle directory named after the container", func() {
+		first, err := generator.BundleDir("layer-abc")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(first)
+		second, err := generator.BundleDir("layer-abc")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(second)
+
+		Expect(first).To(BeADirectory())
+		Expect(filepath.Dir(first)).To(Equal(filepath.Clean(os.TempDir())))
+		Expect(filepath.Base(first)).To(HavePrefix("layer-abc-"))
+		Expect(second).NotTo(Equal(first))
+	})
+
+	It("creates a unique diff output file named after the container", func() {
+		first, err := generator.DiffOutputFile("layer-abc")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(first)
+		second, err := generator.DiffOutputFile("layer-abc")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(second)
+
+		Expect(first).To(BeARegularFile())
+		Expect(filepath.Base(first)).To(HavePrefix("diff-output-layer-abc-"))
+		Expect(second).NotTo(Equal(first))
+	})
+})
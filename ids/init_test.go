@@ -0,0 +1,13 @@
+package ids_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestIds(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Ids Suite")
+}
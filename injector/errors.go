@@ -0,0 +1,67 @@
+package injector
+
+import (
+	"errors"
+)
+
+var (
+	// ErrTimedOut is wrapped by the error of a step whose tool ran past
+	// its timeout.
+	ErrTimedOut = errors.New("timed out")
+
+	// ErrInterrupted is wrapped by the error of a step that was cut short
+	// because the context of the run was done.
+	ErrInterrupted = errors.New("interrupted")
+)
+
+// StepError is returned when a step of the pipeline fails. It wraps the
+// cause, so errors.Is and errors.As see through it.
+type StepError struct {
+	Step Step
+
+	// ExitCode is the exit code of the tool run by the step. It is -1 when
+	// the step does not run a tool or the tool did not exit on its own.
+	ExitCode int
+
+	// Stdout and Stderr hold the output of the last attempt of the tool.
+	Stdout string
+	Stderr string
+
+	Err error
+
+	message string
+}
+
+func (e *StepError) Error() string {
+	return e.message
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// stepError describes the failure of step with message.
+func stepError(step Step, err error, message string) *StepError {
+	return toolError(step, err, "", "", message)
+}
+
+// toolError describes the failure of a step that ran a tool.
+func toolError(step Step, err error, stdout, stderr, message string) *StepError {
+	return &StepError{
+		Step:     step,
+		ExitCode: exitCode(err),
+		Stdout:   stdout,
+		Stderr:   stderr,
+		Err:      err,
+		message:  message,
+	}
+}
+
+// exitCode returns the exit code carried by err, or -1 if there is none.
+func exitCode(err error) int {
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
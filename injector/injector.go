@@ -1,106 +1,796 @@
 package injector
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 )
 
+// BundleDigestAnnotation is recorded on the layer added by the injector so
+// later runs can tell whether the image already trusts the same certificates.
+const BundleDigestAnnotation = "org.cloudfoundry.cert-injector.bundle-digest"
+
+// RemovedThumbprintsAnnotation is recorded on the layers that delete
+// certificates from the root store and lists their thumbprints, separated by
+// commas. Layers replacing such a layer delete the same certificates.
+const RemovedThumbprintsAnnotation = "org.cloudfoundry.cert-injector.removed-thumbprints"
+
+// Step identifies a stage of the injection pipeline.
+type Step string
+
+const (
+	StepValidate    Step = "validate"
+	StepSnapshot    Step = "snapshot"
+	StepRemoveLayer Step = "remove-layer"
+	StepGrootCreate Step = "groot-create"
+	StepConfigWrite Step = "config-write"
+	StepWincRun     Step = "winc-run"
+	StepDiffExport  Step = "diff-export"
+	StepAddLayer    Step = "add-layer"
+	StepGrootDelete Step = "groot-delete"
+	StepLayerBuild  Step = "layer-build"
+	StepPull        Step = "pull"
+	StepPush        Step = "push"
+)
+
+type Status string
+
 const (
-	grootBin        = "c:\\var\\vcap\\packages\\groot\\groot.exe"
-	wincBin         = "c:\\var\\vcap\\packages\\winc\\winc.exe"
-	diffExporterBin = "c:\\var\\vcap\\packages\\diff-exporter\\diff-exporter.exe"
-	hydrateBin      = "c:\\var\\vcap\\packages\\hydrate\\hydrate.exe"
+	StatusSuccess Status = "success"
+	StatusSkipped Status = "skipped"
+	StatusFailed  Status = "failed"
 )
 
+// Result describes the outcome of injecting certificates into one image.
+// Step is only set when Status is StatusFailed. Retries counts the extra
+// attempts of every step that had to be retried, and Timings holds how long
+// every step that ran took, retries included.
+type Result struct {
+	Image   string
+	Status  Status
+	Step    Step
+	Retries map[Step]int
+	Timings map[Step]time.Duration
+
+	// Digest is the digest of the injected certificates.
+	Digest string
+
+	// LayerDigest is the digest of the layer added by hydrate. It is empty
+	// when no layer was added or it could not be read.
+	LayerDigest string
+}
+
+func (r *Result) addRetry(step Step) {
+	if r == nil {
+		return
+	}
+	if r.Retries == nil {
+		r.Retries = map[Step]int{}
+	}
+	r.Retries[step]++
+}
+
+func (r *Result) addTiming(step Step, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	if r.Timings == nil {
+		r.Timings = map[Step]time.Duration{}
+	}
+	r.Timings[step] += duration
+}
+
+// DefaultTimeouts returns how long each external tool or registry transfer
+// may run before it is stopped and the step fails.
+func DefaultTimeouts() map[Step]time.Duration {
+	return map[Step]time.Duration{
+		StepRemoveLayer: 5 * time.Minute,
+		StepGrootCreate: 5 * time.Minute,
+		StepWincRun:     10 * time.Minute,
+		StepDiffExport:  10 * time.Minute,
+		StepAddLayer:    5 * time.Minute,
+		StepGrootDelete: 5 * time.Minute,
+		StepPull:        30 * time.Minute,
+		StepPush:        30 * time.Minute,
+	}
+}
+
 type cmd interface {
-	Run(executable string, args ...string) (string, string, error)
+	Run(ctx context.Context, executable string, args ...string) (string, string, error)
 }
 
 type config interface {
-	Write(bundleDir, grootOutput, certData string) error
+	Write(bundleDir, grootOutput, certData string, thumbprints []string) error
+	Generate(grootOutput, certData string, thumbprints []string) ([]byte, error)
+}
+
+type bundle interface {
+	Validate(certDirectory string) error
+	Digest(certDirectory string) (string, error)
+}
+
+type image interface {
+	Snapshot(uri string) (string, error)
+	Restore(uri, snapshot string) error
+	Discard(snapshot string) error
+	LayerAnnotation(uri, key string) (string, error)
+	AnnotateLayer(uri, key, value string) error
+	LayerDigest(uri string) (string, error)
+	CustomLayers(uri string) ([]map[string]string, error)
+	ManifestDigest(uri string) (string, error)
+}
+
+type ids interface {
+	ContainerId() (string, error)
+	BundleDir(containerId string) (string, error)
+	DiffOutputFile(containerId string) (string, error)
+}
+
+type leaks interface {
+	AddLeak(driverStore, containerId string) error
+	RemoveLeak(driverStore, containerId string) error
+	Leaks(driverStore string) ([]string, error)
+}
+
+// LayerBuilder writes a layer that adds the certificates in certDirectory
+// to the root store to outputFile, in the format diff-exporter exports.
+type LayerBuilder interface {
+	BuildLayer(outputFile, certDirectory string) error
 }
 
-type logger interface {
-	Println(v ...interface{})
+type Options struct {
+	// Transactional snapshots the image before the custom layer is removed
+	// and restores it if any later step fails.
+	Transactional bool
+
+	// Force rebuilds the layer even when the image already carries a layer
+	// for the same certificates.
+	Force bool
+
+	// Timeouts bounds how long the tool run by a step may take. Steps
+	// without a timeout run until they exit or the context is done.
+	Timeouts map[Step]time.Duration
+
+	// Retries holds the retry policy of each step. Steps without a policy
+	// are attempted once.
+	Retries map[Step]RetryPolicy
+
+	// LayerBuilder, when set, writes the certificate layer in place of the
+	// groot create, winc run and diff-exporter steps.
+	LayerBuilder LayerBuilder
+
+	// Stages replaces the tools run by individual steps.
+	Stages Stages
+
+	// Registry pulls docker:// images into PullDirectory before the
+	// certificates are injected, and pushes them back when PushTag is set.
+	Registry      Registry
+	PullDirectory string
+	PushTag       string
 }
 
 type Injector struct {
-	cmd    cmd
-	config config
-	stdout logger
-	stderr logger
+	stages  Stages
+	config  config
+	bundle  bundle
+	image   image
+	ids     ids
+	leaks   leaks
+	logger  *slog.Logger
+	options Options
 }
 
-func NewInjector(cmd cmd, config config, stdout, stderr logger) Injector {
+func NewInjector(cmd cmd, config config, bundle bundle, image image, ids ids, leaks leaks, tools Tools, logger *slog.Logger, options Options) Injector {
 	return Injector{
-		cmd:    cmd,
-		config: config,
-		stdout: stdout,
-		stderr: stderr,
+		stages:  options.Stages.withDefaults(cmd, tools),
+		config:  config,
+		bundle:  bundle,
+		image:   image,
+		ids:     ids,
+		leaks:   leaks,
+		logger:  logger,
+		options: options,
 	}
 }
 
-func (i Injector) InjectCert(grootDriverStore, uri, certDirectory string) error {
-	_, _, err := i.cmd.Run(hydrateBin, "remove-layer", "-ociImage", uri)
+func (i Injector) InjectCert(ctx context.Context, grootDriverStore, uri, certDirectory string) (Result, error) {
+	result := Result{Image: uri}
+
+	var err error
+	if isRemote(uri) {
+		err = i.injectRemote(ctx, grootDriverStore, uri, certDirectory, &result)
+	} else {
+		err = i.injectCert(ctx, grootDriverStore, uri, certDirectory, &result)
+	}
 	if err != nil {
-		return fmt.Errorf("hydrate remove-layer -ociImage %s failed: %s\n", uri, err)
+		result.Status = StatusFailed
+		var stepErr *StepError
+		if errors.As(err, &stepErr) {
+			result.Step = stepErr.Step
+		}
+		return result, err
 	}
 
-	// #nosec G115 - we don't care about integer overflow here, just trying to generate a pseudo random string for the layer
-	containerId := fmt.Sprintf("layer-%d", int32(time.Now().UnixNano()))
+	result.Step = ""
+	return result, nil
+}
+
+// injectCert runs the pipeline. Every failure is returned as a *StepError so
+// it can be attributed to the step that failed.
+func (i Injector) injectCert(ctx context.Context, grootDriverStore, uri, certDirectory string, result *Result) (err error) {
+	log := i.logger.With("image", uri)
 
-	grootOutput, stderr, err := i.cmd.Run(grootBin, "--driver-store", grootDriverStore, "create", uri, containerId)
+	// Cleanup failures are reported alongside the outcome of the pipeline
+	// but must not trigger a rollback of an image that was rotated.
+	var cleanupErr error
+	defer func() {
+		err = errors.Join(err, cleanupErr)
+	}()
+
+	// Validate before touching the image so a bad certificate never costs us the existing layer.
+	start := time.Now()
+	err = i.bundle.Validate(certDirectory)
+	finishStep(log, result, StepValidate, start, err)
 	if err != nil {
-		i.stdout.Println(grootOutput)
-		i.stderr.Println(stderr)
-		return fmt.Errorf("groot create failed: %s", err)
+		return stepError(StepValidate, err, fmt.Sprintf("certificate validation failed: %s", err))
 	}
-	defer func() {
-		stdout, stderr, err := i.cmd.Run(grootBin, "--driver-store", grootDriverStore, "delete", containerId)
+
+	digest, err := i.bundle.Digest(certDirectory)
+	if err != nil {
+		return stepError(StepValidate, err, fmt.Sprintf("certificate digest failed: %s", err))
+	}
+	result.Digest = digest
+
+	if !i.options.Force {
+		current, err := i.image.LayerAnnotation(uri, BundleDigestAnnotation)
+		if err != nil {
+			log.Warn("reading certificate digest failed, rebuilding the layer", "error", err)
+		} else if current == digest {
+			log.Info("image already trusts these certificates, skipping", "digest", digest)
+			result.Status = StatusSkipped
+			return nil
+		}
+	}
+
+	if i.options.Transactional {
+		var snapshot string
+		snapshot, err = i.snapshot(log, result, uri)
 		if err != nil {
-			i.stdout.Println("groot delete failed")
-			i.stdout.Println(stdout)
-			i.stderr.Println(stderr)
+			return err
+		}
+		defer func() {
+			err = i.rollback(log, uri, snapshot, err)
+		}()
+	}
+
+	layers, err := i.image.CustomLayers(uri)
+	if err != nil {
+		return stepError(StepRemoveLayer, err, fmt.Sprintf("read the custom layers of %s failed: %s", uri, err))
+	}
+	purged := purgedThumbprints(layers)
+	if len(purged) > 0 && i.options.LayerBuilder != nil {
+		err = cannotPurgeError(uri, purged)
+		return stepError(StepLayerBuild, err, err.Error())
+	}
+
+	err = i.removeCustomLayers(ctx, log, result, uri, len(layers))
+	if err != nil {
+		return err
+	}
+
+	// Certificates purged from the image stay purged, even when they are
+	// among the certificates being injected.
+	if i.options.LayerBuilder != nil {
+		err = i.writeLayer(ctx, log, result, uri, certDirectory)
+	} else {
+		err = i.buildLayer(ctx, log, result, grootDriverStore, uri, func(bundleDir, grootOutput string) error {
+			return i.config.Write(bundleDir, grootOutput, certDirectory, purged)
+		}, &cleanupErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(purged) > 0 {
+		err = i.annotateRemovedThumbprints(uri, purged)
+		if err != nil {
+			return err
+		}
+	}
+
+	layerDigest, digestErr := i.image.LayerDigest(uri)
+	if digestErr != nil {
+		log.Warn("reading the new layer digest failed", "error", digestErr)
+	}
+	result.LayerDigest = layerDigest
+
+	// The layer is in place at this point, so a missing annotation only costs the next run a rebuild.
+	annotateErr := i.image.AnnotateLayer(uri, BundleDigestAnnotation, digest)
+	if annotateErr != nil {
+		log.Warn("recording certificate digest failed", "error", annotateErr)
+	}
+
+	result.Status = StatusSuccess
+	return nil
+}
+
+// buildLayer creates a volume for the image, runs a container on it with the
+// config written by writeConfig, and adds the changes the container made to
+// the image as a new layer. A failure to delete the volume afterwards is
+// stored in cleanupErr rather than returned.
+func (i Injector) buildLayer(ctx context.Context, log *slog.Logger, result *Result, grootDriverStore, uri string, writeConfig func(bundleDir, grootOutput string) error, cleanupErr *error) error {
+	containerId, err := i.ids.ContainerId()
+	if err != nil {
+		return stepError(StepGrootCreate, err, fmt.Sprintf("generate container id failed: %s", err))
+	}
+	log = log.With("container_id", containerId)
+
+	// A failed groot create can leave a partial volume under containerId,
+	// which makes the next attempt fail with "already exists".
+	deletePartialVolume := func(ctx context.Context) error {
+		stdout, stderr, err := i.deleteVolume(ctx, log, result, grootDriverStore, containerId)
+		if err != nil {
+			i.recordLeak(log, grootDriverStore, containerId)
+			return toolError(StepGrootDelete, err, stdout, stderr, fmt.Sprintf("groot delete %s failed: %s", containerId, err))
+		}
+		return nil
+	}
+	grootOutput, stderr, err := i.retry(ctx, log, result, StepGrootCreate, func(ctx context.Context) (string, string, error) {
+		return i.stages.VolumeCreator.CreateVolume(ctx, grootDriverStore, uri, containerId)
+	}, deletePartialVolume)
+	if err != nil {
+		return toolError(StepGrootCreate, err, grootOutput, stderr, fmt.Sprintf("groot create failed: %s", err))
+	}
+	defer func() {
+		// Clean up even when the run was interrupted.
+		stdout, stderr, deleteErr := i.deleteVolume(context.WithoutCancel(ctx), log, result, grootDriverStore, containerId)
+		if deleteErr != nil {
+			*cleanupErr = toolError(StepGrootDelete, deleteErr, stdout, stderr, fmt.Sprintf("groot delete %s failed: %s", containerId, deleteErr))
+			i.recordLeak(log, grootDriverStore, containerId)
 		}
 	}()
 
-	bundleDir := filepath.Join(os.TempDir(), containerId)
-	err = os.MkdirAll(bundleDir, 0755)
+	bundleDir, err := i.ids.BundleDir(containerId)
 	if err != nil {
-		return fmt.Errorf("create bundle directory failed: %s", err)
+		return stepError(StepConfigWrite, err, fmt.Sprintf("create bundle directory failed: %s", err))
 	}
 	defer os.RemoveAll(bundleDir)
 
-	err = i.config.Write(bundleDir, grootOutput, certDirectory)
+	start := time.Now()
+	err = writeConfig(bundleDir, grootOutput)
+	finishStep(log, result, StepConfigWrite, start, err)
 	if err != nil {
-		return fmt.Errorf("container config write failed: %s", err)
+		return stepError(StepConfigWrite, err, fmt.Sprintf("container config write failed: %s", err))
 	}
 
-	stdout, stderr, err := i.cmd.Run(wincBin, "run", "-b", bundleDir, containerId)
+	// winc refuses to run a container whose id a failed attempt left behind.
+	deletePartialContainer := func(ctx context.Context) error {
+		if timeout := i.options.Timeouts[StepWincRun]; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		_, stderr, err := i.stages.ContainerRunner.DeleteContainer(ctx, containerId)
+		if err != nil {
+			// The failed attempt may not have created the container at all.
+			log.Warn("deleting the container of the failed attempt failed", "error", err, "stderr", truncate(stderr))
+		}
+		return nil
+	}
+	stdout, stderr, err := i.retry(ctx, log, result, StepWincRun, func(ctx context.Context) (string, string, error) {
+		return i.stages.ContainerRunner.RunContainer(ctx, bundleDir, containerId)
+	}, deletePartialContainer)
 	if err != nil {
-		i.stdout.Println(stdout)
-		i.stderr.Println(stderr)
-		return fmt.Errorf("winc run failed: %s", err)
+		// Killing winc when the run times out or is interrupted leaves the
+		// container running in HCS, where it holds on to the volume and makes
+		// groot delete fail, so delete it with a context that is not done.
+		deletePartialContainer(context.WithoutCancel(ctx))
+		return toolError(StepWincRun, err, stdout, stderr, fmt.Sprintf("winc run failed: %s", err))
 	}
 
-	// #nosec G115 - we don't care about integer overflow here, just trying to generate a pseudo random string for the layer
-	diffOutputFile := filepath.Join(os.TempDir(), fmt.Sprintf("diff-output%d", int32(time.Now().Unix())))
-	stdout, stderr, err = i.cmd.Run(diffExporterBin, "-outputFile", diffOutputFile, "-containerId", containerId, "-bundlePath", bundleDir)
+	diffOutputFile, err := i.ids.DiffOutputFile(containerId)
 	if err != nil {
-		i.stdout.Println(stdout)
-		i.stderr.Println(stderr)
-		return fmt.Errorf("diff-exporter failed exporting the layer: %s", err)
+		return stepError(StepDiffExport, err, fmt.Sprintf("create diff output file failed: %s", err))
 	}
 	defer os.RemoveAll(diffOutputFile)
 
-	stdout, stderr, err = i.cmd.Run(hydrateBin, "add-layer", "-ociImage", uri, "-layer", diffOutputFile)
+	stdout, stderr, err = i.run(ctx, log, result, StepDiffExport, func(ctx context.Context) (string, string, error) {
+		return i.stages.DiffExporter.ExportDiff(ctx, diffOutputFile, containerId, bundleDir)
+	})
+	if err != nil {
+		return toolError(StepDiffExport, err, stdout, stderr, fmt.Sprintf("diff-exporter failed exporting the layer: %s", err))
+	}
+
+	return i.addLayer(ctx, log, result, uri, diffOutputFile)
+}
+
+// writeLayer writes the certificate layer with the LayerBuilder of the
+// options and adds it to the image.
+func (i Injector) writeLayer(ctx context.Context, log *slog.Logger, result *Result, uri, certDirectory string) error {
+	layerId, err := i.ids.ContainerId()
+	if err != nil {
+		return stepError(StepLayerBuild, err, fmt.Sprintf("generate layer id failed: %s", err))
+	}
+
+	diffOutputFile, err := i.ids.DiffOutputFile(layerId)
+	if err != nil {
+		return stepError(StepLayerBuild, err, fmt.Sprintf("create diff output file failed: %s", err))
+	}
+	defer os.RemoveAll(diffOutputFile)
+
+	start := time.Now()
+	err = i.options.LayerBuilder.BuildLayer(diffOutputFile, certDirectory)
+	finishStep(log, result, StepLayerBuild, start, err)
+	if err != nil {
+		return stepError(StepLayerBuild, err, fmt.Sprintf("build layer failed: %s", err))
+	}
+
+	return i.addLayer(ctx, log, result, uri, diffOutputFile)
+}
+
+// addLayer adds the layer in diffOutputFile to the image. A failed attempt
+// is only retried while the top layer of the image is unchanged, so a
+// partial success cannot stack a second certificate layer.
+func (i Injector) addLayer(ctx context.Context, log *slog.Logger, result *Result, uri, diffOutputFile string) error {
+	var topLayer string
+	var topLayerErr error
+	if i.options.Retries[StepAddLayer].MaxAttempts > 1 {
+		topLayer, topLayerErr = i.image.LayerDigest(uri)
+	}
+	unchangedTopLayer := func(ctx context.Context) error {
+		if topLayerErr != nil {
+			return fmt.Errorf("read the top layer of %s failed: %s", uri, topLayerErr)
+		}
+		current, err := i.image.LayerDigest(uri)
+		if err != nil {
+			return fmt.Errorf("read the top layer of %s failed: %s", uri, err)
+		}
+		if current != topLayer {
+			return fmt.Errorf("the failed attempt changed the top layer of %s to %s", uri, current)
+		}
+		return nil
+	}
+	stdout, stderr, err := i.retry(ctx, log, result, StepAddLayer, func(ctx context.Context) (string, string, error) {
+		return i.stages.LayerAdder.AddLayer(ctx, uri, diffOutputFile)
+	}, unchangedTopLayer)
 	if err != nil {
-		i.stdout.Println(stdout)
-		i.stderr.Println(stderr)
-		return fmt.Errorf("hydrate add-layer failed: %s", err)
+		return toolError(StepAddLayer, err, stdout, stderr, fmt.Sprintf("hydrate add-layer failed: %s", err))
 	}
 
 	return nil
 }
+
+// RemoveCert removes every custom layer from the image, including layers
+// that delete certificates, and confirms that the top layer of the image is
+// no longer one the injector added.
+func (i Injector) RemoveCert(ctx context.Context, uri string) error {
+	layers, err := i.image.CustomLayers(uri)
+	if err != nil {
+		return stepError(StepRemoveLayer, err, fmt.Sprintf("read the custom layers of %s failed: %s", uri, err))
+	}
+
+	err = i.removeCustomLayers(ctx, i.logger.With("image", uri), nil, uri, len(layers))
+	if err != nil {
+		return err
+	}
+
+	return i.confirmRemoved(uri)
+}
+
+// PurgeCerts replaces the custom layers of the image with a layer that
+// deletes the certificates with the given SHA-1 thumbprints from
+// Cert:\LocalMachine\Root, so that CAs shipped with the base image can be
+// distrusted. Certificates purged by the layers it replaces stay purged.
+// InjectCert keeps deleting the purged certificates when it replaces the
+// layer. The image is always snapshotted first and restored if any step
+// fails, since the layers it replaces cannot be rebuilt without the
+// certificates they were built from.
+func (i Injector) PurgeCerts(ctx context.Context, grootDriverStore, uri string, thumbprints []string) (err error) {
+	log := i.logger.With("image", uri)
+
+	var cleanupErr error
+	defer func() {
+		err = errors.Join(err, cleanupErr)
+	}()
+
+	snapshot, err := i.snapshot(log, nil, uri)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = i.rollback(log, uri, snapshot, err)
+	}()
+
+	layers, err := i.image.CustomLayers(uri)
+	if err != nil {
+		return stepError(StepRemoveLayer, err, fmt.Sprintf("read the custom layers of %s failed: %s", uri, err))
+	}
+	thumbprints = appendMissing(purgedThumbprints(layers), thumbprints...)
+
+	err = i.removeCustomLayers(ctx, log, nil, uri, len(layers))
+	if err != nil {
+		return err
+	}
+
+	err = i.confirmRemoved(uri)
+	if err != nil {
+		return err
+	}
+
+	err = i.buildLayer(ctx, log, nil, grootDriverStore, uri, func(bundleDir, grootOutput string) error {
+		return i.config.Write(bundleDir, grootOutput, "", thumbprints)
+	}, &cleanupErr)
+	if err != nil {
+		return err
+	}
+
+	return i.annotateRemovedThumbprints(uri, thumbprints)
+}
+
+// removeCustomLayers removes the count custom layers on top of the image.
+// The top layer is removed even when count is 0, since layers hydrate added
+// before they were annotated look like any other layer.
+func (i Injector) removeCustomLayers(ctx context.Context, log *slog.Logger, result *Result, uri string, count int) error {
+	for range max(count, 1) {
+		stdout, stderr, err := i.run(ctx, log, result, StepRemoveLayer, func(ctx context.Context) (string, string, error) {
+			return i.stages.LayerRemover.RemoveLayer(ctx, uri)
+		})
+		if err != nil {
+			return toolError(StepRemoveLayer, err, stdout, stderr, fmt.Sprintf("hydrate remove-layer -ociImage %s failed: %s\n", uri, err))
+		}
+	}
+
+	return nil
+}
+
+// confirmRemoved fails when the top layer of the image is still one the
+// injector added.
+func (i Injector) confirmRemoved(uri string) error {
+	left, err := i.image.CustomLayers(uri)
+	if err != nil {
+		return stepError(StepRemoveLayer, err, fmt.Sprintf("confirm the custom layers were removed from %s failed: %s", uri, err))
+	}
+	if len(left) > 0 {
+		err = fmt.Errorf("custom layer is still present in %s", uri)
+		return stepError(StepRemoveLayer, err, err.Error())
+	}
+
+	return nil
+}
+
+// annotateRemovedThumbprints records the thumbprints the top layer deletes.
+// Unlike the bundle digest they cannot be rebuilt from the certificates, so
+// failing to record them fails the step that added the layer.
+func (i Injector) annotateRemovedThumbprints(uri string, thumbprints []string) error {
+	err := i.image.AnnotateLayer(uri, RemovedThumbprintsAnnotation, strings.Join(thumbprints, ","))
+	if err != nil {
+		return stepError(StepAddLayer, err, fmt.Sprintf("recording removed thumbprints on %s failed: %s", uri, err))
+	}
+	return nil
+}
+
+// purgedThumbprints returns the thumbprints deleted by the given custom
+// layers, oldest purge first.
+func purgedThumbprints(layers []map[string]string) []string {
+	var thumbprints []string
+	for n := len(layers) - 1; n >= 0; n-- {
+		if value := layers[n][RemovedThumbprintsAnnotation]; value != "" {
+			thumbprints = appendMissing(thumbprints, strings.Split(value, ",")...)
+		}
+	}
+	return thumbprints
+}
+
+// cannotPurgeError explains why a LayerBuilder cannot replace the custom
+// layers of an image that deletes certificates.
+func cannotPurgeError(uri string, purged []string) error {
+	return fmt.Errorf("%s deletes certificates %s, which a layer builder cannot do, so the layer must be built in a container", uri, strings.Join(purged, ", "))
+}
+
+// appendMissing appends the values that are not in list yet.
+func appendMissing(list []string, values ...string) []string {
+	for _, value := range values {
+		if !slices.Contains(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// CleanupLeaks retries deleting the volumes in grootDriverStore that earlier
+// runs failed to delete, and returns how many were deleted.
+func (i Injector) CleanupLeaks(ctx context.Context, grootDriverStore string) (int, error) {
+	containerIds, err := i.leaks.Leaks(grootDriverStore)
+	if err != nil {
+		return 0, fmt.Errorf("read leaked volumes failed: %s", err)
+	}
+
+	var errs []error
+	deleted := 0
+	for _, containerId := range containerIds {
+		log := i.logger.With("container_id", containerId)
+		stdout, stderr, err := i.deleteVolume(ctx, log, nil, grootDriverStore, containerId)
+		if err != nil {
+			errs = append(errs, toolError(StepGrootDelete, err, stdout, stderr, fmt.Sprintf("groot delete %s failed: %s", containerId, err)))
+			continue
+		}
+
+		err = i.leaks.RemoveLeak(grootDriverStore, containerId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("forget leaked volume %s failed: %s", containerId, err))
+			continue
+		}
+
+		log.Info("deleted leaked volume")
+		deleted++
+	}
+
+	return deleted, errors.Join(errs...)
+}
+
+// recordLeak remembers a volume that could not be deleted so a later run can
+// retry.
+func (i Injector) recordLeak(log *slog.Logger, grootDriverStore, containerId string) {
+	err := i.leaks.AddLeak(grootDriverStore, containerId)
+	if err != nil {
+		log.Error("recording leaked volume failed", "error", err)
+		return
+	}
+	log.Warn("recorded leaked volume for a later run to delete")
+}
+
+// deleteVolume deletes the volume of containerId with the VolumeCreator.
+func (i Injector) deleteVolume(ctx context.Context, log *slog.Logger, result *Result, grootDriverStore, containerId string) (string, string, error) {
+	return i.run(ctx, log, result, StepGrootDelete, func(ctx context.Context) (string, string, error) {
+		return i.stages.VolumeCreator.DeleteVolume(ctx, grootDriverStore, containerId)
+	})
+}
+
+// stageCall calls into the stage of a step.
+type stageCall func(ctx context.Context) (stdout, stderr string, err error)
+
+// run calls the stage of step, retrying failures as allowed by the retry
+// policy of the step. Retries are counted on result, which may be nil.
+func (i Injector) run(ctx context.Context, log *slog.Logger, result *Result, step Step, call stageCall) (string, string, error) {
+	return i.retry(ctx, log, result, step, call, nil)
+}
+
+// retry is run with prepare, when set, called before every retry to undo
+// what the failed attempt left behind. When prepare fails the failure of the
+// last attempt is returned without retrying.
+func (i Injector) retry(ctx context.Context, log *slog.Logger, result *Result, step Step, call stageCall, prepare func(ctx context.Context) error) (string, string, error) {
+	policy := i.options.Retries[step]
+
+	start := time.Now()
+	defer func() {
+		result.addTiming(step, time.Since(start))
+	}()
+
+	for attempt := 1; ; attempt++ {
+		stdout, stderr, err := i.runOnce(ctx, log.With("attempt", attempt), step, call)
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !policy.retryable(err, stderr) {
+			return stdout, stderr, err
+		}
+
+		if prepare != nil {
+			prepareErr := prepare(ctx)
+			if prepareErr != nil {
+				log.Error("not retrying step", "step", step, "attempt", attempt, "error", prepareErr)
+				return stdout, stderr, err
+			}
+		}
+
+		delay := policy.backoff(attempt)
+		log.Warn("retrying step", "step", step, "attempt", attempt, "max_attempts", policy.MaxAttempts, "backoff_ms", delay.Milliseconds(), "error", err)
+		result.addRetry(step)
+
+		select {
+		case <-ctx.Done():
+			return stdout, stderr, fmt.Errorf("%w: %w", ErrInterrupted, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runOnce calls the stage of step within the timeout configured for the step
+// and logs the outcome. A call cut short by the timeout or by ctx reports that
+// instead of the tool's exit status.
+func (i Injector) runOnce(ctx context.Context, log *slog.Logger, step Step, call stageCall) (string, string, error) {
+	timeout := i.options.Timeouts[step]
+	stepCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	stdout, stderr, err := call(stepCtx)
+	duration := time.Since(start)
+
+	code := 0
+	if err != nil {
+		code = exitCode(err)
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w: %w", ErrInterrupted, ctx.Err())
+		} else if stepCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%w after %s", ErrTimedOut, timeout)
+		}
+	}
+
+	attrs := []any{
+		"step", step,
+		"duration_ms", duration.Milliseconds(),
+		"exit_code", code,
+		"stdout", truncate(stdout),
+		"stderr", truncate(stderr),
+	}
+	if err != nil {
+		log.Error("step failed", append(attrs, "error", err)...)
+	} else {
+		log.Info("step completed", attrs...)
+	}
+
+	return stdout, stderr, err
+}
+
+// finishStep logs and times a step that does not run a tool.
+func finishStep(log *slog.Logger, result *Result, step Step, start time.Time, err error) {
+	duration := time.Since(start)
+	result.addTiming(step, duration)
+
+	attrs := []any{"step", step, "duration_ms", duration.Milliseconds()}
+	if err != nil {
+		log.Error("step failed", append(attrs, "error", err)...)
+		return
+	}
+	log.Info("step completed", attrs...)
+}
+
+// maxOutputLength bounds how much of a tool's output is logged. The end of
+// the output is kept since that is where tools report what went wrong.
+const maxOutputLength = 4096
+
+func truncate(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) <= maxOutputLength {
+		return output
+	}
+	return "..." + output[len(output)-maxOutputLength:]
+}
+
+// snapshot records the image so that rollback can restore it.
+func (i Injector) snapshot(log *slog.Logger, result *Result, uri string) (string, error) {
+	start := time.Now()
+	snapshot, err := i.image.Snapshot(uri)
+	finishStep(log, result, StepSnapshot, start, err)
+	if err != nil {
+		return "", stepError(StepSnapshot, err, fmt.Sprintf("snapshot image %s failed: %s", uri, err))
+	}
+	return snapshot, nil
+}
+
+// rollback restores the image from the snapshot when the pipeline failed.
+// The snapshot is kept on disk if it could not be restored, so an operator can recover the image by hand.
+func (i Injector) rollback(log *slog.Logger, uri, snapshot string, pipelineErr error) error {
+	if pipelineErr != nil {
+		restoreErr := i.image.Restore(uri, snapshot)
+		if restoreErr != nil {
+			return errors.Join(pipelineErr, fmt.Errorf("restoring image %s from snapshot %s failed: %s", uri, snapshot, restoreErr))
+		}
+		log.Info("restored image from snapshot", "snapshot", snapshot)
+	}
+
+	discardErr := i.image.Discard(snapshot)
+	if discardErr != nil {
+		log.Warn("discarding snapshot failed", "snapshot", snapshot, "error", discardErr)
+	}
+
+	return pipelineErr
+}
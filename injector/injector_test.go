@@ -1,12 +1,21 @@
 package injector_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/cert-injector/fakes"
 	"code.cloudfoundry.org/cert-injector/injector"
+	"code.cloudfoundry.org/cert-injector/layout"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -15,8 +24,12 @@ var _ = Describe("cert-injector", Serial, func() {
 	var (
 		fakeCmd    *fakes.Cmd
 		fakeConfig *fakes.Config
-		stdout     *fakes.Logger
-		stderr     *fakes.Logger
+		fakeBundle *fakes.Bundle
+		fakeLayout *fakes.Image
+		fakeIds    *fakes.Ids
+		fakeLeaks  *fakes.Leaks
+		logs       *bytes.Buffer
+		logger     *slog.Logger
 
 		driverStore   string
 		certDirectory string
@@ -30,8 +43,16 @@ var _ = Describe("cert-injector", Serial, func() {
 	BeforeEach(func() {
 		fakeCmd = &fakes.Cmd{}
 		fakeConfig = &fakes.Config{}
-		stdout = &fakes.Logger{}
-		stderr = &fakes.Logger{}
+		fakeBundle = &fakes.Bundle{}
+		fakeLayout = &fakes.Image{}
+
+		tempDir, err := os.MkdirTemp("", "cert-injector-injector-test-*")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tempDir)
+		fakeIds = &fakes.Ids{Dir: tempDir}
+		fakeLeaks = &fakes.Leaks{}
+		logs = &bytes.Buffer{}
+		logger = slog.New(slog.NewJSONHandler(logs, nil))
 
 		driverStore = "some-driver-store"
 		certDirectory = "some-directory-containing-certs"
@@ -41,7 +62,7 @@ var _ = Describe("cert-injector", Serial, func() {
 		fakeCmd.RunCall.OnCall = make([]fakes.RunCallOnCall, 20)
 		fakeCmd.RunCall.Returns = make([]fakes.RunCallReturn, 20)
 		fakeCmd.RunCall.Returns[1].Stdout = grootOutput
-		fakeCmd.RunCall.OnCall[3] = func(executable string, args ...string) (string, string, error) {
+		fakeCmd.RunCall.OnCall[3] = func(ctx context.Context, executable string, args ...string) (string, string, error) {
 			Expect(executable).To(ContainSubstring("diff-exporter.exe"))
 			layerTgz = args[1]
 			Expect(layerTgz).To(ContainSubstring("diff-output"))
@@ -50,13 +71,32 @@ var _ = Describe("cert-injector", Serial, func() {
 		}
 
 		fakeConfig.WriteCall.Returns = make([]fakes.WriteCallReturn, 2)
+		fakeBundle.DigestCall.Returns = []fakes.DigestCallReturn{{Digest: "sha256:some-digest"}}
 
-		inj = injector.NewInjector(fakeCmd, fakeConfig, stdout, stderr)
+		inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{})
 	})
 
 	It("replaces custom layers with a new layer with new certificates", func() {
-		err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
+		fakeLayout.LayerDigestCall.Returns = []fakes.LayerDigestCallReturn{{Digest: "sha256:new-layer"}}
+
+		result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
 		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Image).To(Equal(ociImageUri))
+		Expect(result.Status).To(Equal(injector.StatusSuccess))
+		Expect(result.Step).To(BeEmpty())
+		Expect(result.Retries).To(BeEmpty())
+
+		By("reporting the certificate and layer digests and how long each step took")
+		Expect(result.Digest).To(Equal("sha256:some-digest"))
+		Expect(result.LayerDigest).To(Equal("sha256:new-layer"))
+		Expect(fakeLayout.LayerDigestCall.Receives[0].URI).To(Equal(ociImageUri))
+		Expect(result.Timings).To(HaveLen(8))
+		Expect(result.Timings).To(HaveKey(injector.StepWincRun))
+		Expect(result.Timings).To(HaveKey(injector.StepGrootDelete))
+
+		By("validating the certificates")
+		Expect(fakeBundle.ValidateCall.CallCount).To(Equal(1))
+		Expect(fakeBundle.ValidateCall.Receives[0].CertDirectory).To(Equal(certDirectory))
 
 		By("calling hydrator to remove the old layer")
 		Expect(fakeCmd.RunCall.Receives[0].Executable).To(ContainSubstring("hydrate.exe"))
@@ -64,38 +104,712 @@ var _ = Describe("cert-injector", Serial, func() {
 
 		By("calling groot to create a volume")
 		Expect(fakeCmd.RunCall.Receives[1].Executable).To(ContainSubstring("groot.exe"))
-		Expect(fakeCmd.RunCall.Receives[1].Args).To(ConsistOf("--driver-store", driverStore, "create", ociImageUri, ContainSubstring("layer")))
+		Expect(fakeCmd.RunCall.Receives[1].Args).To(Equal([]string{"--driver-store", driverStore, "create", ociImageUri, "layer-1"}))
 
 		By("creating a bundle directory and container config")
+		Expect(fakeIds.BundleDirCall.Receives[0].ContainerId).To(Equal("layer-1"))
 		Expect(fakeConfig.WriteCall.CallCount).To(Equal(1))
-		Expect(fakeConfig.WriteCall.Receives[0].BundleDir).To(ContainSubstring("layer"))
+		Expect(fakeConfig.WriteCall.Receives[0].BundleDir).To(Equal(filepath.Join(fakeIds.Dir, "layer-1")))
 		Expect(fakeConfig.WriteCall.Receives[0].GrootOutput).To(Equal(grootOutput))
 		Expect(fakeConfig.WriteCall.Receives[0].CertData).To(Equal(certDirectory))
+		Expect(fakeConfig.WriteCall.Receives[0].Thumbprints).To(BeEmpty())
 
 		By("calling winc to create a container")
 		Expect(fakeCmd.RunCall.Receives[2].Executable).To(ContainSubstring("winc.exe"))
-		Expect(fakeCmd.RunCall.Receives[2].Args).To(ConsistOf("run", "-b", ContainSubstring("layer"), ContainSubstring("layer")))
-
-		By("creating a bundle directory using the name of the containerId passed to winc")
-		Expect(fakeCmd.RunCall.Receives[2].Args[2]).To(Equal(filepath.Join(os.TempDir(), fakeCmd.RunCall.Receives[2].Args[3])))
+		Expect(fakeCmd.RunCall.Receives[2].Args).To(Equal([]string{"run", "-b", filepath.Join(fakeIds.Dir, "layer-1"), "layer-1"}))
 
 		By("calling diff-exporter to export the top layer")
 		Expect(fakeCmd.RunCall.Receives[3].Executable).To(ContainSubstring("diff-exporter.exe"))
-		Expect(fakeCmd.RunCall.Receives[3].Args).To(ConsistOf("-outputFile", ContainSubstring("diff-output"), "-containerId", ContainSubstring("layer"), "-bundlePath", ContainSubstring("layer")))
+		Expect(fakeCmd.RunCall.Receives[3].Args).To(Equal([]string{"-outputFile", filepath.Join(fakeIds.Dir, "diff-output-layer-1"), "-containerId", "layer-1", "-bundlePath", filepath.Join(fakeIds.Dir, "layer-1")}))
 
 		By("calling hydrator to add the new layer")
 		Expect(fakeCmd.RunCall.Receives[4].Executable).To(ContainSubstring("hydrate.exe"))
-		Expect(fakeCmd.RunCall.Receives[4].Args).To(ConsistOf("add-layer", "-ociImage", ociImageUri, "-layer", ContainSubstring("diff-output")))
+		Expect(fakeCmd.RunCall.Receives[4].Args).To(Equal([]string{"add-layer", "-ociImage", ociImageUri, "-layer", filepath.Join(fakeIds.Dir, "diff-output-layer-1")}))
 
 		By("calling groot to delete the volume")
 		Expect(fakeCmd.RunCall.Receives[5].Executable).To(ContainSubstring("groot.exe"))
-		Expect(fakeCmd.RunCall.Receives[5].Args).To(ConsistOf("--driver-store", driverStore, "delete", ContainSubstring("layer")))
+		Expect(fakeCmd.RunCall.Receives[5].Args).To(Equal([]string{"--driver-store", driverStore, "delete", "layer-1"}))
 
 		By("checking bundle dir is gone")
 		Expect(fakeConfig.WriteCall.Receives[0].BundleDir).NotTo(BeAnExistingFile())
 
 		By("checking layer.tgz is gone")
 		Expect(layerTgz).NotTo(BeAnExistingFile())
+
+		By("not snapshotting the image")
+		Expect(fakeLayout.SnapshotCall.CallCount).To(Equal(0))
+
+		By("recording the certificate digest on the new layer")
+		Expect(fakeLayout.AnnotateLayerCall.CallCount).To(Equal(1))
+		Expect(fakeLayout.AnnotateLayerCall.Receives[0]).To(Equal(fakes.AnnotateLayerCallReceive{
+			URI:   ociImageUri,
+			Key:   injector.BundleDigestAnnotation,
+			Value: "sha256:some-digest",
+		}))
+	})
+
+	It("logs an event for every step", func() {
+		fakeCmd.RunCall.Returns[4] = fakes.RunCallReturn{Stdout: "added layer", Stderr: "some warning"}
+
+		_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+		Expect(err).NotTo(HaveOccurred())
+
+		var steps []interface{}
+		for _, event := range logEvents(logs) {
+			if event["msg"] == "step completed" {
+				Expect(event).To(HaveKeyWithValue("image", ociImageUri))
+				Expect(event).To(HaveKeyWithValue("duration_ms", BeNumerically(">=", 0)))
+				steps = append(steps, event["step"])
+			}
+		}
+		Expect(steps).To(Equal([]interface{}{"validate", "remove-layer", "groot-create", "config-write", "winc-run", "diff-export", "add-layer", "groot-delete"}))
+
+		addLayer := findStep(logs, "add-layer")
+		Expect(addLayer).To(HaveKeyWithValue("level", "INFO"))
+		Expect(addLayer).To(HaveKeyWithValue("container_id", "layer-1"))
+		Expect(addLayer).To(HaveKeyWithValue("exit_code", BeNumerically("==", 0)))
+		Expect(addLayer).To(HaveKeyWithValue("stdout", "added layer"))
+		Expect(addLayer).To(HaveKeyWithValue("stderr", "some warning"))
+	})
+
+	Context("when a tool fails with an exit code", func() {
+		BeforeEach(func() {
+			fakeCmd.RunCall.OnCall[3] = nil
+			fakeCmd.RunCall.Returns[2] = fakes.RunCallReturn{Stderr: strings.Repeat("x", 5000) + "the real problem", Error: exitError{code: 3}}
+		})
+
+		It("logs the exit code and the tail of the output", func() {
+			_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).To(HaveOccurred())
+
+			wincRun := findStep(logs, "winc-run")
+			Expect(wincRun).To(HaveKeyWithValue("level", "ERROR"))
+			Expect(wincRun).To(HaveKeyWithValue("exit_code", BeNumerically("==", 3)))
+			Expect(wincRun["stderr"]).To(HaveSuffix("the real problem"))
+			Expect(len(wincRun["stderr"].(string))).To(BeNumerically("<=", 4096+3))
+		})
+	})
+
+	Context("when a step fails transiently", func() {
+		var policy injector.RetryPolicy
+
+		BeforeEach(func() {
+			policy = injector.DefaultRetries()[injector.StepWincRun]
+			policy.InitialBackoff = time.Millisecond
+			policy.MaxBackoff = 2 * time.Millisecond
+			fakeCmd.RunCall.OnCall[5] = fakeCmd.RunCall.OnCall[3]
+			fakeCmd.RunCall.OnCall[3] = nil
+			fakeCmd.RunCall.Returns[2] = fakes.RunCallReturn{Stderr: "The requested resource is in use.", Error: exitError{code: 5}}
+		})
+
+		JustBeforeEach(func() {
+			inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{
+				Retries: map[injector.Step]injector.RetryPolicy{injector.StepWincRun: policy},
+			})
+		})
+
+		It("retries the step, logs the attempt and reports the retry in the result", func() {
+			result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Status).To(Equal(injector.StatusSuccess))
+			Expect(result.Retries).To(Equal(map[injector.Step]int{injector.StepWincRun: 1}))
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(8))
+			Expect(fakeCmd.RunCall.Receives[4].Args).To(Equal(fakeCmd.RunCall.Receives[2].Args))
+			retry := findEvent(logs, "retrying step")
+			Expect(retry).To(HaveKeyWithValue("level", "WARN"))
+			Expect(retry).To(HaveKeyWithValue("image", ociImageUri))
+			Expect(retry).To(HaveKeyWithValue("container_id", "layer-1"))
+			Expect(retry).To(HaveKeyWithValue("step", "winc-run"))
+			Expect(retry).To(HaveKeyWithValue("attempt", BeNumerically("==", 1)))
+			Expect(retry).To(HaveKeyWithValue("max_attempts", BeNumerically("==", 3)))
+			Expect(retry).To(HaveKeyWithValue("error", "exit status 5"))
+		})
+
+		It("deletes the container the failed attempt left behind before retrying", func() {
+			_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCmd.RunCall.Receives[3].Executable).To(ContainSubstring("winc.exe"))
+			Expect(fakeCmd.RunCall.Receives[3].Args).To(Equal([]string{"delete", "layer-1"}))
+		})
+
+		Context("when the container of the failed attempt cannot be deleted", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.Returns[3] = fakes.RunCallReturn{Stderr: "container layer-1 does not exist", Error: exitError{code: 1}}
+			})
+
+			It("retries anyway", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(findEvent(logs, "deleting the container of the failed attempt failed")).To(HaveKeyWithValue("stderr", "container layer-1 does not exist"))
+			})
+		})
+
+		Context("when the step keeps failing", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.OnCall[5] = nil
+				fakeCmd.RunCall.Returns[4] = fakeCmd.RunCall.Returns[2]
+				fakeCmd.RunCall.Returns[6] = fakeCmd.RunCall.Returns[2]
+			})
+
+			It("gives up after the maximum number of attempts", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("winc run failed: exit status 5"))
+				Expect(result.Retries).To(Equal(map[injector.Step]int{injector.StepWincRun: 2}))
+				Expect(fakeCmd.RunCall.Receives[7].Executable).To(ContainSubstring("winc.exe"))
+				Expect(fakeCmd.RunCall.Receives[7].Args).To(Equal([]string{"delete", "layer-1"}))
+				Expect(fakeCmd.RunCall.Receives[8].Executable).To(ContainSubstring("groot.exe"))
+				Expect(fakeCmd.RunCall.Receives[8].Args).To(ContainElement("delete"))
+			})
+		})
+
+		Context("when the exit code is retryable", func() {
+			BeforeEach(func() {
+				policy.RetryableExitCodes = []int{5}
+				policy.RetryableStderr = nil
+			})
+
+			It("retries the step", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(8))
+			})
+		})
+
+		Context("when stderr matches a retryable pattern", func() {
+			BeforeEach(func() {
+				policy.RetryableExitCodes = []int{1}
+				policy.RetryableStderr = []*regexp.Regexp{regexp.MustCompile(`(?i)in use`)}
+			})
+
+			It("retries the step", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(8))
+			})
+		})
+
+		Context("when the failure is not retryable", func() {
+			BeforeEach(func() {
+				policy.RetryableExitCodes = []int{1}
+				policy.RetryableStderr = nil
+			})
+
+			It("fails without retrying", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("winc run failed: exit status 5"))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepWincRun))
+				Expect(stepErr.ExitCode).To(Equal(5))
+				Expect(stepErr.Stderr).To(Equal("The requested resource is in use."))
+				Expect(errors.Is(err, exitError{code: 5})).To(BeTrue())
+
+				Expect(result.Retries).To(BeEmpty())
+				Expect(fakeCmd.RunCall.Receives[3].Args).To(Equal([]string{"delete", "layer-1"}))
+				Expect(fakeCmd.RunCall.Receives[4].Args).To(ContainElement("delete"))
+			})
+		})
+
+		Context("when the failure is not one the default policy knows to be transient", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.Returns[2] = fakes.RunCallReturn{Stderr: "invalid container spec", Error: exitError{code: 5}}
+			})
+
+			It("fails without retrying", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("winc run failed: exit status 5"))
+				Expect(result.Retries).To(BeEmpty())
+			})
+		})
+
+		Context("when the policy lists no retryable failures", func() {
+			BeforeEach(func() {
+				policy.RetryableExitCodes = nil
+				policy.RetryableStderr = nil
+			})
+
+			It("fails without retrying", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("winc run failed: exit status 5"))
+				Expect(result.Retries).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when groot create fails transiently", func() {
+		BeforeEach(func() {
+			policy := injector.DefaultRetries()[injector.StepGrootCreate]
+			policy.InitialBackoff = time.Millisecond
+			inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{
+				Retries: map[injector.Step]injector.RetryPolicy{injector.StepGrootCreate: policy},
+			})
+
+			fakeCmd.RunCall.OnCall[5] = fakeCmd.RunCall.OnCall[3]
+			fakeCmd.RunCall.OnCall[3] = nil
+			fakeCmd.RunCall.Returns[1] = fakes.RunCallReturn{Stderr: "layer.vhdx is being used by another process", Error: exitError{code: 1}}
+			fakeCmd.RunCall.Returns[3].Stdout = grootOutput
+		})
+
+		It("deletes the partial volume before retrying", func() {
+			result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Retries).To(Equal(map[injector.Step]int{injector.StepGrootCreate: 1}))
+
+			Expect(fakeCmd.RunCall.Receives[2].Args).To(Equal([]string{"--driver-store", driverStore, "delete", "layer-1"}))
+			Expect(fakeCmd.RunCall.Receives[3].Args).To(Equal(fakeCmd.RunCall.Receives[1].Args))
+		})
+
+		Context("when the partial volume cannot be deleted", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.Returns[2] = fakes.RunCallReturn{Stderr: "access denied", Error: exitError{code: 1}}
+			})
+
+			It("records the volume as leaked and does not retry", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("groot create failed: exit status 1"))
+				Expect(result.Retries).To(BeEmpty())
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(3))
+				Expect(fakeLeaks.AddLeakCall.Receives).To(Equal([]fakes.LeakCallReceive{{DriverStore: driverStore, ContainerId: "layer-1"}}))
+			})
+		})
+	})
+
+	Context("when custom tool paths are configured", func() {
+		BeforeEach(func() {
+			tools := injector.Tools{
+				Groot:        "/some/groot",
+				Winc:         "/some/winc",
+				DiffExporter: "/some/diff-exporter",
+				Hydrate:      "/some/hydrate",
+			}
+			fakeCmd.RunCall.OnCall[3] = nil
+			inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, tools, logger, injector.Options{})
+		})
+
+		It("runs the configured executables", func() {
+			_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCmd.RunCall.Receives[0].Executable).To(Equal("/some/hydrate"))
+			Expect(fakeCmd.RunCall.Receives[1].Executable).To(Equal("/some/groot"))
+			Expect(fakeCmd.RunCall.Receives[2].Executable).To(Equal("/some/winc"))
+			Expect(fakeCmd.RunCall.Receives[3].Executable).To(Equal("/some/diff-exporter"))
+			Expect(fakeCmd.RunCall.Receives[4].Executable).To(Equal("/some/hydrate"))
+			Expect(fakeCmd.RunCall.Receives[5].Executable).To(Equal("/some/groot"))
+		})
+	})
+
+	Context("when the image already has a layer for the same certificates", func() {
+		BeforeEach(func() {
+			fakeLayout.LayerAnnotationCall.Returns = []fakes.LayerAnnotationCallReturn{{Value: "sha256:some-digest"}}
+		})
+
+		It("skips the pipeline", func() {
+			result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Status).To(Equal(injector.StatusSkipped))
+
+			Expect(fakeLayout.LayerAnnotationCall.Receives[0].URI).To(Equal(ociImageUri))
+			Expect(fakeLayout.LayerAnnotationCall.Receives[0].Key).To(Equal(injector.BundleDigestAnnotation))
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+			Expect(findEvent(logs, "image already trusts these certificates, skipping")).To(And(
+				HaveKeyWithValue("image", ociImageUri),
+				HaveKeyWithValue("digest", "sha256:some-digest"),
+			))
+		})
+
+		Context("when forced", func() {
+			BeforeEach(func() {
+				inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{Force: true})
+			})
+
+			It("rebuilds the layer anyway", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeLayout.LayerAnnotationCall.CallCount).To(Equal(0))
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(6))
+			})
+		})
+	})
+
+	Context("when the image layer carries a different certificate digest", func() {
+		BeforeEach(func() {
+			fakeLayout.LayerAnnotationCall.Returns = []fakes.LayerAnnotationCallReturn{{Value: "sha256:old-digest"}}
+		})
+
+		It("rebuilds the layer", func() {
+			_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(6))
+		})
+	})
+
+	Context("when the image has a layer deleting certificates on top of the certificate layer", func() {
+		purged := "89ABCDEF0123456789ABCDEF0123456789ABCDEF"
+
+		BeforeEach(func() {
+			fakeLayout.CustomLayersCall.Returns = []fakes.CustomLayersCallReturn{{Layers: []map[string]string{
+				{injector.RemovedThumbprintsAnnotation: purged},
+				{injector.BundleDigestAnnotation: "sha256:old-digest"},
+			}}}
+			fakeCmd.RunCall.OnCall[3] = nil
+			fakeCmd.RunCall.Returns[1].Stdout = ""
+			fakeCmd.RunCall.Returns[2].Stdout = grootOutput
+		})
+
+		It("removes both layers and keeps deleting the purged certificates in the new layer", func() {
+			_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(7))
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+			Expect(fakeCmd.RunCall.Receives[1].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+			Expect(fakeCmd.RunCall.Receives[2].Args).To(ContainElement("create"))
+
+			Expect(fakeConfig.WriteCall.Receives).To(Equal([]fakes.WriteCallReceive{{
+				BundleDir:   filepath.Join(fakeIds.Dir, "layer-1"),
+				GrootOutput: grootOutput,
+				CertData:    certDirectory,
+				Thumbprints: []string{purged},
+			}}))
+
+			Expect(fakeLayout.AnnotateLayerCall.Receives).To(ConsistOf(
+				fakes.AnnotateLayerCallReceive{URI: ociImageUri, Key: injector.RemovedThumbprintsAnnotation, Value: purged},
+				fakes.AnnotateLayerCallReceive{URI: ociImageUri, Key: injector.BundleDigestAnnotation, Value: "sha256:some-digest"},
+			))
+		})
+
+		Context("when a layer builder is configured", func() {
+			BeforeEach(func() {
+				inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{LayerBuilder: &fakes.LayerBuilder{}})
+			})
+
+			It("refuses to replace the layers, since a layer builder cannot delete certificates", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError(ContainSubstring("oci:///first-image-uri deletes certificates " + purged)))
+				Expect(result.Step).To(Equal(injector.StepLayerBuild))
+
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when transactional mode is enabled", func() {
+		BeforeEach(func() {
+			fakeLayout.SnapshotCall.Returns = []fakes.SnapshotCallReturn{{Snapshot: "some-snapshot"}}
+			inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{Transactional: true})
+		})
+
+		It("snapshots the image before removing the layer and discards the snapshot on success", func() {
+			_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeLayout.SnapshotCall.CallCount).To(Equal(1))
+			Expect(fakeLayout.SnapshotCall.Receives[0].URI).To(Equal(ociImageUri))
+			Expect(fakeLayout.RestoreCall.CallCount).To(Equal(0))
+			Expect(fakeLayout.DiscardCall.CallCount).To(Equal(1))
+			Expect(fakeLayout.DiscardCall.Receives[0].Snapshot).To(Equal("some-snapshot"))
+		})
+
+		Context("when a step after remove-layer fails", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.OnCall[3] = nil
+				fakeCmd.RunCall.Returns[2].Error = errors.New("winc is unhappy")
+			})
+
+			It("restores the image from the snapshot", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepWincRun))
+				Expect(err).To(MatchError("winc run failed: winc is unhappy"))
+
+				Expect(fakeLayout.RestoreCall.CallCount).To(Equal(1))
+				Expect(fakeLayout.RestoreCall.Receives[0].URI).To(Equal(ociImageUri))
+				Expect(fakeLayout.RestoreCall.Receives[0].Snapshot).To(Equal("some-snapshot"))
+				Expect(fakeLayout.DiscardCall.CallCount).To(Equal(1))
+
+				By("restoring only after the groot volume is deleted")
+				Expect(fakeCmd.RunCall.Receives[4].Executable).To(ContainSubstring("groot.exe"))
+				Expect(fakeCmd.RunCall.Receives[4].Args).To(ContainElement("delete"))
+			})
+
+			Context("when the restore fails", func() {
+				BeforeEach(func() {
+					fakeLayout.RestoreCall.Returns = []fakes.RestoreCallReturn{{Error: errors.New("disk full")}}
+				})
+
+				It("returns both errors and keeps the snapshot", func() {
+					_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+					Expect(err).To(MatchError(ContainSubstring("winc run failed: winc is unhappy")))
+					Expect(err).To(MatchError(ContainSubstring("restoring image oci:///first-image-uri from snapshot some-snapshot failed: disk full")))
+
+					var stepErr *injector.StepError
+					Expect(errors.As(err, &stepErr)).To(BeTrue())
+					Expect(stepErr.Step).To(Equal(injector.StepWincRun))
+
+					Expect(fakeLayout.DiscardCall.CallCount).To(Equal(0))
+				})
+			})
+		})
+
+		Context("when the snapshot fails", func() {
+			BeforeEach(func() {
+				fakeLayout.SnapshotCall.Returns[0].Error = errors.New("no index.json")
+			})
+
+			It("returns a helpful error and leaves the image untouched", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("snapshot image oci:///first-image-uri failed: no index.json"))
+
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when a stage is replaced", func() {
+		var fakeLayerAdder *fakes.LayerAdder
+
+		BeforeEach(func() {
+			fakeLayerAdder = &fakes.LayerAdder{}
+			inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{
+				Stages:  injector.Stages{LayerAdder: fakeLayerAdder},
+				Retries: map[injector.Step]injector.RetryPolicy{injector.StepAddLayer: {MaxAttempts: 2, RetryableStderr: []*regexp.Regexp{regexp.MustCompile("another process")}}},
+			})
+		})
+
+		It("calls it in place of the tool and keeps the tools for the other stages", func() {
+			_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeLayerAdder.AddLayerCall.CallCount).To(Equal(1))
+			Expect(fakeLayerAdder.AddLayerCall.Receives[0]).To(Equal(fakes.AddLayerCallReceive{
+				URI:       ociImageUri,
+				LayerFile: filepath.Join(fakeIds.Dir, "diff-output-layer-1"),
+			}))
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(5))
+			for _, call := range fakeCmd.RunCall.Receives {
+				Expect(call.Args).NotTo(ContainElement("add-layer"))
+			}
+			Expect(findStep(logs, "add-layer")).To(HaveKeyWithValue("level", "INFO"))
+		})
+
+		Context("when it fails", func() {
+			BeforeEach(func() {
+				fakeLayerAdder.AddLayerCall.Returns = []fakes.AddLayerCallReturn{
+					{Stderr: "index.json is being used by another process", Error: errors.New("layout is locked")},
+					{Stderr: "still locked", Error: errors.New("layout is locked")},
+				}
+			})
+
+			It("retries it and reports the step like a tool failure", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("hydrate add-layer failed: layout is locked"))
+				Expect(result.Step).To(Equal(injector.StepAddLayer))
+				Expect(result.Retries).To(Equal(map[injector.Step]int{injector.StepAddLayer: 1}))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Stderr).To(Equal("still locked"))
+				Expect(stepErr.ExitCode).To(Equal(-1))
+			})
+
+			Context("after changing the top layer of the image", func() {
+				BeforeEach(func() {
+					fakeLayout.LayerDigestCall.Returns = []fakes.LayerDigestCallReturn{
+						{Digest: "sha256:base-layer"},
+						{Digest: "sha256:half-added-layer"},
+					}
+				})
+
+				It("does not retry it, so that a second layer is not stacked on the first", func() {
+					result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+					Expect(err).To(MatchError("hydrate add-layer failed: layout is locked"))
+					Expect(result.Retries).To(BeEmpty())
+					Expect(fakeLayerAdder.AddLayerCall.CallCount).To(Equal(1))
+
+					notRetried := findEvent(logs, "not retrying step")
+					Expect(notRetried).To(HaveKeyWithValue("error", "the failed attempt changed the top layer of oci:///first-image-uri to sha256:half-added-layer"))
+				})
+			})
+		})
+	})
+
+	Context("when a layer builder is configured", func() {
+		var fakeLayerBuilder *fakes.LayerBuilder
+
+		BeforeEach(func() {
+			fakeLayerBuilder = &fakes.LayerBuilder{}
+			fakeCmd.RunCall.OnCall[3] = nil
+			inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{LayerBuilder: fakeLayerBuilder})
+		})
+
+		It("writes the layer without running a container", func() {
+			result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Status).To(Equal(injector.StatusSuccess))
+			Expect(result.Timings).To(HaveKey(injector.StepLayerBuild))
+			Expect(result.Timings).NotTo(HaveKey(injector.StepWincRun))
+
+			diffOutputFile := filepath.Join(fakeIds.Dir, "diff-output-layer-1")
+			Expect(fakeLayerBuilder.BuildLayerCall.CallCount).To(Equal(1))
+			Expect(fakeLayerBuilder.BuildLayerCall.Receives[0]).To(Equal(fakes.BuildLayerCallReceive{
+				OutputFile:    diffOutputFile,
+				CertDirectory: certDirectory,
+			}))
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(2))
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+			Expect(fakeCmd.RunCall.Receives[1].Args).To(Equal([]string{"add-layer", "-ociImage", ociImageUri, "-layer", diffOutputFile}))
+			Expect(fakeConfig.WriteCall.CallCount).To(Equal(0))
+			Expect(fakeIds.BundleDirCall.CallCount).To(Equal(0))
+
+			By("removing the layer file")
+			Expect(diffOutputFile).NotTo(BeAnExistingFile())
+
+			By("recording the certificate digest on the new layer")
+			Expect(fakeLayout.AnnotateLayerCall.Receives[0].Value).To(Equal("sha256:some-digest"))
+		})
+
+		Context("when the layer cannot be built", func() {
+			BeforeEach(func() {
+				fakeLayerBuilder.BuildLayerCall.Returns = []fakes.BuildLayerCallReturn{{Error: errors.New("no certificates")}}
+			})
+
+			It("fails the layer-build step without adding a layer", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("build layer failed: no certificates"))
+				Expect(result.Step).To(Equal(injector.StepLayerBuild))
+
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(1))
+				Expect(findStep(logs, "layer-build")).To(HaveKeyWithValue("level", "ERROR"))
+			})
+		})
+	})
+
+	Context("when the image is in a registry", func() {
+		var (
+			fakeRegistry *fakes.Registry
+			pullDir      string
+			dockerUri    string
+			pushTag      string
+		)
+
+		BeforeEach(func() {
+			fakeRegistry = &fakes.Registry{}
+			pullDir = filepath.Join(fakeIds.Dir, "images")
+			dockerUri = "docker://registry.example.com/team/windows:1809"
+			pushTag = "1809-certs"
+		})
+
+		JustBeforeEach(func() {
+			inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{
+				Registry:      fakeRegistry,
+				PullDirectory: pullDir,
+				PushTag:       pushTag,
+			})
+		})
+
+		It("pulls it, injects into the local copy and pushes it under the push tag", func() {
+			result, err := inj.InjectCert(context.Background(), driverStore, dockerUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Image).To(Equal(dockerUri))
+			Expect(result.Status).To(Equal(injector.StatusSuccess))
+			Expect(result.Timings).To(HaveKey(injector.StepPull))
+			Expect(result.Timings).To(HaveKey(injector.StepPush))
+
+			Expect(fakeRegistry.PullCall.CallCount).To(Equal(1))
+			dir := fakeRegistry.PullCall.Receives[0].Dir
+			Expect(fakeRegistry.PullCall.Receives[0].URI).To(Equal(dockerUri))
+			Expect(filepath.Dir(dir)).To(Equal(pullDir))
+			Expect(filepath.Base(dir)).To(MatchRegexp(`^registry\.example\.com_team_windows_1809-[0-9a-f]{12}$`))
+
+			localUri := layout.URI(dir)
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(Equal([]string{"remove-layer", "-ociImage", localUri}))
+			Expect(fakeLayout.AnnotateLayerCall.Receives[0].URI).To(Equal(localUri))
+
+			Expect(fakeRegistry.PushCall.Receives).To(Equal([]fakes.PushCallReceive{{Dir: dir, URI: dockerUri, Tag: pushTag}}))
+		})
+
+		It("pushes an image that already trusts the certificates", func() {
+			fakeLayout.LayerAnnotationCall.Returns = []fakes.LayerAnnotationCallReturn{{Value: "sha256:some-digest"}}
+
+			result, err := inj.InjectCert(context.Background(), driverStore, dockerUri, certDirectory)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Status).To(Equal(injector.StatusSkipped))
+			Expect(fakeRegistry.PushCall.CallCount).To(Equal(1))
+		})
+
+		Context("without a push tag", func() {
+			BeforeEach(func() {
+				pushTag = ""
+			})
+
+			It("leaves the registry alone", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, dockerUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeRegistry.PushCall.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when the pull fails", func() {
+			BeforeEach(func() {
+				fakeRegistry.PullCall.Returns = []fakes.PullCallReturn{{Error: errors.New("connection refused")}}
+			})
+
+			It("fails the pull step without touching the image", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, dockerUri, certDirectory)
+				Expect(err).To(MatchError("pull " + dockerUri + " failed: connection refused"))
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepPull))
+
+				Expect(fakeBundle.ValidateCall.CallCount).To(Equal(0))
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+				Expect(findStep(logs, "pull")).To(HaveKeyWithValue("level", "ERROR"))
+			})
+		})
+
+		Context("when the push fails", func() {
+			BeforeEach(func() {
+				fakeRegistry.PushCall.Returns = []fakes.PushCallReturn{{Error: errors.New("denied")}}
+			})
+
+			It("fails the push step", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, dockerUri, certDirectory)
+				Expect(err).To(MatchError("push " + dockerUri + " to tag 1809-certs failed: denied"))
+				Expect(result.Step).To(Equal(injector.StepPush))
+			})
+		})
+
+		Context("when injection fails", func() {
+			BeforeEach(func() {
+				fakeBundle.ValidateCall.Returns = []fakes.ValidateCallReturn{{Error: errors.New("expired")}}
+			})
+
+			It("does not push", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, dockerUri, certDirectory)
+				Expect(err).To(HaveOccurred())
+				Expect(result.Step).To(Equal(injector.StepValidate))
+				Expect(fakeRegistry.PushCall.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when no registry is configured", func() {
+			JustBeforeEach(func() {
+				inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{})
+			})
+
+			It("fails the pull step", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, dockerUri, certDirectory)
+				Expect(err).To(MatchError("pull " + dockerUri + " failed: no registry configured"))
+				Expect(result.Step).To(Equal(injector.StepPull))
+			})
+		})
 	})
 
 	Describe("error cases", func() {
@@ -103,24 +817,103 @@ var _ = Describe("cert-injector", Serial, func() {
 			fakeCmd.RunCall.OnCall[3] = nil
 		})
 
+		Context("when the certificates are invalid", func() {
+			BeforeEach(func() {
+				fakeBundle.ValidateCall.Returns = []fakes.ValidateCallReturn{{Error: errors.New("bad.pem: not a CA certificate")}}
+			})
+
+			It("returns a helpful error and leaves the image untouched", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepValidate))
+				Expect(err).To(MatchError("certificate validation failed: bad.pem: not a CA certificate"))
+
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when the current certificate digest cannot be read", func() {
+			BeforeEach(func() {
+				fakeLayout.LayerAnnotationCall.Returns = []fakes.LayerAnnotationCallReturn{{Error: errors.New("no index.json")}}
+			})
+
+			It("logs a warning and rebuilds the layer", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(findEvent(logs, "reading certificate digest failed, rebuilding the layer")).To(And(
+					HaveKeyWithValue("level", "WARN"),
+					HaveKeyWithValue("image", ociImageUri),
+					HaveKeyWithValue("error", "no index.json"),
+				))
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(6))
+			})
+		})
+
+		Context("when the new layer digest cannot be read", func() {
+			BeforeEach(func() {
+				fakeLayout.LayerDigestCall.Returns = []fakes.LayerDigestCallReturn{{Error: errors.New("no index.json")}}
+			})
+
+			It("logs a warning but does not error", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.LayerDigest).To(BeEmpty())
+
+				Expect(findEvent(logs, "reading the new layer digest failed")).To(HaveKeyWithValue("error", "no index.json"))
+			})
+		})
+
+		Context("when recording the certificate digest fails", func() {
+			BeforeEach(func() {
+				fakeLayout.AnnotateLayerCall.Returns = []fakes.AnnotateLayerCallReturn{{Error: errors.New("read-only")}}
+			})
+
+			It("logs a warning but does not error", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(findEvent(logs, "recording certificate digest failed")).To(And(
+					HaveKeyWithValue("level", "WARN"),
+					HaveKeyWithValue("image", ociImageUri),
+					HaveKeyWithValue("error", "read-only"),
+				))
+			})
+		})
+
 		Context("when hydrator fails to remove the custom layer", func() {
 			BeforeEach(func() {
 				fakeCmd.RunCall.Returns[0].Error = errors.New("hydrator is unhappy")
 			})
 
 			It("should return a helpful error", func() {
-				err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepRemoveLayer))
 				Expect(err).To(MatchError("hydrate remove-layer -ociImage oci:///first-image-uri failed: hydrator is unhappy\n"))
 			})
 		})
 
+		Context("when a container id cannot be generated", func() {
+			BeforeEach(func() {
+				fakeIds.ContainerIdCall.Returns = []fakes.ContainerIdCallReturn{{Error: errors.New("no entropy")}}
+			})
+
+			It("returns a helpful error", func() {
+				_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("generate container id failed: no entropy"))
+			})
+		})
+
 		Context("when groot fails to create a volume", func() {
 			BeforeEach(func() {
 				fakeCmd.RunCall.Returns[1].Error = errors.New("groot is unhappy")
 			})
 
 			It("returns a helpful error message", func() {
-				err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepGrootCreate))
 				Expect(err).To(MatchError("groot create failed: groot is unhappy"))
 			})
 		})
@@ -131,9 +924,16 @@ var _ = Describe("cert-injector", Serial, func() {
 			})
 
 			It("returns a helpful error message, deletes the bundle dir, and deletes the volume created by groot", func() {
-				err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepConfigWrite))
 				Expect(err).To(MatchError("container config write failed: banana"))
 
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepConfigWrite))
+				Expect(stepErr.ExitCode).To(Equal(-1))
+
 				Expect(fakeConfig.WriteCall.Receives[0].BundleDir).NotTo(BeAnExistingFile())
 				Expect(fakeCmd.RunCall.Receives[2].Executable).To(ContainSubstring("groot.exe"))
 				Expect(fakeCmd.RunCall.Receives[2].Args).To(ConsistOf("--driver-store", driverStore, "delete", ContainSubstring("layer")))
@@ -146,12 +946,16 @@ var _ = Describe("cert-injector", Serial, func() {
 			})
 
 			It("returns a helpful error message, deletes the bundle dir, and deletes the volume created by groot", func() {
-				err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepWincRun))
 				Expect(err).To(MatchError("winc run failed: winc is unhappy"))
 
 				Expect(fakeConfig.WriteCall.Receives[0].BundleDir).NotTo(BeAnExistingFile())
-				Expect(fakeCmd.RunCall.Receives[3].Executable).To(ContainSubstring("groot.exe"))
-				Expect(fakeCmd.RunCall.Receives[3].Args).To(ConsistOf("--driver-store", driverStore, "delete", ContainSubstring("layer")))
+				Expect(fakeCmd.RunCall.Receives[3].Executable).To(ContainSubstring("winc.exe"))
+				Expect(fakeCmd.RunCall.Receives[3].Args).To(Equal([]string{"delete", "layer-1"}))
+				Expect(fakeCmd.RunCall.Receives[4].Executable).To(ContainSubstring("groot.exe"))
+				Expect(fakeCmd.RunCall.Receives[4].Args).To(ConsistOf("--driver-store", driverStore, "delete", ContainSubstring("layer")))
 			})
 		})
 
@@ -162,19 +966,28 @@ var _ = Describe("cert-injector", Serial, func() {
 			})
 
 			It("returns a helpful error message", func() {
-				err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepDiffExport))
 				Expect(err).To(MatchError("diff-exporter failed exporting the layer: diff-exporter is unhappy"))
 
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Stdout).To(Equal("diff-exporter is unhappy"))
+
 				Expect(fakeConfig.WriteCall.Receives[0].BundleDir).NotTo(BeAnExistingFile())
 				Expect(fakeCmd.RunCall.Receives[3].Executable).To(ContainSubstring("diff-exporter.exe"))
 				Expect(fakeCmd.RunCall.Receives[3].Args).To(ConsistOf("-outputFile", ContainSubstring("diff-output"), "-containerId", ContainSubstring("layer"), "-bundlePath", ContainSubstring("layer")))
-				Expect(stdout.PrintlnCall.Receives[0].Args[0]).To(Equal("diff-exporter is unhappy"))
+				Expect(findStep(logs, "diff-export")).To(And(
+					HaveKeyWithValue("level", "ERROR"),
+					HaveKeyWithValue("stdout", "diff-exporter is unhappy"),
+				))
 			})
 		})
 
 		Context("when hydrator fails to add the new layer", func() {
 			BeforeEach(func() {
-				fakeCmd.RunCall.OnCall[3] = func(executable string, args ...string) (string, string, error) {
+				fakeCmd.RunCall.OnCall[3] = func(ctx context.Context, executable string, args ...string) (string, string, error) {
 					Expect(executable).To(ContainSubstring("diff-exporter.exe"))
 					layerTgz = args[1]
 					Expect(layerTgz).To(ContainSubstring("diff-output"))
@@ -186,28 +999,424 @@ var _ = Describe("cert-injector", Serial, func() {
 			})
 
 			It("should return a helpful error, deletes the bundle dir, deletes the volume created by groot, and deletes the exported layer.tgz", func() {
-				err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepAddLayer))
 				Expect(err).To(MatchError("hydrate add-layer failed: hydrate add-layer is unhappy"))
 
 				Expect(fakeConfig.WriteCall.Receives[0].BundleDir).NotTo(BeAnExistingFile())
 				Expect(fakeCmd.RunCall.Receives[4].Executable).To(ContainSubstring("hydrate.exe"))
 				Expect(fakeCmd.RunCall.Receives[4].Args).To(ConsistOf("add-layer", "-ociImage", ociImageUri, "-layer", ContainSubstring("diff-output")))
-				Expect(stdout.PrintlnCall.Receives[0].Args[0]).To(Equal("hydrate add-layer is unhappy"))
+				Expect(findStep(logs, "add-layer")).To(HaveKeyWithValue("stdout", "hydrate add-layer is unhappy"))
 				Expect(layerTgz).NotTo(BeAnExistingFile())
 			})
 		})
 
+		Context("when a step times out", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.OnCall[2] = func(ctx context.Context, executable string, args ...string) (string, string, error) {
+					<-ctx.Done()
+					return "", "", ctx.Err()
+				}
+				inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{
+					Timeouts: map[injector.Step]time.Duration{injector.StepWincRun: 10 * time.Millisecond},
+				})
+			})
+
+			It("reports which step timed out and still deletes the container and the volume", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("winc run failed: timed out after 10ms"))
+				Expect(errors.Is(err, injector.ErrTimedOut)).To(BeTrue())
+				Expect(result.Step).To(Equal(injector.StepWincRun))
+
+				Expect(fakeCmd.RunCall.Receives[3].Executable).To(ContainSubstring("winc.exe"))
+				Expect(fakeCmd.RunCall.Receives[3].Args).To(Equal([]string{"delete", "layer-1"}))
+				Expect(fakeCmd.RunCall.Receives[4].Args).To(ConsistOf("--driver-store", driverStore, "delete", "layer-1"))
+			})
+		})
+
+		Context("when the run is interrupted", func() {
+			var cancel context.CancelFunc
+
+			BeforeEach(func() {
+				fakeCmd.RunCall.OnCall[2] = func(ctx context.Context, executable string, args ...string) (string, string, error) {
+					cancel()
+					<-ctx.Done()
+					return "", "", ctx.Err()
+				}
+				liveContext := func(ctx context.Context, executable string, args ...string) (string, string, error) {
+					Expect(ctx.Err()).NotTo(HaveOccurred())
+					return "", "", nil
+				}
+				fakeCmd.RunCall.OnCall[3] = liveContext
+				fakeCmd.RunCall.OnCall[4] = liveContext
+			})
+
+			It("reports the interruption and deletes the container and the volume with a live context", func() {
+				var ctx context.Context
+				ctx, cancel = context.WithCancel(context.Background())
+
+				_, err := inj.InjectCert(ctx, driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("winc run failed: interrupted: context canceled"))
+				Expect(errors.Is(err, injector.ErrInterrupted)).To(BeTrue())
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(5))
+				Expect(fakeCmd.RunCall.Receives[3].Args).To(Equal([]string{"delete", "layer-1"}))
+				Expect(fakeCmd.RunCall.Receives[4].Args).To(ContainElement("delete"))
+			})
+		})
+
 		Context("when groot fails to delete a volume", func() {
 			BeforeEach(func() {
 				fakeCmd.RunCall.Returns[5].Error = errors.New("groot is unhappy")
 			})
 
-			It("logs a helpful error message, but does not error", func() {
-				err := inj.InjectCert(driverStore, ociImageUri, certDirectory)
-				Expect(err).NotTo(HaveOccurred())
+			It("returns the cleanup error and records the leaked volume", func() {
+				result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+				Expect(err).To(MatchError("groot delete layer-1 failed: groot is unhappy"))
+				Expect(result.Status).To(Equal(injector.StatusFailed))
+				Expect(result.Step).To(Equal(injector.StepGrootDelete))
+
+				Expect(fakeLeaks.AddLeakCall.Receives).To(Equal([]fakes.LeakCallReceive{{DriverStore: driverStore, ContainerId: "layer-1"}}))
+				Expect(findStep(logs, "groot-delete")).To(And(
+					HaveKeyWithValue("msg", "step failed"),
+					HaveKeyWithValue("container_id", "layer-1"),
+					HaveKeyWithValue("error", "groot is unhappy"),
+				))
+			})
+
+			Context("when an earlier step failed too", func() {
+				BeforeEach(func() {
+					fakeCmd.RunCall.Returns[2].Error = errors.New("winc is unhappy")
+					fakeCmd.RunCall.Returns[4].Error = errors.New("groot is unhappy")
+				})
 
-				Expect(stdout.PrintlnCall.Receives[0].Args[0]).To(Equal("groot delete failed"))
+				It("returns both errors and attributes the failure to the earlier step", func() {
+					result, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+					Expect(err).To(MatchError("winc run failed: winc is unhappy\ngroot delete layer-1 failed: groot is unhappy"))
+					Expect(result.Step).To(Equal(injector.StepWincRun))
+				})
+			})
+
+			Context("when transactional mode is enabled", func() {
+				BeforeEach(func() {
+					inj = injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, injector.DefaultTools(), logger, injector.Options{Transactional: true})
+				})
+
+				It("keeps the new layer", func() {
+					_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+					Expect(err).To(HaveOccurred())
+
+					Expect(fakeLayout.RestoreCall.CallCount).To(Equal(0))
+					Expect(fakeLayout.DiscardCall.CallCount).To(Equal(1))
+				})
+			})
+
+			Context("when the leak cannot be recorded", func() {
+				BeforeEach(func() {
+					fakeLeaks.AddLeakCall.Returns = []fakes.AddLeakCallReturn{{Error: errors.New("disk full")}}
+				})
+
+				It("logs the failure", func() {
+					_, err := inj.InjectCert(context.Background(), driverStore, ociImageUri, certDirectory)
+					Expect(err).To(MatchError("groot delete layer-1 failed: groot is unhappy"))
+
+					Expect(findEvent(logs, "recording leaked volume failed")).To(HaveKeyWithValue("error", "disk full"))
+				})
+			})
+		})
+	})
+
+	Describe("CleanupLeaks", func() {
+		BeforeEach(func() {
+			fakeLeaks.LeaksCall.Returns = []fakes.LeaksCallReturn{{ContainerIds: []string{"layer-a", "layer-b", "layer-c"}}}
+			fakeCmd.RunCall.Returns[1].Error = errors.New("groot is unhappy")
+		})
+
+		It("deletes the leaked volumes and forgets the ones that were deleted", func() {
+			deleted, err := inj.CleanupLeaks(context.Background(), driverStore)
+			Expect(err).To(MatchError("groot delete layer-b failed: groot is unhappy"))
+			Expect(deleted).To(Equal(2))
+
+			Expect(fakeLeaks.LeaksCall.Receives[0].DriverStore).To(Equal(driverStore))
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(3))
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(Equal([]string{"--driver-store", driverStore, "delete", "layer-a"}))
+			Expect(fakeLeaks.RemoveLeakCall.Receives).To(Equal([]fakes.LeakCallReceive{
+				{DriverStore: driverStore, ContainerId: "layer-a"},
+				{DriverStore: driverStore, ContainerId: "layer-c"},
+			}))
+		})
+
+		Context("when the leaks cannot be read", func() {
+			BeforeEach(func() {
+				fakeLeaks.LeaksCall.Returns[0].Error = errors.New("corrupt")
+			})
+
+			It("returns a helpful error", func() {
+				_, err := inj.CleanupLeaks(context.Background(), driverStore)
+				Expect(err).To(MatchError("read leaked volumes failed: corrupt"))
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+			})
+		})
+	})
+
+	Describe("RemoveCert", func() {
+		It("calls hydrator to remove the custom layer", func() {
+			err := inj.RemoveCert(context.Background(), ociImageUri)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(1))
+			Expect(fakeCmd.RunCall.Receives[0].Executable).To(ContainSubstring("hydrate.exe"))
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(ConsistOf("remove-layer", "-ociImage", ociImageUri))
+		})
+
+		Context("when hydrator fails", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.Returns[0].Stderr = "no such image"
+				fakeCmd.RunCall.Returns[0].Error = errors.New("exit status 1")
+			})
+
+			It("returns a helpful error", func() {
+				err := inj.RemoveCert(context.Background(), ociImageUri)
+				Expect(err).To(MatchError("hydrate remove-layer -ociImage oci:///first-image-uri failed: exit status 1\n"))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepRemoveLayer))
+				Expect(stepErr.Stderr).To(Equal("no such image"))
+				Expect(findStep(logs, "remove-layer")).To(And(
+					HaveKeyWithValue("image", ociImageUri),
+					HaveKeyWithValue("stderr", "no such image"),
+				))
+			})
+		})
+
+		It("confirms the custom layer is gone", func() {
+			Expect(inj.RemoveCert(context.Background(), ociImageUri)).To(Succeed())
+
+			Expect(fakeLayout.CustomLayersCall.Receives).To(Equal([]fakes.CustomLayersCallReceive{{URI: ociImageUri}, {URI: ociImageUri}}))
+		})
+
+		It("removes every custom layer, including those deleting certificates", func() {
+			fakeLayout.CustomLayersCall.Returns = []fakes.CustomLayersCallReturn{{Layers: []map[string]string{
+				{injector.BundleDigestAnnotation: "sha256:some-digest"},
+				{injector.RemovedThumbprintsAnnotation: "0123456789ABCDEF0123456789ABCDEF01234567"},
+			}}}
+
+			Expect(inj.RemoveCert(context.Background(), ociImageUri)).To(Succeed())
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(2))
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+			Expect(fakeCmd.RunCall.Receives[1].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+		})
+
+		Context("when the custom layers of the image cannot be read", func() {
+			BeforeEach(func() {
+				fakeLayout.CustomLayersCall.Returns = []fakes.CustomLayersCallReturn{{Error: errors.New("no index.json")}}
+			})
+
+			It("fails at the remove-layer step without removing anything", func() {
+				err := inj.RemoveCert(context.Background(), ociImageUri)
+				Expect(err).To(MatchError("read the custom layers of oci:///first-image-uri failed: no index.json"))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepRemoveLayer))
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when the custom layer is still there after hydrate ran", func() {
+			BeforeEach(func() {
+				fakeLayout.CustomLayersCall.Returns = []fakes.CustomLayersCallReturn{{}, {Layers: []map[string]string{{injector.BundleDigestAnnotation: "sha256:some-digest"}}}}
+			})
+
+			It("fails at the remove-layer step", func() {
+				err := inj.RemoveCert(context.Background(), ociImageUri)
+				Expect(err).To(MatchError("custom layer is still present in oci:///first-image-uri"))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepRemoveLayer))
+				Expect(stepErr.ExitCode).To(Equal(-1))
+			})
+		})
+	})
+
+	Describe("PurgeCerts", func() {
+		var thumbprints []string
+
+		BeforeEach(func() {
+			thumbprints = []string{"0123456789ABCDEF0123456789ABCDEF01234567"}
+		})
+
+		It("replaces the custom layer with a layer that deletes the certificates from the root store", func() {
+			Expect(inj.PurgeCerts(context.Background(), driverStore, ociImageUri, thumbprints)).To(Succeed())
+
+			Expect(fakeCmd.RunCall.CallCount).To(Equal(6))
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+			Expect(fakeLayout.CustomLayersCall.CallCount).To(Equal(2))
+			Expect(fakeCmd.RunCall.Receives[1].Args[:4]).To(Equal([]string{"--driver-store", driverStore, "create", ociImageUri}))
+			containerId := fakeCmd.RunCall.Receives[1].Args[4]
+
+			Expect(fakeConfig.WriteCall.Receives).To(HaveLen(1))
+			Expect(fakeConfig.WriteCall.Receives[0].GrootOutput).To(Equal(grootOutput))
+			Expect(fakeConfig.WriteCall.Receives[0].CertData).To(BeEmpty())
+			Expect(fakeConfig.WriteCall.Receives[0].Thumbprints).To(Equal(thumbprints))
+
+			Expect(fakeCmd.RunCall.Receives[2].Args).To(ContainElements("run", containerId))
+			Expect(fakeCmd.RunCall.Receives[3].Executable).To(ContainSubstring("diff-exporter.exe"))
+			Expect(fakeCmd.RunCall.Receives[4].Args[:3]).To(Equal([]string{"add-layer", "-ociImage", ociImageUri}))
+			Expect(fakeCmd.RunCall.Receives[5].Args).To(Equal([]string{"--driver-store", driverStore, "delete", containerId}))
+
+			Expect(fakeLayout.AnnotateLayerCall.Receives).To(Equal([]fakes.AnnotateLayerCallReceive{{
+				URI:   ociImageUri,
+				Key:   injector.RemovedThumbprintsAnnotation,
+				Value: "0123456789ABCDEF0123456789ABCDEF01234567",
+			}}))
+
+			By("snapshotting the image first and discarding the snapshot")
+			Expect(fakeLayout.SnapshotCall.Receives).To(Equal([]fakes.SnapshotCallReceive{{URI: ociImageUri}}))
+			Expect(fakeLayout.RestoreCall.CallCount).To(Equal(0))
+			Expect(fakeLayout.DiscardCall.CallCount).To(Equal(1))
+		})
+
+		It("keeps deleting the certificates purged by the layers it replaces", func() {
+			fakeCmd.RunCall.OnCall[3] = nil
+			fakeLayout.CustomLayersCall.Returns = []fakes.CustomLayersCallReturn{{Layers: []map[string]string{
+				{injector.BundleDigestAnnotation: "sha256:some-digest"},
+				{injector.RemovedThumbprintsAnnotation: "89ABCDEF0123456789ABCDEF0123456789ABCDEF,0123456789ABCDEF0123456789ABCDEF01234567"},
+			}}}
+
+			Expect(inj.PurgeCerts(context.Background(), driverStore, ociImageUri, thumbprints)).To(Succeed())
+
+			Expect(fakeCmd.RunCall.Receives[0].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+			Expect(fakeCmd.RunCall.Receives[1].Args).To(Equal([]string{"remove-layer", "-ociImage", ociImageUri}))
+			Expect(fakeCmd.RunCall.Receives[2].Args).To(ContainElement("create"))
+
+			purged := []string{"89ABCDEF0123456789ABCDEF0123456789ABCDEF", "0123456789ABCDEF0123456789ABCDEF01234567"}
+			Expect(fakeConfig.WriteCall.Receives[0].Thumbprints).To(Equal(purged))
+			Expect(fakeLayout.AnnotateLayerCall.Receives).To(Equal([]fakes.AnnotateLayerCallReceive{{
+				URI:   ociImageUri,
+				Key:   injector.RemovedThumbprintsAnnotation,
+				Value: strings.Join(purged, ","),
+			}}))
+		})
+
+		Context("when the removed thumbprints cannot be recorded", func() {
+			BeforeEach(func() {
+				fakeLayout.AnnotateLayerCall.Returns = []fakes.AnnotateLayerCallReturn{{Error: errors.New("disk full")}}
+			})
+
+			It("fails at the add-layer step, since a later inject could not keep them purged", func() {
+				err := inj.PurgeCerts(context.Background(), driverStore, ociImageUri, thumbprints)
+				Expect(err).To(MatchError("recording removed thumbprints on oci:///first-image-uri failed: disk full"))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepAddLayer))
+			})
+		})
+
+		Context("when the image cannot be snapshotted", func() {
+			BeforeEach(func() {
+				fakeLayout.SnapshotCall.Returns = []fakes.SnapshotCallReturn{{Error: errors.New("no index.json")}}
+			})
+
+			It("changes nothing and returns a snapshot error", func() {
+				err := inj.PurgeCerts(context.Background(), driverStore, ociImageUri, thumbprints)
+				Expect(err).To(MatchError("snapshot image oci:///first-image-uri failed: no index.json"))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepSnapshot))
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when writing the config fails", func() {
+			BeforeEach(func() {
+				fakeConfig.WriteCall.Returns = []fakes.WriteCallReturn{{Error: errors.New("invalid thumbprint")}}
+			})
+
+			It("deletes the volume, restores the image and returns a config-write error", func() {
+				fakeLayout.SnapshotCall.Returns = []fakes.SnapshotCallReturn{{Snapshot: "some-snapshot"}}
+
+				err := inj.PurgeCerts(context.Background(), driverStore, ociImageUri, thumbprints)
+				Expect(err).To(MatchError("container config write failed: invalid thumbprint"))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepConfigWrite))
+
+				Expect(fakeCmd.RunCall.CallCount).To(Equal(3))
+				Expect(fakeCmd.RunCall.Receives[2].Args).To(ContainElement("delete"))
+				Expect(fakeLayout.AnnotateLayerCall.CallCount).To(Equal(0))
+
+				Expect(fakeLayout.RestoreCall.Receives).To(Equal([]fakes.RestoreCallReceive{{URI: ociImageUri, Snapshot: "some-snapshot"}}))
+				Expect(fakeLayout.DiscardCall.CallCount).To(Equal(1))
+			})
+		})
+
+		Context("when groot fails to delete the volume", func() {
+			BeforeEach(func() {
+				fakeCmd.RunCall.Returns[5].Error = errors.New("volume in use")
+			})
+
+			It("keeps the layer, records the leak and returns a groot-delete error", func() {
+				err := inj.PurgeCerts(context.Background(), driverStore, ociImageUri, thumbprints)
+				Expect(err).To(MatchError(ContainSubstring("groot delete")))
+
+				var stepErr *injector.StepError
+				Expect(errors.As(err, &stepErr)).To(BeTrue())
+				Expect(stepErr.Step).To(Equal(injector.StepGrootDelete))
+				Expect(fakeLeaks.AddLeakCall.CallCount).To(Equal(1))
+				Expect(fakeLayout.AnnotateLayerCall.CallCount).To(Equal(1))
 			})
 		})
 	})
 })
+
+func logEvents(logs *bytes.Buffer) []map[string]interface{} {
+	var events []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(logs.Bytes()))
+	for decoder.More() {
+		var event map[string]interface{}
+		Expect(decoder.Decode(&event)).To(Succeed())
+		events = append(events, event)
+	}
+	return events
+}
+
+func findEvent(logs *bytes.Buffer, msg string) map[string]interface{} {
+	for _, event := range logEvents(logs) {
+		if event["msg"] == msg {
+			return event
+		}
+	}
+	Fail(fmt.Sprintf("no %q event in logs:\n%s", msg, logs.String()))
+	return nil
+}
+
+func findStep(logs *bytes.Buffer, step string) map[string]interface{} {
+	for _, event := range logEvents(logs) {
+		if event["step"] == step && event["msg"] != "retrying step" {
+			return event
+		}
+	}
+	Fail(fmt.Sprintf("no %q step event in logs:\n%s", step, logs.String()))
+	return nil
+}
+
+type exitError struct {
+	code int
+}
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+func (e exitError) ExitCode() int {
+	return e.code
+}
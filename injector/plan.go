@@ -0,0 +1,137 @@
+package injector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Placeholders stand in for values that only exist once the pipeline runs.
+const (
+	PlaceholderBundleDir      = "<bundle-dir>"
+	PlaceholderCertsDir       = "<certs-dir>"
+	PlaceholderDiffOutputFile = "<diff-output-file>"
+	PlaceholderVolumePath     = "<volume-path>"
+	PlaceholderLayerFolders   = "<layer-folders>"
+)
+
+// synthesizedGrootOutput is used in place of the output of groot create when
+// planning without a real volume.
+var synthesizedGrootOutput = fmt.Sprintf(`{"ociVersion":"1.0.2","root":{"path":%q},"windows":{"layerFolders":[%q]}}`, PlaceholderVolumePath, PlaceholderLayerFolders)
+
+// Command is a tool run by a step of the pipeline.
+type Command struct {
+	Step       Step
+	Executable string
+	Args       []string
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Executable}, c.Args...), " ")
+}
+
+// Plan describes what InjectCert would do to an image.
+type Plan struct {
+	Image string
+
+	// Digest is the digest of the certificates that would be injected.
+	Digest string
+
+	// Skip is set when the image already trusts the same certificates.
+	// Commands and Config are empty in that case.
+	Skip bool
+
+	// Commands are the tools that would run, in order.
+	Commands []Command
+
+	// Config is the config.json that would be written to the bundle
+	// directory of the container. It is empty when the layer is written by
+	// a LayerBuilder instead.
+	Config []byte
+}
+
+// Plan validates the certificates and returns the commands InjectCert would
+// run for uri without running them or changing the image. grootOutput stands
+// in for the output of groot create; when it is empty a placeholder volume is
+// used. Paths created while the pipeline runs, including the directory the
+// certificates are staged in, are shown as placeholders, and docker:// images
+// are planned against the layout they would be pulled into.
+func (i Injector) Plan(grootDriverStore, uri, certDirectory, grootOutput string) (Plan, error) {
+	if isRemote(uri) {
+		return i.planRemote(grootDriverStore, uri, certDirectory, grootOutput)
+	}
+	return i.plan(grootDriverStore, uri, certDirectory, grootOutput, true)
+}
+
+// plan plans the injection into the image uri refers to. Unless readImage is
+// set the image is planned as if it had no custom layers, since it does not
+// exist yet.
+func (i Injector) plan(grootDriverStore, uri, certDirectory, grootOutput string, readImage bool) (Plan, error) {
+	plan := Plan{Image: uri}
+
+	err := i.bundle.Validate(certDirectory)
+	if err != nil {
+		return plan, fmt.Errorf("certificate validation failed: %s", err)
+	}
+
+	plan.Digest, err = i.bundle.Digest(certDirectory)
+	if err != nil {
+		return plan, fmt.Errorf("certificate digest failed: %s", err)
+	}
+
+	if readImage && !i.options.Force {
+		current, err := i.image.LayerAnnotation(uri, BundleDigestAnnotation)
+		if err == nil && current == plan.Digest {
+			plan.Skip = true
+			return plan, nil
+		}
+	}
+
+	// Like the digest, the layers of an image that cannot be read are
+	// planned as if there were no custom layers.
+	var layers []map[string]string
+	if readImage {
+		layers, _ = i.image.CustomLayers(uri)
+	}
+	purged := purgedThumbprints(layers)
+
+	var removeLayers []Command
+	for range max(len(layers), 1) {
+		removeLayers = append(removeLayers, planned(StepRemoveLayer, i.stages.LayerRemover, func(t toolStages) Command { return t.removeLayer(uri) }))
+	}
+	addLayer := planned(StepAddLayer, i.stages.LayerAdder, func(t toolStages) Command { return t.addLayer(uri, PlaceholderDiffOutputFile) })
+
+	if i.options.LayerBuilder != nil {
+		if len(purged) > 0 {
+			return plan, cannotPurgeError(uri, purged)
+		}
+		plan.Commands = append(removeLayers, addLayer)
+		return plan, nil
+	}
+
+	containerId, err := i.ids.ContainerId()
+	if err != nil {
+		return plan, fmt.Errorf("generate container id failed: %s", err)
+	}
+
+	if grootOutput == "" {
+		grootOutput = synthesizedGrootOutput
+	}
+	// The certificates are staged in a directory that is gone once the
+	// plan is printed.
+	plan.Config, err = i.config.Generate(grootOutput, PlaceholderCertsDir, purged)
+	if err != nil {
+		return plan, fmt.Errorf("container config generate failed: %s", err)
+	}
+
+	plan.Commands = append(removeLayers,
+		planned(StepGrootCreate, i.stages.VolumeCreator, func(t toolStages) Command { return t.grootCreate(grootDriverStore, uri, containerId) }),
+		planned(StepWincRun, i.stages.ContainerRunner, func(t toolStages) Command { return t.wincRun(PlaceholderBundleDir, containerId) }),
+		planned(StepDiffExport, i.stages.DiffExporter, func(t toolStages) Command {
+			return t.diffExport(PlaceholderDiffOutputFile, containerId, PlaceholderBundleDir)
+		}),
+		addLayer,
+		planned(StepGrootDelete, i.stages.VolumeCreator, func(t toolStages) Command { return t.grootDelete(grootDriverStore, containerId) }),
+	)
+
+	return plan, nil
+}
@@ -0,0 +1,267 @@
+package injector_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/fakes"
+	"code.cloudfoundry.org/cert-injector/injector"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plan", func() {
+	var (
+		fakeCmd    *fakes.Cmd
+		fakeConfig *fakes.Config
+		fakeBundle *fakes.Bundle
+		fakeLayout *fakes.Image
+		fakeIds    *fakes.Ids
+		fakeLeaks  *fakes.Leaks
+		options    injector.Options
+
+		tools       injector.Tools
+		ociImageUri string
+	)
+
+	BeforeEach(func() {
+		fakeCmd = &fakes.Cmd{}
+		fakeConfig = &fakes.Config{}
+		fakeBundle = &fakes.Bundle{}
+		fakeLayout = &fakes.Image{}
+		fakeIds = &fakes.Ids{Dir: GinkgoT().TempDir()}
+		fakeLeaks = &fakes.Leaks{}
+		options = injector.Options{}
+
+		tools = injector.Tools{Groot: "groot.exe", Winc: "winc.exe", DiffExporter: "diff-exporter.exe", Hydrate: "hydrate.exe"}
+		ociImageUri = "oci:///first-image-uri"
+
+		fakeBundle.DigestCall.Returns = []fakes.DigestCallReturn{{Digest: "sha256:some-digest"}}
+		fakeConfig.GenerateCall.Returns = []fakes.GenerateCallReturn{{Config: []byte(`{"some":"config"}`)}}
+	})
+
+	plan := func(grootOutput string) (injector.Plan, error) {
+		inj := injector.NewInjector(fakeCmd, fakeConfig, fakeBundle, fakeLayout, fakeIds, fakeLeaks, tools, slog.New(slog.NewJSONHandler(&bytes.Buffer{}, nil)), options)
+		return inj.Plan("some-driver-store", ociImageUri, "some-cert-dir", grootOutput)
+	}
+
+	It("returns the commands and config without running or changing anything", func() {
+		p, err := plan(`{"ociVersion":"1.0.2"}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(p.Image).To(Equal(ociImageUri))
+		Expect(p.Digest).To(Equal("sha256:some-digest"))
+		Expect(p.Skip).To(BeFalse())
+		Expect(p.Config).To(MatchJSON(`{"some":"config"}`))
+		Expect(fakeConfig.GenerateCall.Receives[0]).To(Equal(fakes.GenerateCallReceive{GrootOutput: `{"ociVersion":"1.0.2"}`, CertData: injector.PlaceholderCertsDir}))
+
+		var commands []string
+		for _, c := range p.Commands {
+			commands = append(commands, string(c.Step)+": "+c.String())
+		}
+		Expect(commands).To(Equal([]string{
+			"remove-layer: hydrate.exe remove-layer -ociImage oci:///first-image-uri",
+			"groot-create: groot.exe --driver-store some-driver-store create oci:///first-image-uri layer-1",
+			"winc-run: winc.exe run -b <bundle-dir> layer-1",
+			"diff-export: diff-exporter.exe -outputFile <diff-output-file> -containerId layer-1 -bundlePath <bundle-dir>",
+			"add-layer: hydrate.exe add-layer -ociImage oci:///first-image-uri -layer <diff-output-file>",
+			"groot-delete: groot.exe --driver-store some-driver-store delete layer-1",
+		}))
+
+		Expect(fakeCmd.RunCall.CallCount).To(Equal(0))
+		Expect(fakeConfig.WriteCall.CallCount).To(Equal(0))
+		Expect(fakeIds.BundleDirCall.CallCount).To(Equal(0))
+		Expect(fakeIds.DiffOutputFileCall.CallCount).To(Equal(0))
+		Expect(fakeLayout.SnapshotCall.CallCount).To(Equal(0))
+		Expect(fakeLayout.AnnotateLayerCall.CallCount).To(Equal(0))
+	})
+
+	It("synthesizes the groot output when none is given", func() {
+		_, err := plan("")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(fakeConfig.GenerateCall.Receives[0].GrootOutput).To(MatchJSON(`{"ociVersion":"1.0.2","root":{"path":"<volume-path>"},"windows":{"layerFolders":["<layer-folders>"]}}`))
+	})
+
+	Context("when a stage is replaced", func() {
+		BeforeEach(func() {
+			options.Stages.LayerAdder = &fakes.LayerAdder{}
+		})
+
+		It("names the stage in place of the command", func() {
+			p, err := plan("")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Commands).To(HaveLen(6))
+			Expect(p.Commands[1].String()).To(Equal("groot.exe --driver-store some-driver-store create oci:///first-image-uri layer-1"))
+			Expect(p.Commands[4]).To(Equal(injector.Command{Step: injector.StepAddLayer, Executable: "*fakes.LayerAdder"}))
+		})
+	})
+
+	Context("when a layer builder is configured", func() {
+		BeforeEach(func() {
+			options.LayerBuilder = &fakes.LayerBuilder{}
+		})
+
+		It("plans to add the layer it writes without a container", func() {
+			p, err := plan("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Config).To(BeEmpty())
+
+			var commands []string
+			for _, c := range p.Commands {
+				commands = append(commands, string(c.Step)+": "+c.String())
+			}
+			Expect(commands).To(Equal([]string{
+				"remove-layer: hydrate.exe remove-layer -ociImage oci:///first-image-uri",
+				"add-layer: hydrate.exe add-layer -ociImage oci:///first-image-uri -layer <diff-output-file>",
+			}))
+			Expect(fakeConfig.GenerateCall.CallCount).To(Equal(0))
+		})
+	})
+
+	Context("when the image is in a registry", func() {
+		BeforeEach(func() {
+			ociImageUri = "docker://registry.example.com/windows:1809"
+			options.LayerBuilder = &fakes.LayerBuilder{}
+			options.Registry = &fakes.Registry{}
+			options.PullDirectory = "/images"
+			options.PushTag = "1809-certs"
+		})
+
+		It("plans to pull it, change the local copy and push it", func() {
+			p, err := plan("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Image).To(Equal(ociImageUri))
+
+			var commands []string
+			for _, c := range p.Commands {
+				commands = append(commands, string(c.Step)+": "+filepath.ToSlash(c.String()))
+			}
+			dir := "/images/registry.example.com_windows_1809-"
+			Expect(commands).To(HaveLen(4))
+			Expect(commands[0]).To(HavePrefix("pull: *fakes.Registry docker://registry.example.com/windows:1809 " + dir))
+			Expect(commands[1]).To(HavePrefix("remove-layer: hydrate.exe remove-layer -ociImage oci:///images/registry.example.com_windows_1809-"))
+			Expect(commands[3]).To(HavePrefix("push: *fakes.Registry " + dir))
+			Expect(commands[3]).To(HaveSuffix(" docker://registry.example.com/windows:1809 1809-certs"))
+		})
+
+		Context("when a copy pulled earlier already trusts the certificates", func() {
+			var registry *fakes.Registry
+
+			BeforeEach(func() {
+				registry = &fakes.Registry{}
+				registry.ResolveCall.Returns = []fakes.ResolveCallReturn{{Digest: "sha256:remote-manifest"}}
+				options.Registry = registry
+				fakeLayout.LayerAnnotationCall.Returns = []fakes.LayerAnnotationCallReturn{{Value: "sha256:some-digest"}}
+			})
+
+			It("plans to skip the image while the copy is the image in the registry", func() {
+				fakeLayout.ManifestDigestCall.Returns = []fakes.ManifestDigestCallReturn{{Digest: "sha256:remote-manifest"}}
+
+				p, err := plan("")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(p.Skip).To(BeTrue())
+				Expect(registry.ResolveCall.Receives).To(Equal([]fakes.ResolveCallReceive{{URI: ociImageUri}}))
+				Expect(fakeLayout.ManifestDigestCall.Receives[0].URI).To(HavePrefix("oci:///images/registry.example.com_windows_1809-"))
+			})
+
+			It("plans the full pipeline when the image in the registry changed since", func() {
+				fakeLayout.ManifestDigestCall.Returns = []fakes.ManifestDigestCallReturn{{Digest: "sha256:stale-manifest"}}
+
+				p, err := plan("")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(p.Skip).To(BeFalse())
+				Expect(p.Commands).To(HaveLen(4))
+				Expect(fakeLayout.LayerAnnotationCall.CallCount).To(Equal(0))
+				Expect(fakeLayout.CustomLayersCall.CallCount).To(Equal(0))
+			})
+		})
+
+		Context("when the image cannot be resolved", func() {
+			BeforeEach(func() {
+				registry := &fakes.Registry{}
+				registry.ResolveCall.Returns = []fakes.ResolveCallReturn{{Error: errors.New("connection refused")}}
+				options.Registry = registry
+			})
+
+			It("returns a helpful error", func() {
+				_, err := plan("")
+				Expect(err).To(MatchError("resolve docker://registry.example.com/windows:1809 failed: connection refused"))
+			})
+		})
+	})
+
+	Context("when the image has custom layers deleting certificates", func() {
+		BeforeEach(func() {
+			fakeLayout.CustomLayersCall.Returns = []fakes.CustomLayersCallReturn{{Layers: []map[string]string{
+				{injector.RemovedThumbprintsAnnotation: "0123456789ABCDEF0123456789ABCDEF01234567"},
+				{injector.BundleDigestAnnotation: "sha256:old-digest"},
+			}}}
+			fakeConfig.GenerateCall.Returns = []fakes.GenerateCallReturn{{Config: []byte(`{"some":"removal-config"}`)}}
+		})
+
+		It("plans to remove every custom layer and keep deleting the certificates", func() {
+			p, err := plan("")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Commands).To(HaveLen(7))
+			Expect(p.Commands[0].Step).To(Equal(injector.StepRemoveLayer))
+			Expect(p.Commands[1].Step).To(Equal(injector.StepRemoveLayer))
+			Expect(p.Config).To(MatchJSON(`{"some":"removal-config"}`))
+			Expect(fakeConfig.GenerateCall.Receives[0].CertData).To(Equal(injector.PlaceholderCertsDir))
+			Expect(fakeConfig.GenerateCall.Receives[0].Thumbprints).To(Equal([]string{"0123456789ABCDEF0123456789ABCDEF01234567"}))
+		})
+
+		It("refuses to plan a layer builder", func() {
+			options.LayerBuilder = &fakes.LayerBuilder{}
+			_, err := plan("")
+			Expect(err).To(MatchError(ContainSubstring("which a layer builder cannot do")))
+		})
+	})
+
+	Context("when the image already trusts the certificates", func() {
+		BeforeEach(func() {
+			fakeLayout.LayerAnnotationCall.Returns = []fakes.LayerAnnotationCallReturn{{Value: "sha256:some-digest"}}
+		})
+
+		It("plans to skip the image", func() {
+			p, err := plan("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Skip).To(BeTrue())
+			Expect(p.Commands).To(BeEmpty())
+		})
+
+		It("plans the full pipeline when forced", func() {
+			options.Force = true
+			p, err := plan("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Skip).To(BeFalse())
+			Expect(p.Commands).To(HaveLen(6))
+		})
+	})
+
+	Context("when the certificates are invalid", func() {
+		BeforeEach(func() {
+			fakeBundle.ValidateCall.Returns = []fakes.ValidateCallReturn{{Error: errors.New("bad.pem: not a CA certificate")}}
+		})
+
+		It("returns the validation error", func() {
+			_, err := plan("")
+			Expect(err).To(MatchError("certificate validation failed: bad.pem: not a CA certificate"))
+		})
+	})
+
+	Context("when the config cannot be generated", func() {
+		BeforeEach(func() {
+			fakeConfig.GenerateCall.Returns[0].Error = errors.New("json unmarshal groot output: bad")
+		})
+
+		It("returns a helpful error", func() {
+			_, err := plan("$$$")
+			Expect(err).To(MatchError("container config generate failed: json unmarshal groot output: bad"))
+		})
+	})
+})
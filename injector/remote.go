@@ -0,0 +1,111 @@
+package injector
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"code.cloudfoundry.org/cert-injector/layout"
+	"code.cloudfoundry.org/cert-injector/registry"
+)
+
+// Registry moves images between a registry and local OCI image layouts.
+// Resolve returns the digest of the manifest Pull would store.
+type Registry interface {
+	Pull(ctx context.Context, uri, dir string) error
+	Push(ctx context.Context, dir, uri, tag string) error
+	Resolve(ctx context.Context, uri string) (string, error)
+}
+
+func isRemote(uri string) bool {
+	return strings.HasPrefix(uri, registry.Scheme)
+}
+
+// injectRemote pulls the image uri refers to into a layout under the pull
+// directory, injects the certificates into that copy and, when a push tag is
+// set, pushes it back to the repository of uri.
+func (i Injector) injectRemote(ctx context.Context, grootDriverStore, uri, certDirectory string, result *Result) error {
+	log := i.logger.With("image", uri)
+
+	if i.options.Registry == nil {
+		err := errors.New("no registry configured")
+		return stepError(StepPull, err, fmt.Sprintf("pull %s failed: %s", uri, err))
+	}
+
+	dir := i.pullDir(uri)
+	_, _, err := i.run(ctx, log, result, StepPull, func(ctx context.Context) (string, string, error) {
+		return "", "", i.options.Registry.Pull(ctx, uri, dir)
+	})
+	if err != nil {
+		return stepError(StepPull, err, fmt.Sprintf("pull %s failed: %s", uri, err))
+	}
+
+	err = i.injectCert(ctx, grootDriverStore, layout.URI(dir), certDirectory, result)
+	if err != nil || i.options.PushTag == "" {
+		return err
+	}
+
+	// A skipped image is pushed too, so the tag exists after every successful run.
+	_, _, err = i.run(ctx, log, result, StepPush, func(ctx context.Context) (string, string, error) {
+		return "", "", i.options.Registry.Push(ctx, dir, uri, i.options.PushTag)
+	})
+	if err != nil {
+		return stepError(StepPush, err, fmt.Sprintf("push %s to tag %s failed: %s", uri, i.options.PushTag, err))
+	}
+
+	return nil
+}
+
+// planRemote plans the injection into the local copy of uri between pulling
+// and pushing it. Since the image is pulled again before it is changed, a
+// copy pulled earlier is only read while it is still the image in the
+// registry.
+func (i Injector) planRemote(grootDriverStore, uri, certDirectory, grootOutput string) (Plan, error) {
+	if i.options.Registry == nil {
+		return Plan{Image: uri}, errors.New("no registry configured")
+	}
+
+	ctx := context.Background()
+	if timeout := i.options.Timeouts[StepPull]; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	remote, err := i.options.Registry.Resolve(ctx, uri)
+	if err != nil {
+		return Plan{Image: uri}, fmt.Errorf("resolve %s failed: %s", uri, err)
+	}
+
+	dir := i.pullDir(uri)
+	local, err := i.image.ManifestDigest(layout.URI(dir))
+	current := err == nil && local == remote
+
+	plan, err := i.plan(grootDriverStore, layout.URI(dir), certDirectory, grootOutput, current)
+	plan.Image = uri
+	if err != nil || plan.Skip {
+		return plan, err
+	}
+
+	client := fmt.Sprintf("%T", i.options.Registry)
+	plan.Commands = append([]Command{{Step: StepPull, Executable: client, Args: []string{uri, dir}}}, plan.Commands...)
+	if i.options.PushTag != "" {
+		plan.Commands = append(plan.Commands, Command{Step: StepPush, Executable: client, Args: []string{dir, uri, i.options.PushTag}})
+	}
+
+	return plan, nil
+}
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// pullDir is the directory uri is pulled into. The name is readable but
+// ends in a hash of uri, since different uris can sanitize to the same name.
+func (i Injector) pullDir(uri string) string {
+	name := unsafePathChars.ReplaceAllString(strings.TrimPrefix(uri, registry.Scheme), "_")
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(uri)))
+	return filepath.Join(i.options.PullDirectory, name+"-"+hash[:12])
+}
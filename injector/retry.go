@@ -0,0 +1,91 @@
+package injector
+
+import (
+	"errors"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed tool run is attempted again.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt; values below 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is doubled after every failed attempt up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Jitter is the fraction, between 0 and 1, of each backoff that is
+	// randomly taken off so that cells do not retry in lock step.
+	Jitter float64
+
+	// A failure is retried when its exit code is in RetryableExitCodes or its
+	// stderr matches one of RetryableStderr. When both are empty no failure
+	// is retried.
+	RetryableExitCodes []int
+	RetryableStderr    []*regexp.Regexp
+}
+
+// transientStderr matches the errors groot, winc and hydrate report when a
+// file is locked by another process or an antivirus scan, or HCS is busy.
+var transientStderr = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)being used by another process`),
+	regexp.MustCompile(`(?i)another process has locked a portion of the file`),
+	regexp.MustCompile(`(?i)access is denied`),
+	regexp.MustCompile(`(?i)the requested resource is in use`),
+	regexp.MustCompile(`(?i)a response was not received from the virtual machine or container`),
+}
+
+// DefaultRetries returns the retry policies for the steps known to fail
+// transiently because of file locks, busy HCS or antivirus scans. Only
+// those failures are retried; any other failure is deterministic.
+func DefaultRetries() map[Step]RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:     3,
+		InitialBackoff:  5 * time.Second,
+		MaxBackoff:      time.Minute,
+		Jitter:          0.2,
+		RetryableStderr: transientStderr,
+	}
+
+	return map[Step]RetryPolicy{
+		StepGrootCreate: policy,
+		StepWincRun:     policy,
+		StepAddLayer:    policy,
+	}
+}
+
+func (p RetryPolicy) retryable(err error, stderr string) bool {
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) && slices.Contains(p.RetryableExitCodes, exitErr.ExitCode()) {
+		return true
+	}
+
+	for _, pattern := range p.RetryableStderr {
+		if pattern.MatchString(stderr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns how long to wait after the given failed attempt, counting from 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for n := 1; n < attempt && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); n++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 && delay > 0 {
+		// #nosec G404 - jitter does not need a cryptographic source
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+
+	return delay
+}
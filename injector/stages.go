@@ -0,0 +1,144 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+)
+
+// LayerRemover removes the custom certificate layer from an image.
+type LayerRemover interface {
+	RemoveLayer(ctx context.Context, uri string) (stdout, stderr string, err error)
+}
+
+// VolumeCreator creates a volume for a container from an image and deletes
+// it again. The stdout of CreateVolume is the runtime spec of the volume.
+type VolumeCreator interface {
+	CreateVolume(ctx context.Context, driverStore, uri, containerId string) (stdout, stderr string, err error)
+	DeleteVolume(ctx context.Context, driverStore, containerId string) (stdout, stderr string, err error)
+}
+
+// ContainerRunner runs a container from the bundle in bundleDir until it
+// exits. DeleteContainer deletes what a failed run left behind.
+type ContainerRunner interface {
+	RunContainer(ctx context.Context, bundleDir, containerId string) (stdout, stderr string, err error)
+	DeleteContainer(ctx context.Context, containerId string) (stdout, stderr string, err error)
+}
+
+// DiffExporter writes the changes a container made to its volume to
+// outputFile as a layer.
+type DiffExporter interface {
+	ExportDiff(ctx context.Context, outputFile, containerId, bundleDir string) (stdout, stderr string, err error)
+}
+
+// LayerAdder adds the layer in layerFile to the top of an image.
+type LayerAdder interface {
+	AddLayer(ctx context.Context, uri, layerFile string) (stdout, stderr string, err error)
+}
+
+// Stages are the parts of the pipeline that change images, volumes and
+// containers. Stages that are not set run the tools in Tools.
+type Stages struct {
+	LayerRemover    LayerRemover
+	VolumeCreator   VolumeCreator
+	ContainerRunner ContainerRunner
+	DiffExporter    DiffExporter
+	LayerAdder      LayerAdder
+}
+
+// withDefaults returns a copy of s with every stage that is not set backed
+// by the tools.
+func (s Stages) withDefaults(cmd cmd, tools Tools) Stages {
+	cli := toolStages{cmd: cmd, tools: tools}
+	if s.LayerRemover == nil {
+		s.LayerRemover = cli
+	}
+	if s.VolumeCreator == nil {
+		s.VolumeCreator = cli
+	}
+	if s.ContainerRunner == nil {
+		s.ContainerRunner = cli
+	}
+	if s.DiffExporter == nil {
+		s.DiffExporter = cli
+	}
+	if s.LayerAdder == nil {
+		s.LayerAdder = cli
+	}
+	return s
+}
+
+// toolStages implements every stage by running hydrate, groot, winc and
+// diff-exporter.
+type toolStages struct {
+	cmd   cmd
+	tools Tools
+}
+
+func (t toolStages) RemoveLayer(ctx context.Context, uri string) (string, string, error) {
+	return t.run(ctx, t.removeLayer(uri))
+}
+
+func (t toolStages) CreateVolume(ctx context.Context, driverStore, uri, containerId string) (string, string, error) {
+	return t.run(ctx, t.grootCreate(driverStore, uri, containerId))
+}
+
+func (t toolStages) DeleteVolume(ctx context.Context, driverStore, containerId string) (string, string, error) {
+	return t.run(ctx, t.grootDelete(driverStore, containerId))
+}
+
+func (t toolStages) RunContainer(ctx context.Context, bundleDir, containerId string) (string, string, error) {
+	return t.run(ctx, t.wincRun(bundleDir, containerId))
+}
+
+func (t toolStages) DeleteContainer(ctx context.Context, containerId string) (string, string, error) {
+	return t.run(ctx, t.wincDelete(containerId))
+}
+
+func (t toolStages) ExportDiff(ctx context.Context, outputFile, containerId, bundleDir string) (string, string, error) {
+	return t.run(ctx, t.diffExport(outputFile, containerId, bundleDir))
+}
+
+func (t toolStages) AddLayer(ctx context.Context, uri, layerFile string) (string, string, error) {
+	return t.run(ctx, t.addLayer(uri, layerFile))
+}
+
+func (t toolStages) run(ctx context.Context, c Command) (string, string, error) {
+	return t.cmd.Run(ctx, c.Executable, c.Args...)
+}
+
+func (t toolStages) removeLayer(uri string) Command {
+	return Command{StepRemoveLayer, t.tools.Hydrate, []string{"remove-layer", "-ociImage", uri}}
+}
+
+func (t toolStages) grootCreate(grootDriverStore, uri, containerId string) Command {
+	return Command{StepGrootCreate, t.tools.Groot, []string{"--driver-store", grootDriverStore, "create", uri, containerId}}
+}
+
+func (t toolStages) wincRun(bundleDir, containerId string) Command {
+	return Command{StepWincRun, t.tools.Winc, []string{"run", "-b", bundleDir, containerId}}
+}
+
+func (t toolStages) wincDelete(containerId string) Command {
+	return Command{StepWincRun, t.tools.Winc, []string{"delete", containerId}}
+}
+
+func (t toolStages) diffExport(diffOutputFile, containerId, bundleDir string) Command {
+	return Command{StepDiffExport, t.tools.DiffExporter, []string{"-outputFile", diffOutputFile, "-containerId", containerId, "-bundlePath", bundleDir}}
+}
+
+func (t toolStages) addLayer(uri, diffOutputFile string) Command {
+	return Command{StepAddLayer, t.tools.Hydrate, []string{"add-layer", "-ociImage", uri, "-layer", diffOutputFile}}
+}
+
+func (t toolStages) grootDelete(grootDriverStore, containerId string) Command {
+	return Command{StepGrootDelete, t.tools.Groot, []string{"--driver-store", grootDriverStore, "delete", containerId}}
+}
+
+// planned returns the command the stage for step would run. A stage that
+// does not run a tool is shown by its type.
+func planned(step Step, stage any, command func(toolStages) Command) Command {
+	if cli, ok := stage.(toolStages); ok {
+		return command(cli)
+	}
+	return Command{Step: step, Executable: fmt.Sprintf("%T", stage)}
+}
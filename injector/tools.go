@@ -0,0 +1,102 @@
+package injector
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+const (
+	grootBin        = "c:\\var\\vcap\\packages\\groot\\groot.exe"
+	wincBin         = "c:\\var\\vcap\\packages\\winc\\winc.exe"
+	diffExporterBin = "c:\\var\\vcap\\packages\\diff-exporter\\diff-exporter.exe"
+	hydrateBin      = "c:\\var\\vcap\\packages\\hydrate\\hydrate.exe"
+)
+
+// Tools holds the paths of the executables the injector shells out to.
+type Tools struct {
+	Groot        string `json:"groot,omitempty"`
+	Winc         string `json:"winc,omitempty"`
+	DiffExporter string `json:"diff_exporter,omitempty"`
+	Hydrate      string `json:"hydrate,omitempty"`
+}
+
+// DefaultTools returns the paths the tools are installed at by winc-release.
+func DefaultTools() Tools {
+	return Tools{
+		Groot:        grootBin,
+		Winc:         wincBin,
+		DiffExporter: diffExporterBin,
+		Hydrate:      hydrateBin,
+	}
+}
+
+// Merge returns a copy of t with every non-empty path in overrides applied.
+func (t Tools) Merge(overrides Tools) Tools {
+	if overrides.Groot != "" {
+		t.Groot = overrides.Groot
+	}
+	if overrides.Winc != "" {
+		t.Winc = overrides.Winc
+	}
+	if overrides.DiffExporter != "" {
+		t.DiffExporter = overrides.DiffExporter
+	}
+	if overrides.Hydrate != "" {
+		t.Hydrate = overrides.Hydrate
+	}
+	return t
+}
+
+// Check verifies that every tool exists and is executable, and reports all
+// problems at once. Tools named in unused, such as "hydrate" when its stages
+// are replaced, are not checked.
+func (t Tools) Check(unused ...string) error {
+	var problems []string
+	for _, tool := range []struct{ name, path string }{
+		{"groot", t.Groot},
+		{"winc", t.Winc},
+		{"diff-exporter", t.DiffExporter},
+		{"hydrate", t.Hydrate},
+	} {
+		if slices.Contains(unused, tool.name) {
+			continue
+		}
+
+		err := checkExecutable(tool.path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", tool.name, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid tools: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func checkExecutable(path string) error {
+	if path == "" {
+		return fmt.Errorf("path is not set")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s does not exist", path)
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	// LookPath checks the execute bits on unix and the file extension on windows.
+	_, err = exec.LookPath(path)
+	if err != nil {
+		return fmt.Errorf("%s is not executable", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package injector_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/injector"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tools", func() {
+	It("defaults to the winc-release package paths", func() {
+		Expect(injector.DefaultTools()).To(Equal(injector.Tools{
+			Groot:        "c:\\var\\vcap\\packages\\groot\\groot.exe",
+			Winc:         "c:\\var\\vcap\\packages\\winc\\winc.exe",
+			DiffExporter: "c:\\var\\vcap\\packages\\diff-exporter\\diff-exporter.exe",
+			Hydrate:      "c:\\var\\vcap\\packages\\hydrate\\hydrate.exe",
+		}))
+	})
+
+	It("merges non-empty overrides", func() {
+		tools := injector.DefaultTools().Merge(injector.Tools{Winc: "/some/winc"})
+		Expect(tools.Winc).To(Equal("/some/winc"))
+		Expect(tools.Groot).To(Equal(injector.DefaultTools().Groot))
+	})
+
+	Describe("Check", func() {
+		var (
+			toolsDir   string
+			executable string
+		)
+
+		BeforeEach(func() {
+			var err error
+			toolsDir, err = os.MkdirTemp("", "cert-injector-tools-test-*")
+			Expect(err).NotTo(HaveOccurred())
+
+			executable = filepath.Join(toolsDir, "tool.exe")
+			Expect(os.WriteFile(executable, []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(toolsDir)).To(Succeed())
+		})
+
+		It("succeeds when every tool exists and is executable", func() {
+			tools := injector.Tools{Groot: executable, Winc: executable, DiffExporter: executable, Hydrate: executable}
+			Expect(tools.Check()).To(Succeed())
+		})
+
+		It("reports every missing or non-executable tool", func() {
+			notExecutable := filepath.Join(toolsDir, "tool.txt")
+			Expect(os.WriteFile(notExecutable, []byte("text"), 0644)).To(Succeed())
+			missing := filepath.Join(toolsDir, "missing.exe")
+
+			tools := injector.Tools{Groot: missing, Winc: executable, DiffExporter: notExecutable, Hydrate: toolsDir}
+			Expect(tools.Check()).To(MatchError(
+				"invalid tools: groot: " + missing + " does not exist; diff-exporter: " + notExecutable + " is not executable; hydrate: " + toolsDir + " is a directory",
+			))
+		})
+
+		It("skips the tools that are not used", func() {
+			tools := injector.Tools{Groot: executable, Winc: executable}
+			Expect(tools.Check("diff-exporter", "hydrate")).To(Succeed())
+		})
+	})
+})
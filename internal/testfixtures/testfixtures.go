@@ -0,0 +1,118 @@
+// Package testfixtures builds the certificates and OCI image layouts shared
+// by the tests of several packages. Failures are reported with gomega, so it
+// may only be used from a suite that registered a fail handler.
+package testfixtures
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/layout"
+	. "github.com/onsi/gomega"
+)
+
+// GenerateCert returns a DER encoded self-signed certificate.
+func GenerateCert(commonName string, isCA bool, notBefore, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return der
+}
+
+// GenerateCA returns a DER encoded self-signed CA certificate that is valid
+// for an hour either side of now.
+func GenerateCA(commonName string) []byte {
+	return GenerateCert(commonName, true, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// ToPEM returns the DER encoded certificates as a PEM bundle.
+func ToPEM(der ...[]byte) []byte {
+	var out []byte
+	for _, d := range der {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: d})...)
+	}
+	return out
+}
+
+// WriteBlob stores data in the OCI image layout in dir and returns its
+// digest.
+func WriteBlob(dir string, data []byte) string {
+	hex := fmt.Sprintf("%x", sha256.Sum256(data))
+	Expect(os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, "blobs", "sha256", hex), data, 0644)).To(Succeed())
+	return "sha256:" + hex
+}
+
+// WriteJSONBlob stores v as JSON in the OCI image layout in dir and returns
+// its digest and size.
+func WriteJSONBlob(dir string, v interface{}) (string, int64) {
+	data, err := json.Marshal(v)
+	Expect(err).NotTo(HaveOccurred())
+	return WriteBlob(dir, data), int64(len(data))
+}
+
+// WriteImage creates an OCI image layout in dir with one manifest whose
+// layers contain the given data, and returns the layer digests.
+func WriteImage(dir string, layers ...string) []string {
+	Expect(os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)).To(Succeed())
+
+	manifest := layout.Manifest{SchemaVersion: 2, MediaType: layout.MediaTypeImageManifest}
+	var digests []string
+	var diffIDs []string
+	for _, l := range layers {
+		digest := WriteBlob(dir, []byte(l))
+		digests = append(digests, digest)
+		diffIDs = append(diffIDs, digest)
+		manifest.Layers = append(manifest.Layers, layout.Descriptor{
+			MediaType: layout.MediaTypeLayer,
+			Digest:    digest,
+			Size:      int64(len(l)),
+		})
+	}
+
+	configDigest, configSize := WriteJSONBlob(dir, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "windows",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	manifest.Config = layout.Descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: configDigest, Size: configSize}
+
+	manifestDigest, manifestSize := WriteJSONBlob(dir, manifest)
+	index := layout.Index{SchemaVersion: 2, Manifests: []layout.Descriptor{{
+		MediaType: layout.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}}
+
+	data, err := json.Marshal(index)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.WriteFile(filepath.Join(dir, "index.json"), data, 0644)).To(Succeed())
+
+	return digests
+}
@@ -0,0 +1,18 @@
+package layout_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLayout(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Layout Suite")
+}
+
+func blobFile(dir, digest string) string {
+	return filepath.Join(dir, "blobs", "sha256", digest[len("sha256:"):])
+}
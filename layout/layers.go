@@ -0,0 +1,376 @@
+package layout
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/cert-injector/winlayer"
+)
+
+const (
+	MediaTypeLayer           = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip       = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// AddedLayerAnnotation marks the layers added by AddLayer.
+const AddedLayerAnnotation = "org.cloudfoundry.cert-injector.layer-added"
+
+// customLayerAnnotationPrefix is shared by every annotation cert-injector
+// puts on a layer, which is how RemoveLayer recognises the layers it may
+// remove, including those added by hydrate and annotated afterwards.
+const customLayerAnnotationPrefix = "org.cloudfoundry.cert-injector."
+
+// AddLayer adds the layer tar in layerFile, gzipped or not, to the top of
+// the image: the tar is stored as a blob, its diff_id is appended to the
+// config and index.json is pointed at a new manifest. Blobs are written
+// before index.json is replaced, so readers see either the old or the new
+// image.
+func (l Layout) AddLayer(ctx context.Context, uri, layerFile string) (string, string, error) {
+	dir, err := Path(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	index, position, manifest, err := ReadManifest(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Docker manifests, as pulled from registries, only allow docker media
+	// types, and registries only accept gzipped docker layers.
+	docker := manifest.MediaType == MediaTypeDockerManifest
+	layer, diffID, err := writeLayerBlob(dir, layerFile, docker)
+	if err != nil {
+		return "", "", err
+	}
+	layer.Annotations = map[string]string{AddedLayerAnnotation: "true"}
+	if docker {
+		layer.MediaType = MediaTypeDockerLayerGzip
+	}
+
+	err = updateConfig(dir, &manifest, func(diffIDs []string, history []map[string]json.RawMessage) ([]string, []map[string]json.RawMessage, error) {
+		if history != nil {
+			history = append(history, map[string]json.RawMessage{"created_by": json.RawMessage(`"cert-injector"`)})
+		}
+		return append(diffIDs, diffID), history, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+
+	err = writeManifest(dir, index, position, manifest)
+	if err != nil {
+		return "", "", err
+	}
+
+	return fmt.Sprintf("added layer %s to %s\n", layer.Digest, uri), "", nil
+}
+
+// RemoveLayer removes the top layer of the image when cert-injector added
+// it, and leaves the image alone otherwise. It fails instead when the top
+// layer trusts certificates but carries no annotation. The blob of the layer
+// is kept since snapshots may still refer to it.
+func (l Layout) RemoveLayer(ctx context.Context, uri string) (string, string, error) {
+	dir, err := Path(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	index, position, manifest, err := ReadManifest(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(manifest.Layers) == 0 {
+		return fmt.Sprintf("%s has no custom layer\n", uri), "", nil
+	}
+	top := manifest.Layers[len(manifest.Layers)-1]
+	if !isCustomLayer(top) {
+		if thumbprints := unannotatedCertificates(dir, top); len(thumbprints) > 0 {
+			return "", "", fmt.Errorf("the top layer of %s trusts certificates %s but has no cert-injector annotation, so it may have been added by hydrate before cert-injector annotated its layers: remove it once with --layout-writer hydrate", uri, strings.Join(thumbprints, ", "))
+		}
+		return fmt.Sprintf("%s has no custom layer\n", uri), "", nil
+	}
+
+	err = updateConfig(dir, &manifest, func(diffIDs []string, history []map[string]json.RawMessage) ([]string, []map[string]json.RawMessage, error) {
+		if len(diffIDs) != len(manifest.Layers) {
+			return nil, nil, fmt.Errorf("config has %d diff_ids for %d layers", len(diffIDs), len(manifest.Layers))
+		}
+
+		// History entries of empty layers do not count towards the layers.
+		for n := len(history) - 1; n >= 0; n-- {
+			if string(history[n]["empty_layer"]) != "true" {
+				history = append(history[:n], history[n+1:]...)
+				break
+			}
+		}
+
+		return diffIDs[:len(diffIDs)-1], history, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	manifest.Layers = manifest.Layers[:len(manifest.Layers)-1]
+
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+
+	err = writeManifest(dir, index, position, manifest)
+	if err != nil {
+		return "", "", err
+	}
+
+	return fmt.Sprintf("removed layer %s from %s\n", top.Digest, uri), "", nil
+}
+
+// CustomLayers returns the annotations of the layers cert-injector added on
+// top of the image, top layer first. The first layer it did not add ends the
+// list, so layers below a base layer are never included.
+func (l Layout) CustomLayers(uri string) ([]map[string]string, error) {
+	dir, err := Path(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, manifest, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var annotations []map[string]string
+	for n := len(manifest.Layers) - 1; n >= 0 && isCustomLayer(manifest.Layers[n]); n-- {
+		annotations = append(annotations, manifest.Layers[n].Annotations)
+	}
+
+	return annotations, nil
+}
+
+// unannotatedCertificates returns the thumbprints of the certificates layer
+// adds to the root store, if it can be read as a Windows layer at all. Such
+// a layer may have been added by hydrate before cert-injector annotated its
+// layers, but it may as well be part of the image, so RemoveLayer does not
+// guess which.
+func unannotatedCertificates(dir string, layer Descriptor) []string {
+	path, err := BlobPath(dir, layer.Digest)
+	if err != nil {
+		return nil
+	}
+
+	thumbprints, err := winlayer.Thumbprints(path)
+	if err != nil {
+		return nil
+	}
+	return thumbprints
+}
+
+func isCustomLayer(layer Descriptor) bool {
+	for key := range layer.Annotations {
+		if strings.HasPrefix(key, customLayerAnnotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateConfig rewrites the rootfs.diff_ids and history of the config of
+// manifest with update, stores the result as a new blob and points the
+// manifest at it. Every other field of the config is kept as is.
+func updateConfig(dir string, manifest *Manifest, update func(diffIDs []string, history []map[string]json.RawMessage) ([]string, []map[string]json.RawMessage, error)) error {
+	path, err := BlobPath(dir, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	var config map[string]json.RawMessage
+	err = readJSON(path, &config)
+	if err != nil {
+		return err
+	}
+
+	var rootfs map[string]json.RawMessage
+	if raw, ok := config["rootfs"]; ok {
+		if err := json.Unmarshal(raw, &rootfs); err != nil {
+			return fmt.Errorf("json unmarshal config rootfs: %s", err)
+		}
+	}
+	if rootfs == nil {
+		rootfs = map[string]json.RawMessage{"type": json.RawMessage(`"layers"`)}
+	}
+
+	var diffIDs []string
+	if raw, ok := rootfs["diff_ids"]; ok {
+		if err := json.Unmarshal(raw, &diffIDs); err != nil {
+			return fmt.Errorf("json unmarshal config diff_ids: %s", err)
+		}
+	}
+
+	var history []map[string]json.RawMessage
+	if raw, ok := config["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return fmt.Errorf("json unmarshal config history: %s", err)
+		}
+	}
+
+	diffIDs, history, err = update(diffIDs, history)
+	if err != nil {
+		return err
+	}
+
+	rootfs["diff_ids"], err = json.Marshal(diffIDs)
+	if err != nil {
+		return err
+	}
+	config["rootfs"], err = json.Marshal(rootfs)
+	if err != nil {
+		return err
+	}
+	if history != nil {
+		config["history"], err = json.Marshal(history)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("json marshal config: %s", err)
+	}
+
+	digest, err := WriteBlob(dir, data)
+	if err != nil {
+		return err
+	}
+
+	manifest.Config.Digest = digest
+	manifest.Config.Size = int64(len(data))
+	return nil
+}
+
+// writeLayerBlob copies layerFile into the blobs of the layout and returns
+// its descriptor and diff_id, the digest of the uncompressed tar. With
+// compress an uncompressed tar is stored gzipped.
+func writeLayerBlob(dir, layerFile string, compress bool) (Descriptor, string, error) {
+	in, err := os.Open(layerFile)
+	if err != nil {
+		return Descriptor{}, "", fmt.Errorf("open layer: %s", err)
+	}
+	defer in.Close()
+
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	err = os.MkdirAll(blobs, 0755)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+
+	tmp, err := os.CreateTemp(blobs, ".layer-*")
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), in)
+	if err != nil {
+		tmp.Close()
+		return Descriptor{}, "", fmt.Errorf("copy layer: %s", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	desc := Descriptor{MediaType: MediaTypeLayer, Digest: digest, Size: size}
+	diffID := digest
+
+	_, err = in.Seek(0, io.SeekStart)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+
+	gz, err := gzip.NewReader(in)
+	if err == nil {
+		uncompressed := sha256.New()
+		_, err = io.Copy(uncompressed, gz)
+		if err != nil {
+			return Descriptor{}, "", fmt.Errorf("decompress layer: %s", err)
+		}
+		desc.MediaType = MediaTypeLayerGzip
+		diffID = fmt.Sprintf("sha256:%x", uncompressed.Sum(nil))
+	}
+
+	blob := tmp.Name()
+	if compress && desc.MediaType == MediaTypeLayer {
+		blob, desc.Digest, desc.Size, err = gzipFile(blobs, tmp.Name())
+		if err != nil {
+			return Descriptor{}, "", fmt.Errorf("compress layer: %s", err)
+		}
+		defer os.Remove(blob)
+		desc.MediaType = MediaTypeLayerGzip
+	}
+
+	path, err := BlobPath(dir, desc.Digest)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+
+	err = os.Rename(blob, path)
+	if err != nil {
+		return Descriptor{}, "", fmt.Errorf("write blob %s: %s", desc.Digest, err)
+	}
+
+	return desc, diffID, nil
+}
+
+// gzipFile writes a gzipped copy of src to a new temporary file in dir and
+// returns its path, digest and size.
+func gzipFile(dir, src string) (string, string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(dir, ".layer-*")
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	hash := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, hash))
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", 0, err
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", 0, err
+	}
+
+	return tmp.Name(), fmt.Sprintf("sha256:%x", hash.Sum(nil)), info.Size(), nil
+}
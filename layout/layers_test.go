@@ -0,0 +1,325 @@
+package layout_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/internal/testfixtures"
+	"code.cloudfoundry.org/cert-injector/layout"
+	"code.cloudfoundry.org/cert-injector/winlayer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AddLayer and RemoveLayer", func() {
+	var (
+		imageDir     string
+		uri          string
+		layerDigests []string
+		l            layout.Layout
+	)
+
+	BeforeEach(func() {
+		imageDir = GinkgoT().TempDir()
+		uri = layout.URI(imageDir)
+		layerDigests = testfixtures.WriteImage(imageDir, "base-layer")
+		l = layout.NewLayout()
+	})
+
+	// readImage returns the manifest and config index.json points at,
+	// checking that every digest and size matches the blob it names.
+	readImage := func() (layout.Manifest, map[string]interface{}) {
+		readBlob := func(desc layout.Descriptor) []byte {
+			data, err := os.ReadFile(blobFile(imageDir, desc.Digest))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(desc.Digest).To(Equal(fmt.Sprintf("sha256:%x", sha256.Sum256(data))))
+			Expect(desc.Size).To(Equal(int64(len(data))))
+			return data
+		}
+
+		data, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+		Expect(err).NotTo(HaveOccurred())
+		var index layout.Index
+		Expect(json.Unmarshal(data, &index)).To(Succeed())
+
+		var manifest layout.Manifest
+		Expect(json.Unmarshal(readBlob(index.Manifests[0]), &manifest)).To(Succeed())
+		for _, layer := range manifest.Layers {
+			readBlob(layer)
+		}
+
+		var config map[string]interface{}
+		Expect(json.Unmarshal(readBlob(manifest.Config), &config)).To(Succeed())
+
+		return manifest, config
+	}
+
+	// rewriteImage lets edit change the manifest and config of the image.
+	rewriteImage := func(edit func(manifest *layout.Manifest, config map[string]interface{})) {
+		manifest, config := readImage()
+		edit(&manifest, config)
+
+		configDigest, configSize := testfixtures.WriteJSONBlob(imageDir, config)
+		manifest.Config.Digest = configDigest
+		manifest.Config.Size = configSize
+
+		manifestDigest, manifestSize := testfixtures.WriteJSONBlob(imageDir, manifest)
+		data, err := json.Marshal(layout.Index{SchemaVersion: 2, Manifests: []layout.Descriptor{{
+			MediaType: manifest.MediaType,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(imageDir, "index.json"), data, 0644)).To(Succeed())
+	}
+
+	diffIDs := func(config map[string]interface{}) []interface{} {
+		return config["rootfs"].(map[string]interface{})["diff_ids"].([]interface{})
+	}
+
+	writeLayerFile := func(data []byte) string {
+		path := filepath.Join(GinkgoT().TempDir(), "layer.tgz")
+		Expect(os.WriteFile(path, data, 0644)).To(Succeed())
+		return path
+	}
+
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gz.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	It("adds a gzipped layer with the diff_id of the uncompressed tar", func() {
+		compressed := gzipped([]byte("custom-layer"))
+
+		stdout, _, err := l.AddLayer(context.Background(), uri, writeLayerFile(compressed))
+		Expect(err).NotTo(HaveOccurred())
+
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(compressed))
+		Expect(stdout).To(ContainSubstring("added layer " + digest))
+
+		manifest, config := readImage()
+		Expect(manifest.Layers).To(HaveLen(2))
+		Expect(manifest.Layers[1]).To(Equal(layout.Descriptor{
+			MediaType:   layout.MediaTypeLayerGzip,
+			Digest:      digest,
+			Size:        int64(len(compressed)),
+			Annotations: map[string]string{layout.AddedLayerAnnotation: "true"},
+		}))
+
+		Expect(diffIDs(config)).To(Equal([]interface{}{layerDigests[0], fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("custom-layer")))}))
+		Expect(config).To(HaveKeyWithValue("os", "windows"))
+		Expect(config).To(HaveKeyWithValue("architecture", "amd64"))
+		Expect(config).NotTo(HaveKey("history"))
+
+		By("leaving no temporary files in the layout")
+		entries, err := os.ReadDir(filepath.Join(imageDir, "blobs", "sha256"))
+		Expect(err).NotTo(HaveOccurred())
+		for _, entry := range entries {
+			Expect(entry.Name()).NotTo(HavePrefix("."))
+		}
+	})
+
+	It("adds an uncompressed layer with its digest as diff_id", func() {
+		_, _, err := l.AddLayer(context.Background(), uri, writeLayerFile([]byte("custom-layer")))
+		Expect(err).NotTo(HaveOccurred())
+
+		manifest, config := readImage()
+		Expect(manifest.Layers[1].MediaType).To(Equal(layout.MediaTypeLayer))
+		Expect(diffIDs(config)[1]).To(Equal(manifest.Layers[1].Digest))
+	})
+
+	It("removes the layer it added", func() {
+		originalManifest, originalConfig := readImage()
+
+		_, _, err := l.AddLayer(context.Background(), uri, writeLayerFile(gzipped([]byte("custom-layer"))))
+		Expect(err).NotTo(HaveOccurred())
+
+		stdout, _, err := l.RemoveLayer(context.Background(), uri)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stdout).To(ContainSubstring("removed layer sha256:"))
+
+		manifest, config := readImage()
+		Expect(manifest).To(Equal(originalManifest))
+		Expect(config).To(Equal(originalConfig))
+	})
+
+	It("removes a layer annotated by cert-injector", func() {
+		testfixtures.WriteImage(imageDir, "base-layer", "hydrated-layer")
+		Expect(l.AnnotateLayer(uri, "org.cloudfoundry.cert-injector.bundle-digest", "sha256:some-digest")).To(Succeed())
+
+		_, _, err := l.RemoveLayer(context.Background(), uri)
+		Expect(err).NotTo(HaveOccurred())
+
+		manifest, config := readImage()
+		Expect(manifest.Layers).To(HaveLen(1))
+		Expect(diffIDs(config)).To(Equal([]interface{}{layerDigests[0]}))
+	})
+
+	It("leaves an image without a custom layer alone", func() {
+		original, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+		Expect(err).NotTo(HaveOccurred())
+
+		stdout, _, err := l.RemoveLayer(context.Background(), uri)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stdout).To(ContainSubstring("has no custom layer"))
+
+		current, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(current).To(Equal(original))
+	})
+
+	It("lists the annotations of the custom layers on top of the image", func() {
+		layers, err := l.CustomLayers(uri)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(BeEmpty())
+
+		_, _, err = l.AddLayer(context.Background(), uri, writeLayerFile([]byte("first-custom-layer")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.AnnotateLayer(uri, "org.cloudfoundry.cert-injector.removed-thumbprints", "SOME-THUMBPRINT")).To(Succeed())
+		_, _, err = l.AddLayer(context.Background(), uri, writeLayerFile([]byte("second-custom-layer")))
+		Expect(err).NotTo(HaveOccurred())
+
+		layers, err = l.CustomLayers(uri)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(layers).To(Equal([]map[string]string{
+			{layout.AddedLayerAnnotation: "true"},
+			{layout.AddedLayerAnnotation: "true", "org.cloudfoundry.cert-injector.removed-thumbprints": "SOME-THUMBPRINT"},
+		}))
+	})
+
+	Context("when the top layer trusts certificates but carries no annotation", func() {
+		var thumbprint string
+
+		BeforeEach(func() {
+			der := testfixtures.GenerateCA("some-ca")
+			thumbprint = fmt.Sprintf("%X", sha1.Sum(der))
+			certDirectory := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(certDirectory, "ca.crt"), der, 0644)).To(Succeed())
+			layerFile := filepath.Join(GinkgoT().TempDir(), "layer.tgz")
+			Expect(winlayer.NewBuilder().BuildLayer(layerFile, certDirectory)).To(Succeed())
+
+			_, _, err := l.AddLayer(context.Background(), uri, layerFile)
+			Expect(err).NotTo(HaveOccurred())
+			rewriteImage(func(manifest *layout.Manifest, config map[string]interface{}) {
+				manifest.Layers[1].Annotations = nil
+			})
+		})
+
+		It("refuses to guess whether hydrate added it and leaves the image alone", func() {
+			original, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = l.RemoveLayer(context.Background(), uri)
+			Expect(err).To(MatchError(And(
+				ContainSubstring("trusts certificates "+thumbprint+" but has no cert-injector annotation"),
+				ContainSubstring("remove it once with --layout-writer hydrate"),
+			)))
+
+			current, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(current).To(Equal(original))
+		})
+	})
+
+	Context("when the config has a history", func() {
+		BeforeEach(func() {
+			rewriteImage(func(manifest *layout.Manifest, config map[string]interface{}) {
+				config["history"] = []interface{}{
+					map[string]interface{}{"created_by": "base"},
+					map[string]interface{}{"created_by": "ENV FOO=bar", "empty_layer": true},
+				}
+			})
+		})
+
+		It("keeps one history entry per layer", func() {
+			_, _, err := l.AddLayer(context.Background(), uri, writeLayerFile([]byte("custom-layer")))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, config := readImage()
+			Expect(config["history"]).To(HaveLen(3))
+			Expect(config["history"].([]interface{})[2]).To(Equal(map[string]interface{}{"created_by": "cert-injector"}))
+
+			_, _, err = l.RemoveLayer(context.Background(), uri)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, config = readImage()
+			Expect(config["history"]).To(Equal([]interface{}{
+				map[string]interface{}{"created_by": "base"},
+				map[string]interface{}{"created_by": "ENV FOO=bar", "empty_layer": true},
+			}))
+		})
+	})
+
+	Context("when the image has a docker manifest", func() {
+		BeforeEach(func() {
+			rewriteImage(func(manifest *layout.Manifest, config map[string]interface{}) {
+				manifest.MediaType = layout.MediaTypeDockerManifest
+			})
+		})
+
+		It("adds a gzipped layer with the docker media type", func() {
+			_, _, err := l.AddLayer(context.Background(), uri, writeLayerFile(gzipped([]byte("custom-layer"))))
+			Expect(err).NotTo(HaveOccurred())
+
+			manifest, _ := readImage()
+			Expect(manifest.Layers[1].MediaType).To(Equal(layout.MediaTypeDockerLayerGzip))
+		})
+
+		It("gzips an uncompressed layer, since registries reject uncompressed docker layers", func() {
+			_, _, err := l.AddLayer(context.Background(), uri, writeLayerFile([]byte("custom-layer")))
+			Expect(err).NotTo(HaveOccurred())
+
+			manifest, config := readImage()
+			Expect(manifest.Layers[1].MediaType).To(Equal(layout.MediaTypeDockerLayerGzip))
+			Expect(diffIDs(config)[1]).To(Equal(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("custom-layer")))))
+
+			data, err := os.ReadFile(blobFile(imageDir, manifest.Layers[1].Digest))
+			Expect(err).NotTo(HaveOccurred())
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(gz)).To(Equal([]byte("custom-layer")))
+
+			By("leaving no temporary files in the layout")
+			entries, err := os.ReadDir(filepath.Join(imageDir, "blobs", "sha256"))
+			Expect(err).NotTo(HaveOccurred())
+			for _, entry := range entries {
+				Expect(entry.Name()).NotTo(HavePrefix("."))
+			}
+		})
+	})
+
+	Context("when the layer file does not exist", func() {
+		It("returns an error and leaves the image alone", func() {
+			_, _, err := l.AddLayer(context.Background(), uri, filepath.Join(imageDir, "missing.tgz"))
+			Expect(err).To(MatchError(ContainSubstring("open layer")))
+
+			manifest, _ := readImage()
+			Expect(manifest.Layers).To(HaveLen(1))
+		})
+	})
+
+	Context("when the context is done", func() {
+		It("does not change the image", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, _, err := l.AddLayer(ctx, uri, writeLayerFile([]byte("custom-layer")))
+			Expect(err).To(MatchError(context.Canceled))
+
+			manifest, _ := readImage()
+			Expect(manifest.Layers).To(HaveLen(1))
+		})
+	})
+})
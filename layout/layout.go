@@ -0,0 +1,580 @@
+package layout
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/cert-injector/atomicfile"
+)
+
+const (
+	MediaTypeImageIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	URLs        []string          `json:"urls,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    json.RawMessage   `json:"platform,omitempty"`
+}
+
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type Layout struct{}
+
+func NewLayout() Layout {
+	return Layout{}
+}
+
+// Path converts an oci:/// image uri into the directory holding the OCI image layout.
+func Path(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("parse image uri %s: %s", uri, err)
+	}
+
+	if u.Scheme != "oci" {
+		return "", fmt.Errorf("image uri %s is not an oci:/// uri", uri)
+	}
+
+	path := u.Path
+	// oci:///C:/some/dir parses to /C:/some/dir
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+
+	return filepath.FromSlash(path), nil
+}
+
+// URI returns the oci:/// uri of the OCI image layout in dir, the reverse of
+// Path.
+func URI(dir string) string {
+	return "oci:///" + strings.TrimPrefix(filepath.ToSlash(dir), "/")
+}
+
+// Snapshot saves index.json and hard links every blob reachable from it into a
+// new directory next to the image, so the image can be restored if a later
+// step fails. The digests of all the blobs stored at that point are recorded
+// too, so Restore knows which blobs were added afterwards. It returns the
+// snapshot directory.
+func (l Layout) Snapshot(uri string) (string, error) {
+	dir, err := Path(uri)
+	if err != nil {
+		return "", err
+	}
+
+	digests, err := reachableBlobs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	stored, err := storedBlobs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	snapshot, err := os.MkdirTemp(filepath.Dir(dir), fmt.Sprintf(".%s-snapshot-*", filepath.Base(dir)))
+	if err != nil {
+		return "", fmt.Errorf("create snapshot directory: %s", err)
+	}
+
+	err = linkOrCopy(filepath.Join(dir, "index.json"), filepath.Join(snapshot, "index.json"), true)
+	if err != nil {
+		os.RemoveAll(snapshot)
+		return "", err
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		os.RemoveAll(snapshot)
+		return "", fmt.Errorf("json marshal stored blobs: %s", err)
+	}
+
+	err = os.WriteFile(filepath.Join(snapshot, storedBlobsFile), data, 0644)
+	if err != nil {
+		os.RemoveAll(snapshot)
+		return "", fmt.Errorf("write stored blobs: %s", err)
+	}
+
+	for _, digest := range digests {
+		src, err := BlobPath(dir, digest)
+		if err != nil {
+			os.RemoveAll(snapshot)
+			return "", err
+		}
+		dst, _ := BlobPath(snapshot, digest)
+
+		err = linkOrCopy(src, dst, false)
+		if err != nil {
+			os.RemoveAll(snapshot)
+			return "", err
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Restore puts back any blob removed since the snapshot was taken, replaces
+// index.json with the saved copy and then removes the blobs written since,
+// which nothing refers to any more.
+func (l Layout) Restore(uri, snapshot string) error {
+	dir, err := Path(uri)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(filepath.Join(snapshot, "blobs"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(snapshot, path)
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(dir, rel)
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+
+		return linkOrCopy(path, dst, false)
+	})
+	if err != nil {
+		return fmt.Errorf("restore blobs: %s", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(snapshot, "index.json"))
+	if err != nil {
+		return fmt.Errorf("read saved index.json: %s", err)
+	}
+
+	err = atomicfile.Write(filepath.Join(dir, "index.json"), data)
+	if err != nil {
+		return err
+	}
+
+	return removeAddedBlobs(dir, snapshot)
+}
+
+// storedBlobsFile lists the blobs stored in the layout when the snapshot was
+// taken, reachable or not.
+const storedBlobsFile = "stored-blobs.json"
+
+// removeAddedBlobs removes the blobs of the layout in dir that were not
+// stored yet when snapshot was taken.
+func removeAddedBlobs(dir, snapshot string) error {
+	var before []string
+	err := readJSON(filepath.Join(snapshot, storedBlobsFile), &before)
+	if err != nil {
+		return fmt.Errorf("remove added blobs: %s", err)
+	}
+
+	kept := map[string]bool{}
+	for _, digest := range before {
+		kept[digest] = true
+	}
+
+	after, err := storedBlobs(dir)
+	if err != nil {
+		return fmt.Errorf("remove added blobs: %s", err)
+	}
+
+	for _, digest := range after {
+		if kept[digest] {
+			continue
+		}
+
+		path, err := BlobPath(dir, digest)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove blob %s: %s", digest, err)
+		}
+	}
+
+	return nil
+}
+
+// Discard removes a snapshot directory created by Snapshot.
+func (l Layout) Discard(snapshot string) error {
+	return os.RemoveAll(snapshot)
+}
+
+// LayerAnnotation returns the value of an annotation on the top layer of the
+// image, or an empty string when the image has no layers or no such annotation.
+func (l Layout) LayerAnnotation(uri, key string) (string, error) {
+	dir, err := Path(uri)
+	if err != nil {
+		return "", err
+	}
+
+	_, _, manifest, err := ReadManifest(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if len(manifest.Layers) == 0 {
+		return "", nil
+	}
+
+	return manifest.Layers[len(manifest.Layers)-1].Annotations[key], nil
+}
+
+// LayerDigest returns the digest of the top layer of the image, or an empty
+// string when the image has no layers.
+func (l Layout) LayerDigest(uri string) (string, error) {
+	dir, err := Path(uri)
+	if err != nil {
+		return "", err
+	}
+
+	_, _, manifest, err := ReadManifest(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if len(manifest.Layers) == 0 {
+		return "", nil
+	}
+
+	return manifest.Layers[len(manifest.Layers)-1].Digest, nil
+}
+
+// ManifestDigest returns the digest of the manifest of the image, which
+// changes with every layer added, removed or annotated.
+func (l Layout) ManifestDigest(uri string) (string, error) {
+	dir, err := Path(uri)
+	if err != nil {
+		return "", err
+	}
+
+	index, position, _, err := ReadManifest(dir)
+	if err != nil {
+		return "", err
+	}
+
+	return index.Manifests[position].Digest, nil
+}
+
+// LayerFile returns the path of the blob holding the top layer of the image.
+func (l Layout) LayerFile(uri string) (string, error) {
+	digest, err := l.LayerDigest(uri)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return "", fmt.Errorf("image %s has no layers", uri)
+	}
+
+	dir, err := Path(uri)
+	if err != nil {
+		return "", err
+	}
+
+	return BlobPath(dir, digest)
+}
+
+// AnnotateLayer sets an annotation on the top layer of the image. This writes
+// a new manifest blob and points index.json at it.
+func (l Layout) AnnotateLayer(uri, key, value string) error {
+	dir, err := Path(uri)
+	if err != nil {
+		return err
+	}
+
+	index, position, manifest, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("image %s has no layers", uri)
+	}
+
+	top := &manifest.Layers[len(manifest.Layers)-1]
+	if top.Annotations == nil {
+		top.Annotations = map[string]string{}
+	}
+	top.Annotations[key] = value
+
+	return writeManifest(dir, index, position, manifest)
+}
+
+// ReadManifest returns the index.json of the layout in dir, the position of
+// the image manifest within it and the manifest itself. Images produced for
+// groot contain a single manifest.
+func ReadManifest(dir string) (Index, int, Manifest, error) {
+	var index Index
+	err := readJSON(filepath.Join(dir, "index.json"), &index)
+	if err != nil {
+		return Index{}, 0, Manifest{}, err
+	}
+
+	for position, desc := range index.Manifests {
+		if desc.MediaType == MediaTypeImageIndex || desc.MediaType == MediaTypeDockerList {
+			continue
+		}
+
+		path, err := BlobPath(dir, desc.Digest)
+		if err != nil {
+			return Index{}, 0, Manifest{}, err
+		}
+
+		var manifest Manifest
+		err = readJSON(path, &manifest)
+		if err != nil {
+			return Index{}, 0, Manifest{}, err
+		}
+
+		return index, position, manifest, nil
+	}
+
+	return Index{}, 0, Manifest{}, fmt.Errorf("index.json does not reference an image manifest")
+}
+
+// writeManifest stores manifest as a new blob and updates the descriptor at
+// position in index.json to point at it.
+func writeManifest(dir string, index Index, position int, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("json marshal manifest: %s", err)
+	}
+
+	digest, err := WriteBlob(dir, data)
+	if err != nil {
+		return err
+	}
+
+	index.Manifests[position].Digest = digest
+	index.Manifests[position].Size = int64(len(data))
+
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("json marshal index.json: %s", err)
+	}
+
+	err = atomicfile.Write(filepath.Join(dir, "index.json"), indexData)
+	if err != nil {
+		return fmt.Errorf("write index.json: %s", err)
+	}
+
+	return nil
+}
+
+// WriteBlob stores data in the layout in dir under its sha256 digest and
+// returns the digest.
+func WriteBlob(dir string, data []byte) (string, error) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	path, err := BlobPath(dir, digest)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return digest, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	err = atomicfile.Write(path, data)
+	if err != nil {
+		return "", fmt.Errorf("write blob %s: %s", digest, err)
+	}
+
+	return digest, nil
+}
+
+func reachableBlobs(dir string) ([]string, error) {
+	var index Index
+	err := readJSON(filepath.Join(dir, "index.json"), &index)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	seen := map[string]bool{}
+
+	var walk func(descriptors []Descriptor) error
+	walk = func(descriptors []Descriptor) error {
+		for _, desc := range descriptors {
+			if seen[desc.Digest] {
+				continue
+			}
+			seen[desc.Digest] = true
+			digests = append(digests, desc.Digest)
+
+			path, err := BlobPath(dir, desc.Digest)
+			if err != nil {
+				return err
+			}
+
+			switch desc.MediaType {
+			case MediaTypeImageIndex, MediaTypeDockerList:
+				var child Index
+				if err := readJSON(path, &child); err != nil {
+					return err
+				}
+				if err := walk(child.Manifests); err != nil {
+					return err
+				}
+			default:
+				var manifest Manifest
+				if err := readJSON(path, &manifest); err != nil {
+					return err
+				}
+				var referenced []Descriptor
+				if manifest.Config.Digest != "" {
+					referenced = append(referenced, manifest.Config)
+				}
+				for _, layer := range manifest.Layers {
+					layerPath, err := BlobPath(dir, layer.Digest)
+					if err != nil {
+						return err
+					}
+					// Foreign layers are not stored in the layout.
+					if _, err := os.Stat(layerPath); err == nil {
+						referenced = append(referenced, layer)
+					}
+				}
+				for _, ref := range referenced {
+					if !seen[ref.Digest] {
+						seen[ref.Digest] = true
+						digests = append(digests, ref.Digest)
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	err = walk(index.Manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// storedBlobs returns the digests of every blob stored in the layout in dir.
+// Temporary files, whose names start with a dot, are skipped.
+func storedBlobs(dir string) ([]string, error) {
+	digests := []string{}
+
+	algorithms, err := os.ReadDir(filepath.Join(dir, "blobs"))
+	if os.IsNotExist(err) {
+		return digests, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read blobs: %s", err)
+	}
+
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(dir, "blobs", algorithm.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read blobs: %s", err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			digests = append(digests, algorithm.Name()+":"+entry.Name())
+		}
+	}
+
+	return digests, nil
+}
+
+// BlobPath returns where the blob with digest is stored in the OCI image
+// layout in dir.
+func BlobPath(dir, digest string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || encoded == "" || strings.ContainsAny(digest, `/\.`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+
+	return filepath.Join(dir, "blobs", algorithm, encoded), nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read %s: %s", filepath.Base(path), err)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("json unmarshal %s: %s", filepath.Base(path), err)
+	}
+
+	return nil
+}
+
+// linkOrCopy hard links src to dst, copying when a link is not possible.
+// Small mutable files such as index.json are always copied.
+func linkOrCopy(src, dst string, forceCopy bool) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	if !forceCopy {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
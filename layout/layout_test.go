@@ -0,0 +1,248 @@
+package layout_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/internal/testfixtures"
+	"code.cloudfoundry.org/cert-injector/layout"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Layout", func() {
+	var (
+		tempDir  string
+		imageDir string
+		uri      string
+		l        layout.Layout
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = os.MkdirTemp("", "cert-injector-layout-test-*")
+		Expect(err).NotTo(HaveOccurred())
+
+		imageDir = filepath.Join(tempDir, "image")
+		Expect(os.Mkdir(imageDir, 0755)).To(Succeed())
+		uri = layout.URI(imageDir)
+
+		l = layout.NewLayout()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tempDir)).To(Succeed())
+	})
+
+	Describe("Path", func() {
+		It("returns the directory of an oci:/// uri", func() {
+			path, err := layout.Path("oci:///some/image")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal(filepath.FromSlash("/some/image")))
+		})
+
+		It("strips the leading slash from windows drive paths", func() {
+			path, err := layout.Path("oci:///C:/some/image")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal(filepath.FromSlash("C:/some/image")))
+		})
+
+		It("rejects other schemes", func() {
+			_, err := layout.Path("docker:///some/image")
+			Expect(err).To(MatchError("image uri docker:///some/image is not an oci:/// uri"))
+		})
+	})
+
+	Describe("Snapshot and Restore", func() {
+		var layerDigests []string
+
+		BeforeEach(func() {
+			layerDigests = testfixtures.WriteImage(imageDir, "base-layer", "custom-layer")
+		})
+
+		It("restores the index and any removed blobs", func() {
+			originalIndex, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshot, err := l.Snapshot(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Dir(snapshot)).To(Equal(tempDir))
+
+			By("removing the custom layer the way hydrate would")
+			Expect(os.Remove(blobFile(imageDir, layerDigests[1]))).To(Succeed())
+			testfixtures.WriteImage(imageDir, "base-layer")
+
+			Expect(l.Restore(uri, snapshot)).To(Succeed())
+
+			restoredIndex, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restoredIndex).To(Equal(originalIndex))
+
+			data, err := os.ReadFile(blobFile(imageDir, layerDigests[1]))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("custom-layer"))
+
+			Expect(l.Discard(snapshot)).To(Succeed())
+			Expect(snapshot).NotTo(BeADirectory())
+		})
+
+		It("removes the blobs written since the snapshot and keeps the ones stored before", func() {
+			unreferenced := testfixtures.WriteBlob(imageDir, []byte("unreferenced-blob"))
+			before, err := filepath.Glob(filepath.Join(imageDir, "blobs", "sha256", "*"))
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshot, err := l.Snapshot(uri)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Discard(snapshot)
+
+			layerFile := filepath.Join(tempDir, "layer.tar")
+			Expect(os.WriteFile(layerFile, []byte("added-layer"), 0644)).To(Succeed())
+			_, _, err = l.AddLayer(context.Background(), uri, layerFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			after, err := filepath.Glob(filepath.Join(imageDir, "blobs", "sha256", "*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(after)).To(BeNumerically(">", len(before)))
+
+			Expect(l.Restore(uri, snapshot)).To(Succeed())
+
+			restored, err := filepath.Glob(filepath.Join(imageDir, "blobs", "sha256", "*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(ConsistOf(before))
+			Expect(blobFile(imageDir, unreferenced)).To(BeAnExistingFile())
+		})
+
+		Context("when the image has no index.json", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(filepath.Join(imageDir, "index.json"))).To(Succeed())
+			})
+
+			It("returns a helpful error and leaves no snapshot behind", func() {
+				_, err := l.Snapshot(uri)
+				Expect(err).To(MatchError(ContainSubstring("read index.json")))
+
+				entries, err := os.ReadDir(tempDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("AnnotateLayer and LayerAnnotation", func() {
+		BeforeEach(func() {
+			testfixtures.WriteImage(imageDir, "base-layer", "custom-layer")
+		})
+
+		It("records the annotation on the top layer in a new manifest", func() {
+			value, err := l.LayerAnnotation(uri, "some-key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(BeEmpty())
+
+			Expect(l.AnnotateLayer(uri, "some-key", "some-value")).To(Succeed())
+
+			value, err = l.LayerAnnotation(uri, "some-key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("some-value"))
+
+			var index layout.Index
+			data, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(data, &index)).To(Succeed())
+
+			manifestData, err := os.ReadFile(blobFile(imageDir, index.Manifests[0].Digest))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(int64(len(manifestData))).To(Equal(index.Manifests[0].Size))
+			Expect(index.Manifests[0].Digest).To(Equal(fmt.Sprintf("sha256:%x", sha256.Sum256(manifestData))))
+
+			var manifest layout.Manifest
+			Expect(json.Unmarshal(manifestData, &manifest)).To(Succeed())
+			Expect(manifest.Layers[0].Annotations).To(BeEmpty())
+			Expect(manifest.Layers[1].Annotations).To(HaveKeyWithValue("some-key", "some-value"))
+		})
+
+		Context("when the image has no layers", func() {
+			BeforeEach(func() {
+				testfixtures.WriteImage(imageDir)
+			})
+
+			It("returns no annotation but refuses to annotate", func() {
+				value, err := l.LayerAnnotation(uri, "some-key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(value).To(BeEmpty())
+
+				Expect(l.AnnotateLayer(uri, "some-key", "some-value")).To(MatchError(ContainSubstring("has no layers")))
+			})
+		})
+	})
+
+	Describe("ManifestDigest", func() {
+		It("returns the digest of the manifest index.json points at", func() {
+			testfixtures.WriteImage(imageDir, "base-layer")
+
+			var index layout.Index
+			data, err := os.ReadFile(filepath.Join(imageDir, "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(data, &index)).To(Succeed())
+
+			digest, err := l.ManifestDigest(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(Equal(index.Manifests[0].Digest))
+
+			By("changing when a layer is annotated")
+			Expect(l.AnnotateLayer(uri, "some-key", "some-value")).To(Succeed())
+			annotated, err := l.ManifestDigest(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(annotated).NotTo(Equal(digest))
+		})
+	})
+
+	Describe("LayerDigest", func() {
+		It("returns the digest of the top layer", func() {
+			digests := testfixtures.WriteImage(imageDir, "base-layer", "custom-layer")
+
+			digest, err := l.LayerDigest(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(Equal(digests[1]))
+
+			By("keeping the digest when the layer is annotated")
+			Expect(l.AnnotateLayer(uri, "some-key", "some-value")).To(Succeed())
+			digest, err = l.LayerDigest(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(Equal(digests[1]))
+		})
+
+		It("returns an empty digest when the image has no layers", func() {
+			testfixtures.WriteImage(imageDir)
+
+			digest, err := l.LayerDigest(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(BeEmpty())
+		})
+
+		It("fails when the image has no index", func() {
+			_, err := l.LayerDigest(uri)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("LayerFile", func() {
+		It("returns the blob of the top layer", func() {
+			digests := testfixtures.WriteImage(imageDir, "base-layer", "custom-layer")
+
+			path, err := l.LayerFile(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal(blobFile(imageDir, digests[1])))
+		})
+
+		It("fails when the image has no layers", func() {
+			testfixtures.WriteImage(imageDir)
+
+			_, err := l.LayerFile(uri)
+			Expect(err).To(MatchError("image " + uri + " has no layers"))
+		})
+	})
+})
@@ -0,0 +1,48 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockedRange is the byte of the lock file that is locked. It lies far past
+// the PID in the file, since windows locks also block reads of their range.
+func lockedRange() *syscall.Overlapped {
+	return &syscall.Overlapped{OffsetHigh: 0x7fffffff}
+}
+
+// tryLock takes an exclusive lock on f without blocking. It reports false
+// when another handle holds the lock.
+func tryLock(f *os.File) (bool, error) {
+	r1, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(lockedRange())))
+	if r1 != 0 {
+		return true, nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return false, nil
+	}
+	return false, err
+}
+
+func unlock(f *os.File) error {
+	r1, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockedRange())))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package lock
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPollInterval = 250 * time.Millisecond
+
+// HeldError is returned when a lock is still held by another process once
+// the wait timeout has passed.
+type HeldError struct {
+	Key     string
+	PID     int
+	Timeout time.Duration
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for the lock on %s held by process %d", e.Timeout, e.Key, e.PID)
+}
+
+// Locker hands out locks backed by OS advisory locks (flock, or LockFileEx
+// on windows) on files in a directory. The OS releases the lock of a process
+// that dies, so a lock is never left behind. Each lock file also holds the
+// PID of its last owner, which is only used to name the owner in errors.
+type Locker struct {
+	dir          string
+	pollInterval time.Duration
+}
+
+func NewLocker(dir string) Locker {
+	return Locker{dir: dir, pollInterval: defaultPollInterval}
+}
+
+// Lock is a held lock.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes the lock named key, waiting up to timeout for another
+// process to release it. A zero timeout fails at once if the lock is held.
+func (l Locker) Acquire(ctx context.Context, key string, timeout time.Duration) (*Lock, error) {
+	err := os.MkdirAll(l.dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create lock directory: %s", err)
+	}
+
+	// The lock file is never removed: a process could otherwise lock a file
+	// that was just unlinked while another creates and locks a new one.
+	path := l.path(key)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file for %s: %s", key, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %s", key, err)
+		}
+		if locked {
+			break
+		}
+
+		pid := owner(path)
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, &HeldError{Key: key, PID: pid, Timeout: timeout}
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("waiting for the lock on %s held by process %d: %w", key, pid, ctx.Err())
+		case <-time.After(l.pollInterval):
+		}
+	}
+
+	err = writeOwner(f)
+	if err != nil {
+		unlock(f)
+		f.Close()
+		return nil, fmt.Errorf("write lock file for %s: %s", key, err)
+	}
+
+	return &Lock{file: f}, nil
+}
+
+// Release gives up the lock.
+func (l *Lock) Release() error {
+	err := unlock(l.file)
+	closeErr := l.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("release lock file: %s", err)
+	}
+	return nil
+}
+
+// path names the lock file after a hash of key, since keys such as image
+// uris are not valid file names.
+func (l Locker) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(l.dir, hex.EncodeToString(sum[:8])+".lock")
+}
+
+// writeOwner replaces the PID in the lock file with that of this process.
+func writeOwner(f *os.File) error {
+	err := f.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	return err
+}
+
+// owner returns the PID recorded in the lock file at path, or 0 when the
+// owner has not written it yet.
+func owner(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+
+	return pid
+}
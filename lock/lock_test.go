@@ -0,0 +1,174 @@
+package lock_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/lock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Locker", func() {
+	var (
+		dir    string
+		locker lock.Locker
+	)
+
+	BeforeEach(func() {
+		dir = filepath.Join(GinkgoT().TempDir(), "locks")
+		locker = lock.NewLocker(dir)
+	})
+
+	lockFile := func() string {
+		files, err := filepath.Glob(filepath.Join(dir, "*.lock"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+		return files[0]
+	}
+
+	It("records the owner in the lock file and unlocks it on release", func() {
+		l, err := locker.Acquire(context.Background(), "oci:///some-image", 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := os.ReadFile(lockFile())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(fmt.Sprintf("%d\n", os.Getpid())))
+
+		Expect(l.Release()).To(Succeed())
+
+		again, err := locker.Acquire(context.Background(), "oci:///some-image", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.Release()).To(Succeed())
+	})
+
+	It("does not block different keys", func() {
+		first, err := locker.Acquire(context.Background(), "oci:///first", 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer first.Release()
+
+		second, err := locker.Acquire(context.Background(), "oci:///second", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second.Release()).To(Succeed())
+	})
+
+	Context("when the lock is held by a live process", func() {
+		var held *lock.Lock
+
+		BeforeEach(func() {
+			var err error
+			held, err = locker.Acquire(context.Background(), "oci:///some-image", 0)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("fails after the timeout naming the process that holds it", func() {
+			start := time.Now()
+			_, err := locker.Acquire(context.Background(), "oci:///some-image", 300*time.Millisecond)
+			Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+
+			var heldErr *lock.HeldError
+			Expect(errors.As(err, &heldErr)).To(BeTrue())
+			Expect(heldErr.PID).To(Equal(os.Getpid()))
+			Expect(err).To(MatchError(fmt.Sprintf("timed out after 300ms waiting for the lock on oci:///some-image held by process %d", os.Getpid())))
+		})
+
+		It("takes the lock once it is released", func() {
+			toRelease := held
+			released := make(chan error, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				released <- toRelease.Release()
+			}()
+
+			l, err := locker.Acquire(context.Background(), "oci:///some-image", 5*time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l.Release()).To(Succeed())
+			Eventually(released).Should(Receive(BeNil()))
+		})
+
+		It("stops waiting when the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err := locker.Acquire(ctx, "oci:///some-image", time.Minute)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+
+	Context("when the process that held the lock is gone", func() {
+		BeforeEach(func() {
+			l, err := locker.Acquire(context.Background(), "oci:///some-image", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l.Release()).To(Succeed())
+
+			exited := exec.Command(os.Args[0], "-test.run=^$")
+			Expect(exited.Run()).To(Succeed())
+			Expect(os.WriteFile(lockFile(), []byte(fmt.Sprintf("%d\n", exited.Process.Pid)), 0644)).To(Succeed())
+		})
+
+		It("takes over the stale lock", func() {
+			l, err := locker.Acquire(context.Background(), "oci:///some-image", 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := os.ReadFile(lockFile())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(fmt.Sprintf("%d\n", os.Getpid())))
+			Expect(l.Release()).To(Succeed())
+		})
+
+		It("hands it to exactly one of several racing waiters", func() {
+			const waiters = 8
+			start := make(chan struct{})
+			acquired := make(chan *lock.Lock, waiters)
+			errs := make(chan error, waiters)
+
+			var wg sync.WaitGroup
+			for n := 0; n < waiters; n++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					<-start
+
+					l, err := locker.Acquire(context.Background(), "oci:///some-image", 0)
+					if err != nil {
+						errs <- err
+						return
+					}
+					acquired <- l
+				}()
+			}
+			close(start)
+			wg.Wait()
+			close(acquired)
+			close(errs)
+
+			Expect(acquired).To(HaveLen(1))
+			for err := range errs {
+				var heldErr *lock.HeldError
+				Expect(errors.As(err, &heldErr)).To(BeTrue(), err.Error())
+			}
+			Expect((<-acquired).Release()).To(Succeed())
+		})
+	})
+
+	Context("when the lock file holds no valid PID", func() {
+		BeforeEach(func() {
+			l, err := locker.Acquire(context.Background(), "oci:///some-image", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(lockFile(), []byte("garbage"), 0644)).To(Succeed())
+			DeferCleanup(l.Release)
+		})
+
+		It("reports the owner as process 0 while the lock is held", func() {
+			_, err := locker.Acquire(context.Background(), "oci:///some-image", 0)
+			Expect(err).To(MatchError("timed out after 0s waiting for the lock on oci:///some-image held by process 0"))
+		})
+	})
+})
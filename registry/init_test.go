@@ -0,0 +1,194 @@
+package registry_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRegistry(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registry Suite")
+}
+
+type manifestEntry struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry is an in memory registry serving the parts of the
+// distribution API the client uses, optionally behind token authentication.
+type fakeRegistry struct {
+	server *httptest.Server
+
+	// username and password, when set, are required to get a token.
+	username string
+	password string
+	token    string
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]manifestEntry
+	uploads   int
+	requests  []string
+}
+
+var pathPattern = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/(.+)$`)
+
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]manifestEntry{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// host is the registry host of the server, 127.0.0.1:<port>.
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *fakeRegistry) putBlob(data []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	r.blobs[digest] = data
+	return digest
+}
+
+func (r *fakeRegistry) putManifest(repository, reference, mediaType string, v interface{}) (string, int64) {
+	data, err := json.Marshal(v)
+	Expect(err).NotTo(HaveOccurred())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	r.manifests[repository+"@"+digest] = manifestEntry{mediaType, data}
+	r.manifests[repository+":"+reference] = manifestEntry{mediaType, data}
+	return digest, int64(len(data))
+}
+
+func (r *fakeRegistry) manifest(repository, reference string) (manifestEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.manifests[repository+":"+reference]
+	return m, ok
+}
+
+func (r *fakeRegistry) blob(digest string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.blobs[digest]
+	return data, ok
+}
+
+func (r *fakeRegistry) uploadCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.uploads
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		user, pass, _ := req.BasicAuth()
+		if r.username != "" && (user != r.username || pass != r.password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("service") != "fake" || !strings.HasPrefix(req.URL.Query().Get("scope"), "repository:") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+
+	match := pathPattern.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repository, kind, reference := match[1], match[2], match[3]
+
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull,push"`, r.server.URL, repository))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case kind == "manifests" && req.Method == http.MethodGet:
+		separator := ":"
+		if strings.HasPrefix(reference, "sha256:") {
+			separator = "@"
+		}
+		m, ok := r.manifests[repository+separator+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.data)
+
+	case kind == "manifests" && req.Method == http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		entry := manifestEntry{req.Header.Get("Content-Type"), data}
+		r.manifests[repository+":"+reference] = entry
+		r.manifests[repository+"@"+digest] = entry
+		w.WriteHeader(http.StatusCreated)
+
+	case kind == "blobs" && reference == "uploads/" && req.Method == http.MethodPost:
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repository, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+
+	case kind == "blobs" && strings.HasPrefix(reference, "uploads/") && req.Method == http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if digest != fmt.Sprintf("sha256:%x", sha256.Sum256(data)) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest did not match content"}]}`)
+			return
+		}
+		r.blobs[digest] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case kind == "blobs" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		data, ok := r.blobs[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Scheme prefixes the image uris that refer to a registry.
+const Scheme = "docker://"
+
+const (
+	dockerHub        = "registry-1.docker.io"
+	defaultTag       = "latest"
+	officialImageOrg = "library"
+)
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Reference names an image in a registry by tag or by digest.
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses a docker://[registry/]repository[:tag|@digest] uri.
+// Like the docker CLI, references without a registry host refer to Docker
+// Hub and default to the latest tag.
+func ParseReference(uri string) (Reference, error) {
+	rest, ok := strings.CutPrefix(uri, Scheme)
+	if !ok {
+		return Reference{}, fmt.Errorf("image uri %s is not a %s uri", uri, Scheme)
+	}
+
+	var ref Reference
+	if name, digest, ok := strings.Cut(rest, "@"); ok {
+		rest, ref.Digest = name, digest
+		if !digestPattern.MatchString(digest) {
+			return Reference{}, fmt.Errorf("image uri %s has an invalid digest", uri)
+		}
+	}
+
+	// A colon after the last slash separates the tag, one before it
+	// belongs to the registry host.
+	if n := strings.LastIndex(rest, ":"); n > strings.LastIndex(rest, "/") {
+		rest, ref.Tag = rest[:n], rest[n+1:]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("image uri %s has an invalid tag", uri)
+		}
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+
+	host, repository, ok := strings.Cut(rest, "/")
+	if ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		ref.Registry, ref.Repository = host, repository
+	} else {
+		ref.Registry, ref.Repository = dockerHub, rest
+		if !strings.Contains(rest, "/") {
+			ref.Repository = officialImageOrg + "/" + rest
+		}
+	}
+
+	if !repositoryPattern.MatchString(ref.Repository) {
+		return Reference{}, fmt.Errorf("image uri %s has an invalid repository", uri)
+	}
+
+	return ref, nil
+}
+
+// String returns the reference as a docker:// uri.
+func (r Reference) String() string {
+	s := Scheme + r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// manifestReference is how the manifest of the image is requested: by
+// digest when it is pinned, by tag otherwise.
+func (r Reference) manifestReference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// baseURL is the root of the distribution API of the registry. Like docker,
+// registries on the loopback interface are spoken to over plain HTTP.
+func (r Reference) baseURL() string {
+	scheme := "https"
+	host, _, err := net.SplitHostPort(r.Registry)
+	if err != nil {
+		host = r.Registry
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, r.Registry, r.Repository)
+}
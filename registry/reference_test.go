@@ -0,0 +1,48 @@
+package registry_test
+
+import (
+	"code.cloudfoundry.org/cert-injector/registry"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseReference", func() {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	DescribeTable("parses docker:// uris",
+		func(uri string, expected registry.Reference) {
+			ref, err := registry.ParseReference(uri)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref).To(Equal(expected))
+		},
+		Entry("registry, repository and tag", "docker://registry.example.com/team/windows:1809",
+			registry.Reference{Registry: "registry.example.com", Repository: "team/windows", Tag: "1809"}),
+		Entry("registry with a port", "docker://localhost:5000/windows:v1",
+			registry.Reference{Registry: "localhost:5000", Repository: "windows", Tag: "v1"}),
+		Entry("no tag", "docker://registry.example.com/windows",
+			registry.Reference{Registry: "registry.example.com", Repository: "windows", Tag: "latest"}),
+		Entry("digest", "docker://registry.example.com/windows@"+digest,
+			registry.Reference{Registry: "registry.example.com", Repository: "windows", Digest: digest}),
+		Entry("Docker Hub user image", "docker://cloudfoundry/windows2016fs:2019",
+			registry.Reference{Registry: "registry-1.docker.io", Repository: "cloudfoundry/windows2016fs", Tag: "2019"}),
+		Entry("Docker Hub official image", "docker://golang",
+			registry.Reference{Registry: "registry-1.docker.io", Repository: "library/golang", Tag: "latest"}),
+	)
+
+	DescribeTable("rejects invalid uris",
+		func(uri, message string) {
+			_, err := registry.ParseReference(uri)
+			Expect(err).To(MatchError(message))
+		},
+		Entry("another scheme", "oci:///C:/images/windows", "image uri oci:///C:/images/windows is not a docker:// uri"),
+		Entry("upper case repository", "docker://registry.example.com/Windows:1", "image uri docker://registry.example.com/Windows:1 has an invalid repository"),
+		Entry("invalid tag", "docker://registry.example.com/windows:-1", "image uri docker://registry.example.com/windows:-1 has an invalid tag"),
+		Entry("invalid digest", "docker://registry.example.com/windows@sha256:abc", "image uri docker://registry.example.com/windows@sha256:abc has an invalid digest"),
+	)
+
+	It("formats the reference back into a uri", func() {
+		ref, err := registry.ParseReference("docker://golang")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ref.String()).To(Equal("docker://registry-1.docker.io/library/golang:latest"))
+	})
+})
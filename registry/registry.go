@@ -0,0 +1,585 @@
+// Package registry pulls images from a registry that speaks the distribution
+// API into local OCI image layouts, and pushes them back.
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/cert-injector/atomicfile"
+	"code.cloudfoundry.org/cert-injector/layout"
+)
+
+// RefNameAnnotation records the tag of a pulled image in index.json.
+const RefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// maxManifestSize bounds how much of a manifest response is read.
+const maxManifestSize = 4 << 20
+
+var manifestMediaTypes = []string{
+	layout.MediaTypeImageIndex,
+	layout.MediaTypeImageManifest,
+	layout.MediaTypeDockerList,
+	layout.MediaTypeDockerManifest,
+}
+
+type Client struct {
+	http     *http.Client
+	username string
+	password string
+}
+
+// NewClient returns a client that authenticates with username and password
+// when the registry asks for credentials. Both may be empty for anonymous
+// access.
+func NewClient(username, password string) Client {
+	return Client{
+		http:     &http.Client{},
+		username: username,
+		password: password,
+	}
+}
+
+// Pull downloads the windows/amd64 image uri refers to into the OCI image
+// layout in dir, creating it if needed. Blobs that are already in the
+// layout are not downloaded again, and foreign layers, which the registry
+// does not serve, are left out. index.json is written last.
+func (c Client) Pull(ctx context.Context, uri, dir string) error {
+	ref, err := ParseReference(uri)
+	if err != nil {
+		return err
+	}
+	s := &session{client: c, ref: ref}
+
+	data, mediaType, err := s.manifest(ctx, ref.manifestReference())
+	if err != nil {
+		return err
+	}
+	if ref.Digest != "" && digestOf(data) != ref.Digest {
+		return fmt.Errorf("manifest of %s does not match its digest", uri)
+	}
+
+	if mediaType == layout.MediaTypeImageIndex || mediaType == layout.MediaTypeDockerList {
+		desc, err := windowsManifest(data)
+		if err != nil {
+			return fmt.Errorf("%s: %s", uri, err)
+		}
+
+		data, mediaType, err = s.manifest(ctx, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if digestOf(data) != desc.Digest {
+			return fmt.Errorf("manifest %s of %s does not match its digest", desc.Digest, uri)
+		}
+	}
+
+	var manifest layout.Manifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return fmt.Errorf("json unmarshal manifest of %s: %s", uri, err)
+	}
+
+	for _, desc := range append([]layout.Descriptor{manifest.Config}, manifest.Layers...) {
+		if isForeign(desc) {
+			continue
+		}
+		err = s.fetchBlob(ctx, dir, desc)
+		if err != nil {
+			return err
+		}
+	}
+
+	digest, err := layout.WriteBlob(dir, data)
+	if err != nil {
+		return err
+	}
+
+	err = atomicfile.Write(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	if err != nil {
+		return err
+	}
+
+	desc := layout.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+	if ref.Tag != "" {
+		desc.Annotations = map[string]string{RefNameAnnotation: ref.Tag}
+	}
+	index, err := json.Marshal(layout.Index{SchemaVersion: 2, Manifests: []layout.Descriptor{desc}})
+	if err != nil {
+		return fmt.Errorf("json marshal index.json: %s", err)
+	}
+
+	return atomicfile.Write(filepath.Join(dir, "index.json"), index)
+}
+
+// Resolve returns the digest of the windows/amd64 manifest uri refers to,
+// which is the manifest Pull would store, without downloading any blob.
+func (c Client) Resolve(ctx context.Context, uri string) (string, error) {
+	ref, err := ParseReference(uri)
+	if err != nil {
+		return "", err
+	}
+	s := &session{client: c, ref: ref}
+
+	data, mediaType, err := s.manifest(ctx, ref.manifestReference())
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" && digestOf(data) != ref.Digest {
+		return "", fmt.Errorf("manifest of %s does not match its digest", uri)
+	}
+
+	if mediaType == layout.MediaTypeImageIndex || mediaType == layout.MediaTypeDockerList {
+		desc, err := windowsManifest(data)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", uri, err)
+		}
+		return desc.Digest, nil
+	}
+
+	return digestOf(data), nil
+}
+
+// Push uploads the image in the OCI image layout in dir to the repository
+// uri refers to and tags it with tag, or with the tag of uri when tag is
+// empty. Blobs the registry already has are not uploaded again.
+func (c Client) Push(ctx context.Context, dir, uri, tag string) error {
+	ref, err := ParseReference(uri)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		ref.Tag, ref.Digest = tag, ""
+	}
+	if ref.Tag == "" {
+		return fmt.Errorf("image uri %s has no tag to push to", uri)
+	}
+	s := &session{client: c, ref: ref}
+
+	index, position, manifest, err := layout.ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	desc := index.Manifests[position]
+
+	// The manifest is pushed as stored, since its digest is that of the
+	// stored bytes.
+	path, err := layout.BlobPath(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read manifest: %s", err)
+	}
+
+	for _, blob := range append([]layout.Descriptor{manifest.Config}, manifest.Layers...) {
+		if isForeign(blob) {
+			continue
+		}
+		err = s.pushBlob(ctx, dir, blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, ref.baseURL()+"/manifests/"+ref.Tag, http.Header{"Content-Type": {mediaType}}, bytesBody(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkStatus(resp, http.StatusCreated)
+}
+
+// session holds the authorization the registry granted for one pull or
+// push, so that the token is only requested once.
+type session struct {
+	client        Client
+	ref           Reference
+	authorization string
+}
+
+// body returns a fresh request body, so that a request can be sent again
+// once the session is authorized.
+type body func() (io.ReadCloser, int64, error)
+
+func bytesBody(data []byte) body {
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+}
+
+func fileBody(path string) body {
+	return func() (io.ReadCloser, int64, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+}
+
+// do sends a request, answering a 401 response by authorizing the session
+// as the registry asks and sending the request once more.
+func (s *session) do(ctx context.Context, method, target string, header http.Header, newBody body) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+		if newBody != nil {
+			body, size, err := newBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body, req.ContentLength = body, size
+		}
+
+		resp, err := s.client.http.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %s", method, target, errorDetail(err))
+		}
+		return resp, nil
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	err = s.authorize(ctx, challenge)
+	if err != nil {
+		return nil, fmt.Errorf("authorize with %s: %s", s.ref.Registry, err)
+	}
+
+	return send()
+}
+
+// authorize handles the Basic and Bearer challenges of the distribution
+// API token authentication.
+func (s *session) authorize(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if s.client.username == "" {
+			return fmt.Errorf("registry requires credentials")
+		}
+		s.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(s.client.username+":"+s.client.password))
+		return nil
+
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return fmt.Errorf("invalid token realm %q", params["realm"])
+		}
+		query := realm.Query()
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		if scope := params["scope"]; scope != "" {
+			query.Set("scope", scope)
+		}
+		realm.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return err
+		}
+		if s.client.username != "" {
+			req.SetBasicAuth(s.client.username, s.client.password)
+		}
+
+		resp, err := s.client.http.Do(req)
+		if err != nil {
+			return fmt.Errorf("request token: %s", errorDetail(err))
+		}
+		defer resp.Body.Close()
+
+		err = checkStatus(resp, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("request token: %s", err)
+		}
+
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token)
+		if err != nil {
+			return fmt.Errorf("json unmarshal token: %s", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		if token.Token == "" {
+			return fmt.Errorf("token response has no token")
+		}
+
+		s.authorization = "Bearer " + token.Token
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+}
+
+func (s *session) manifest(ctx context.Context, reference string) ([]byte, string, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.ref.baseURL()+"/manifests/"+reference, http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	err = checkStatus(resp, http.StatusOK)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("read manifest %s: %s", reference, err)
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if mediaType == "" || mediaType == "application/json" {
+		// Fall back to the media type the manifest declares itself.
+		var declared struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &declared)
+		mediaType = declared.MediaType
+	}
+
+	return data, strings.TrimSpace(mediaType), nil
+}
+
+// fetchBlob downloads the blob desc describes into the layout in dir and
+// checks it against its digest before it is moved into place.
+func (s *session) fetchBlob(ctx context.Context, dir string, desc layout.Descriptor) error {
+	path, err := layout.BlobPath(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, s.ref.baseURL()+"/blobs/"+desc.Digest, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = checkStatus(resp, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("download blob %s: %s", desc.Digest, err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if fmt.Sprintf("sha256:%x", hash.Sum(nil)) != desc.Digest {
+		return fmt.Errorf("blob %s does not match its digest", desc.Digest)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// pushBlob uploads the blob desc describes from the layout in dir in a
+// single request, unless the registry already has it.
+func (s *session) pushBlob(ctx context.Context, dir string, desc layout.Descriptor) error {
+	blobURL := s.ref.baseURL() + "/blobs/" + desc.Digest
+
+	resp, err := s.do(ctx, http.MethodHead, blobURL, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	path, err := layout.BlobPath(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	uploadsURL := s.ref.baseURL() + "/blobs/uploads/"
+	resp, err = s.do(ctx, http.MethodPost, uploadsURL, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	err = checkStatus(resp, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+
+	base, err := url.Parse(uploadsURL)
+	if err != nil {
+		return err
+	}
+	location, err := base.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("upload of blob %s has no valid location", desc.Digest)
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = s.do(ctx, http.MethodPut, location.String(), http.Header{"Content-Type": {"application/octet-stream"}}, fileBody(path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkStatus(resp, http.StatusCreated)
+}
+
+// windowsManifest picks the windows/amd64 image out of an image index.
+func windowsManifest(data []byte) (layout.Descriptor, error) {
+	var index layout.Index
+	err := json.Unmarshal(data, &index)
+	if err != nil {
+		return layout.Descriptor{}, fmt.Errorf("json unmarshal image index: %s", err)
+	}
+
+	for _, desc := range index.Manifests {
+		var platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		}
+		json.Unmarshal(desc.Platform, &platform)
+
+		if platform.OS == "windows" && platform.Architecture == "amd64" {
+			return desc, nil
+		}
+	}
+
+	return layout.Descriptor{}, fmt.Errorf("image index has no windows/amd64 image")
+}
+
+// isForeign reports whether the layer is one registries do not store, such
+// as the base layers of Windows images, which are downloaded from their
+// urls instead.
+func isForeign(desc layout.Descriptor) bool {
+	return strings.Contains(desc.MediaType, "foreign") || strings.Contains(desc.MediaType, "nondistributable")
+}
+
+// checkStatus returns an error describing resp unless it has the expected
+// status code.
+func checkStatus(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+
+	var apiErr struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(data, &apiErr) == nil && len(apiErr.Errors) > 0 {
+		return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status, apiErr.Errors[0].Message)
+	}
+
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status)
+}
+
+// errorDetail drops the method and url net/http puts in front of its
+// errors, since callers add their own.
+func errorDetail(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and
+// parameters. Quoted values may contain commas, as scopes do.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+			continue
+		}
+
+		params[key], rest, _ = strings.Cut(value, ",")
+	}
+
+	return scheme, params
+}
+
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
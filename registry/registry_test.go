@@ -0,0 +1,273 @@
+package registry_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/layout"
+	"code.cloudfoundry.org/cert-injector/registry"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		fake   *fakeRegistry
+		client registry.Client
+		dir    string
+		ctx    context.Context
+
+		configDigest string
+		layerDigest  string
+		foreign      layout.Descriptor
+		manifest     layout.Manifest
+	)
+
+	BeforeEach(func() {
+		fake = newFakeRegistry()
+		DeferCleanup(fake.server.Close)
+
+		client = registry.NewClient("", "")
+		dir = filepath.Join(GinkgoT().TempDir(), "image")
+		ctx = context.Background()
+
+		configDigest = fake.putBlob([]byte(`{"os":"windows","rootfs":{"type":"layers","diff_ids":[]}}`))
+		layerDigest = fake.putBlob([]byte("some-layer"))
+		foreign = layout.Descriptor{
+			MediaType: "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+			Digest:    "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			Size:      100,
+			URLs:      []string{"https://mcr.microsoft.com/some-base-layer"},
+		}
+
+		manifest = layout.Manifest{
+			SchemaVersion: 2,
+			MediaType:     layout.MediaTypeDockerManifest,
+			Config:        layout.Descriptor{MediaType: "application/vnd.docker.container.image.v1+json", Digest: configDigest, Size: 59},
+			Layers: []layout.Descriptor{
+				foreign,
+				{MediaType: layout.MediaTypeDockerLayerGzip, Digest: layerDigest, Size: 10},
+			},
+		}
+	})
+
+	readIndex := func() layout.Index {
+		data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+		Expect(err).NotTo(HaveOccurred())
+		var index layout.Index
+		Expect(json.Unmarshal(data, &index)).To(Succeed())
+		return index
+	}
+
+	Describe("Resolve", func() {
+		It("returns the digest of the manifest Pull would store", func() {
+			manifestDigest, _ := fake.putManifest("team/windows", "1809", layout.MediaTypeDockerManifest, manifest)
+
+			digest, err := client.Resolve(ctx, "docker://"+fake.host()+"/team/windows:1809")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(Equal(manifestDigest))
+		})
+
+		It("returns the digest of the windows/amd64 image of an image index", func() {
+			manifestDigest, manifestSize := fake.putManifest("windows", "windows-amd64", layout.MediaTypeDockerManifest, manifest)
+			fake.putManifest("windows", "multi", layout.MediaTypeDockerList, layout.Index{
+				SchemaVersion: 2,
+				MediaType:     layout.MediaTypeDockerList,
+				Manifests: []layout.Descriptor{
+					{MediaType: layout.MediaTypeDockerManifest, Digest: manifestDigest, Size: manifestSize, Platform: json.RawMessage(`{"os":"windows","architecture":"amd64"}`)},
+				},
+			})
+
+			digest, err := client.Resolve(ctx, "docker://"+fake.host()+"/windows:multi")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(Equal(manifestDigest))
+		})
+
+		It("fails for an unknown tag", func() {
+			_, err := client.Resolve(ctx, "docker://"+fake.host()+"/windows:missing")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Pull", func() {
+		It("writes the image into an OCI image layout", func() {
+			manifestDigest, manifestSize := fake.putManifest("team/windows", "1809", layout.MediaTypeDockerManifest, manifest)
+
+			Expect(client.Pull(ctx, "docker://"+fake.host()+"/team/windows:1809", dir)).To(Succeed())
+
+			Expect(filepath.Join(dir, "oci-layout")).To(BeAnExistingFile())
+			Expect(readIndex().Manifests).To(Equal([]layout.Descriptor{{
+				MediaType:   layout.MediaTypeDockerManifest,
+				Digest:      manifestDigest,
+				Size:        manifestSize,
+				Annotations: map[string]string{registry.RefNameAnnotation: "1809"},
+			}}))
+
+			for _, digest := range []string{manifestDigest, configDigest, layerDigest} {
+				path, err := layout.BlobPath(dir, digest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(path).To(BeAnExistingFile())
+			}
+
+			By("leaving out foreign layers", func() {
+				path, err := layout.BlobPath(dir, foreign.Digest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(path).NotTo(BeAnExistingFile())
+			})
+
+			By("producing a layout the layout package can read", func() {
+				digest, err := layout.NewLayout().LayerDigest(layout.URI(dir))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(digest).To(Equal(layerDigest))
+			})
+		})
+
+		It("picks the windows/amd64 image of an image index", func() {
+			manifestDigest, manifestSize := fake.putManifest("windows", "windows-amd64", layout.MediaTypeDockerManifest, manifest)
+			fake.putManifest("windows", "multi", layout.MediaTypeDockerList, layout.Index{
+				SchemaVersion: 2,
+				MediaType:     layout.MediaTypeDockerList,
+				Manifests: []layout.Descriptor{
+					{MediaType: layout.MediaTypeDockerManifest, Digest: "sha256:2222222222222222222222222222222222222222222222222222222222222222", Size: 10, Platform: json.RawMessage(`{"os":"linux","architecture":"amd64"}`)},
+					{MediaType: layout.MediaTypeDockerManifest, Digest: manifestDigest, Size: manifestSize, Platform: json.RawMessage(`{"os":"windows","architecture":"amd64"}`)},
+				},
+			})
+
+			Expect(client.Pull(ctx, "docker://"+fake.host()+"/windows:multi", dir)).To(Succeed())
+			Expect(readIndex().Manifests[0].Digest).To(Equal(manifestDigest))
+		})
+
+		It("pulls an image pinned by digest", func() {
+			manifestDigest, _ := fake.putManifest("windows", "1809", layout.MediaTypeDockerManifest, manifest)
+
+			Expect(client.Pull(ctx, "docker://"+fake.host()+"/windows@"+manifestDigest, dir)).To(Succeed())
+			Expect(readIndex().Manifests[0].Digest).To(Equal(manifestDigest))
+			Expect(readIndex().Manifests[0].Annotations).To(BeEmpty())
+		})
+
+		It("rejects a blob that does not match its digest", func() {
+			fake.putManifest("windows", "1809", layout.MediaTypeDockerManifest, manifest)
+			fake.blobs[layerDigest] = []byte("tampered")
+
+			err := client.Pull(ctx, "docker://"+fake.host()+"/windows:1809", dir)
+			Expect(err).To(MatchError("blob " + layerDigest + " does not match its digest"))
+
+			path, err := layout.BlobPath(dir, layerDigest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(dir, "index.json")).NotTo(BeAnExistingFile())
+		})
+
+		It("returns the error message of the registry", func() {
+			err := client.Pull(ctx, "docker://"+fake.host()+"/windows:missing", dir)
+			Expect(err).To(MatchError(ContainSubstring("404 Not Found: manifest unknown")))
+		})
+
+		It("fails for an index without a windows/amd64 image", func() {
+			fake.putManifest("windows", "linux", layout.MediaTypeImageIndex, layout.Index{
+				SchemaVersion: 2,
+				Manifests: []layout.Descriptor{
+					{MediaType: layout.MediaTypeImageManifest, Digest: "sha256:2222222222222222222222222222222222222222222222222222222222222222", Size: 10, Platform: json.RawMessage(`{"os":"linux","architecture":"amd64"}`)},
+				},
+			})
+
+			err := client.Pull(ctx, "docker://"+fake.host()+"/windows:linux", dir)
+			Expect(err).To(MatchError("docker://" + fake.host() + "/windows:linux: image index has no windows/amd64 image"))
+		})
+
+		Context("when the registry requires a token", func() {
+			BeforeEach(func() {
+				fake.token = "some-token"
+				fake.username, fake.password = "some-user", "some-password"
+				fake.putManifest("windows", "1809", layout.MediaTypeDockerManifest, manifest)
+			})
+
+			It("requests a token with the credentials", func() {
+				client = registry.NewClient("some-user", "some-password")
+				Expect(client.Pull(ctx, "docker://"+fake.host()+"/windows:1809", dir)).To(Succeed())
+
+				tokenRequests := 0
+				for _, r := range fake.requests {
+					if r == "GET /token" {
+						tokenRequests++
+					}
+				}
+				Expect(tokenRequests).To(Equal(1))
+			})
+
+			It("fails without valid credentials", func() {
+				client = registry.NewClient("some-user", "wrong-password")
+				err := client.Pull(ctx, "docker://"+fake.host()+"/windows:1809", dir)
+				Expect(err).To(MatchError(ContainSubstring("authorize with " + fake.host() + ": request token: GET")))
+				Expect(err).To(MatchError(ContainSubstring("401 Unauthorized")))
+			})
+		})
+	})
+
+	Describe("Push", func() {
+		BeforeEach(func() {
+			fake.putManifest("windows", "1809", layout.MediaTypeDockerManifest, manifest)
+			Expect(client.Pull(ctx, "docker://"+fake.host()+"/windows:1809", dir)).To(Succeed())
+		})
+
+		It("uploads the image under a new tag", func() {
+			added := []byte("added-layer")
+			_, _, err := layout.NewLayout().AddLayer(ctx, layout.URI(dir), writeFile(added))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(client.Push(ctx, dir, "docker://"+fake.host()+"/windows:1809", "1809-certs")).To(Succeed())
+
+			pushed, ok := fake.manifest("windows", "1809-certs")
+			Expect(ok).To(BeTrue())
+			Expect(pushed.mediaType).To(Equal(layout.MediaTypeDockerManifest))
+
+			var m layout.Manifest
+			Expect(json.Unmarshal(pushed.data, &m)).To(Succeed())
+			Expect(m.Layers).To(HaveLen(3))
+
+			data, ok := fake.blob(m.Layers[2].Digest)
+			Expect(ok).To(BeTrue())
+			Expect(m.Layers[2].MediaType).To(Equal(layout.MediaTypeDockerLayerGzip))
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(gz)).To(Equal(added))
+
+			By("only uploading the blobs the registry does not have", func() {
+				Expect(fake.uploadCount()).To(Equal(2))
+			})
+
+			By("leaving the original tag alone", func() {
+				original, _ := fake.manifest("windows", "1809")
+				Expect(original.data).NotTo(Equal(pushed.data))
+			})
+		})
+
+		It("pushes to the tag of the uri without a new tag", func() {
+			Expect(client.Push(ctx, dir, "docker://"+fake.host()+"/mirror:v1", "")).To(Succeed())
+
+			_, ok := fake.manifest("mirror", "v1")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("rejects an invalid tag", func() {
+			err := client.Push(ctx, dir, "docker://"+fake.host()+"/windows:1809", "-certs")
+			Expect(err).To(MatchError(`invalid tag "-certs"`))
+		})
+
+		It("fails for a layout without an index", func() {
+			err := client.Push(ctx, GinkgoT().TempDir(), "docker://"+fake.host()+"/windows:1809", "")
+			Expect(err).To(MatchError(ContainSubstring("read index.json")))
+		})
+	})
+})
+
+func writeFile(data []byte) string {
+	path := filepath.Join(GinkgoT().TempDir(), "layer.tar")
+	Expect(os.WriteFile(path, data, 0644)).To(Succeed())
+	return path
+}
@@ -0,0 +1,152 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/atomicfile"
+	"code.cloudfoundry.org/cert-injector/lock"
+)
+
+// lockTimeout bounds how long an update waits for another process to finish
+// updating the file.
+const lockTimeout = time.Minute
+
+// Leak is a groot volume that could not be deleted.
+type Leak struct {
+	DriverStore string    `json:"driver_store"`
+	ContainerId string    `json:"container_id"`
+	Since       time.Time `json:"since"`
+}
+
+// State is what a run leaves behind for later runs to clean up.
+type State struct {
+	// LeakedCount is the number of leaked volumes ever recorded, including
+	// ones that have since been cleaned up.
+	LeakedCount int    `json:"leaked_count"`
+	Leaks       []Leak `json:"leaks"`
+}
+
+// File keeps the State in a JSON file. It is safe for concurrent use by
+// goroutines of one process and by processes sharing the file, such as runs
+// on different driver stores: updates hold a lock file next to the file while
+// they read, change and replace it.
+type File struct {
+	path   string
+	mu     *sync.Mutex
+	locker lock.Locker
+	now    func() time.Time
+}
+
+func NewFile(path string) File {
+	return File{path: path, mu: &sync.Mutex{}, locker: lock.NewLocker(filepath.Dir(path)), now: time.Now}
+}
+
+func (f File) Path() string {
+	return f.path
+}
+
+// Read returns the recorded state. A missing file is an empty state.
+func (f File) Read() (State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.read()
+}
+
+// AddLeak records that the volume containerId in driverStore leaked.
+func (f File) AddLeak(driverStore, containerId string) error {
+	return f.update(func(s *State) {
+		for _, l := range s.Leaks {
+			if l.DriverStore == driverStore && l.ContainerId == containerId {
+				return
+			}
+		}
+		s.LeakedCount++
+		s.Leaks = append(s.Leaks, Leak{DriverStore: driverStore, ContainerId: containerId, Since: f.now().UTC()})
+	})
+}
+
+// RemoveLeak forgets the volume containerId in driverStore once it has been
+// deleted.
+func (f File) RemoveLeak(driverStore, containerId string) error {
+	return f.update(func(s *State) {
+		var leaks []Leak
+		for _, l := range s.Leaks {
+			if l.DriverStore != driverStore || l.ContainerId != containerId {
+				leaks = append(leaks, l)
+			}
+		}
+		s.Leaks = leaks
+	})
+}
+
+// Leaks returns the ids of the leaked volumes in driverStore.
+func (f File) Leaks(driverStore string) ([]string, error) {
+	s, err := f.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var containerIds []string
+	for _, l := range s.Leaks {
+		if l.DriverStore == driverStore {
+			containerIds = append(containerIds, l.ContainerId)
+		}
+	}
+	return containerIds, nil
+}
+
+func (f File) update(change func(*State)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fileLock, err := f.locker.Acquire(context.Background(), f.path, lockTimeout)
+	if err != nil {
+		return fmt.Errorf("lock state file: %s", err)
+	}
+	defer fileLock.Release()
+
+	s, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	change(&s)
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json marshal state: %s", err)
+	}
+
+	err = atomicfile.Write(f.path, data)
+	if err != nil {
+		return fmt.Errorf("write state file: %s", err)
+	}
+
+	return nil
+}
+
+func (f File) read() (State, error) {
+	var s State
+
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("read state file: %s", err)
+	}
+
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return s, fmt.Errorf("json unmarshal state file %s: %s", f.path, err)
+	}
+
+	return s, nil
+}
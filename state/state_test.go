@@ -0,0 +1,104 @@
+package state_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/cert-injector/state"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("File", func() {
+	var (
+		path string
+		file state.File
+	)
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "some-dir", "state.json")
+		file = state.NewFile(path)
+	})
+
+	It("treats a missing file as an empty state", func() {
+		s, err := file.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s).To(Equal(state.State{}))
+
+		leaks, err := file.Leaks("some-driver-store")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(leaks).To(BeEmpty())
+	})
+
+	It("records and forgets leaked volumes per driver store", func() {
+		Expect(file.AddLeak("some-driver-store", "layer-1")).To(Succeed())
+		Expect(file.AddLeak("some-driver-store", "layer-2")).To(Succeed())
+		Expect(file.AddLeak("other-driver-store", "layer-3")).To(Succeed())
+		Expect(file.AddLeak("some-driver-store", "layer-1")).To(Succeed())
+
+		leaks, err := file.Leaks("some-driver-store")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(leaks).To(Equal([]string{"layer-1", "layer-2"}))
+
+		Expect(file.RemoveLeak("some-driver-store", "layer-1")).To(Succeed())
+
+		By("reading the state back from disk")
+		s, err := state.NewFile(path).Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.LeakedCount).To(Equal(3))
+		Expect(s.Leaks).To(HaveLen(2))
+		Expect(s.Leaks[0].ContainerId).To(Equal("layer-2"))
+		Expect(s.Leaks[0].Since).NotTo(BeZero())
+		Expect(s.Leaks[1].DriverStore).To(Equal("other-driver-store"))
+	})
+
+	It("does not lose updates made concurrently", func() {
+		var wg sync.WaitGroup
+		for _, id := range []string{"layer-1", "layer-2", "layer-3", "layer-4"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				Expect(file.AddLeak("some-driver-store", id)).To(Succeed())
+			}()
+		}
+		wg.Wait()
+
+		leaks, err := file.Leaks("some-driver-store")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(leaks).To(ConsistOf("layer-1", "layer-2", "layer-3", "layer-4"))
+	})
+
+	It("does not lose updates made concurrently by other processes sharing the file", func() {
+		var wg sync.WaitGroup
+		for _, id := range []string{"layer-1", "layer-2", "layer-3", "layer-4"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				// Every File stands in for another process, so only the
+				// lock file orders the updates.
+				Expect(state.NewFile(path).AddLeak("driver-store-"+id, id)).To(Succeed())
+			}()
+		}
+		wg.Wait()
+
+		s, err := file.Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.LeakedCount).To(Equal(4))
+		Expect(s.Leaks).To(HaveLen(4))
+	})
+
+	Context("when the file is corrupt", func() {
+		BeforeEach(func() {
+			Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+			Expect(os.WriteFile(path, []byte("garbage"), 0644)).To(Succeed())
+		})
+
+		It("returns a helpful error", func() {
+			_, err := file.Read()
+			Expect(err).To(MatchError(ContainSubstring("json unmarshal state file " + path)))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package winlayer_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestWinlayer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Winlayer Suite")
+}
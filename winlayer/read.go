@@ -0,0 +1,85 @@
+package winlayer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/cert-injector/hive"
+)
+
+// maxHiveSize bounds how much of a hive is read from a layer.
+const maxHiveSize = 64 << 20
+
+// Thumbprints returns the thumbprints of the certificates the layer in
+// layerFile adds to Cert:\LocalMachine\Root, in upper case and sorted. The
+// layer may be gzipped. A certificate only counts when its key holds the
+// certificate blob, as the layers of both builders do.
+func Thumbprints(layerFile string) ([]string, error) {
+	f, err := os.Open(layerFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var layer io.Reader = r
+	if magic, _ := r.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("read layer: %s", err)
+		}
+		defer gz.Close()
+		layer = gz
+	}
+
+	tr := tar.NewReader(layer)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("layer has no %s hive", SoftwareHive)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read layer: %s", err)
+		}
+
+		if !strings.EqualFold(header.Name, SoftwareHive) {
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(tr, maxHiveSize))
+		if err != nil {
+			return nil, fmt.Errorf("read layer: %s", err)
+		}
+
+		software, err := hive.Unmarshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("read %s hive: %s", SoftwareHive, err)
+		}
+
+		return rootThumbprints(software), nil
+	}
+}
+
+func rootThumbprints(software *hive.Key) []string {
+	store := software.Subkey(CertificatesKey...)
+	if store == nil {
+		return nil
+	}
+
+	var thumbprints []string
+	for _, key := range store.Subkeys {
+		if blob, ok := key.Value("Blob"); ok && len(blob.Data) > 0 {
+			thumbprints = append(thumbprints, strings.ToUpper(key.Name))
+		}
+	}
+	sort.Strings(thumbprints)
+
+	return thumbprints
+}
@@ -0,0 +1,108 @@
+package winlayer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cert-injector/hive"
+	"code.cloudfoundry.org/cert-injector/internal/testfixtures"
+	"code.cloudfoundry.org/cert-injector/winlayer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Thumbprints", func() {
+	var layerFile string
+
+	BeforeEach(func() {
+		layerFile = filepath.Join(GinkgoT().TempDir(), "layer.tar")
+	})
+
+	// writeTar writes an uncompressed layer holding the given files.
+	writeTar := func(files map[string][]byte) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, data := range files {
+			Expect(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data))})).To(Succeed())
+			_, err := tw.Write(data)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(tw.Close()).To(Succeed())
+		Expect(os.WriteFile(layerFile, buf.Bytes(), 0644)).To(Succeed())
+	}
+
+	It("reads the certificates of a layer written by the builder", func() {
+		first := testfixtures.GenerateCA("first")
+		second := testfixtures.GenerateCA("second")
+		certDirectory := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(certDirectory, "bundle.crt"), testfixtures.ToPEM(first, second), 0644)).To(Succeed())
+		Expect(winlayer.NewBuilder().BuildLayer(layerFile, certDirectory)).To(Succeed())
+
+		thumbprints, err := winlayer.Thumbprints(layerFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(thumbprints).To(ConsistOf(fmt.Sprintf("%X", sha1.Sum(first)), fmt.Sprintf("%X", sha1.Sum(second))))
+	})
+
+	It("reads an uncompressed layer and leaves out keys without a certificate", func() {
+		software, err := hive.Marshal(&hive.Key{Name: "ROOT", Subkeys: []*hive.Key{
+			{Name: "Microsoft", Subkeys: []*hive.Key{
+				{Name: "SystemCertificates", Subkeys: []*hive.Key{
+					{Name: "ROOT", Subkeys: []*hive.Key{
+						{Name: "Certificates", Subkeys: []*hive.Key{
+							{Name: "bb", Values: []hive.Value{{Name: "Blob", Type: hive.TypeBinary, Data: []byte{1}}}},
+							{Name: "AA", Values: []hive.Value{{Name: "Blob", Type: hive.TypeBinary, Data: []byte{1}}}},
+							{Name: "CC"},
+						}},
+					}},
+				}},
+			}},
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		writeTar(map[string][]byte{"Hives/Software_Delta": software})
+
+		thumbprints, err := winlayer.Thumbprints(layerFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(thumbprints).To(Equal([]string{"AA", "BB"}))
+	})
+
+	It("returns no thumbprints when the hive has no root store", func() {
+		software, err := hive.Marshal(&hive.Key{Name: "ROOT", Subkeys: []*hive.Key{{Name: "Microsoft"}}})
+		Expect(err).NotTo(HaveOccurred())
+		writeTar(map[string][]byte{"Hives/Software_Delta": software})
+
+		thumbprints, err := winlayer.Thumbprints(layerFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(thumbprints).To(BeEmpty())
+	})
+
+	Context("when the layer has no software hive", func() {
+		It("returns an error", func() {
+			writeTar(map[string][]byte{"Files/some-file": []byte("data")})
+
+			_, err := winlayer.Thumbprints(layerFile)
+			Expect(err).To(MatchError("layer has no Hives/Software_Delta hive"))
+		})
+	})
+
+	Context("when the hive is corrupt", func() {
+		It("returns an error", func() {
+			writeTar(map[string][]byte{"Hives/Software_Delta": []byte("garbage")})
+
+			_, err := winlayer.Thumbprints(layerFile)
+			Expect(err).To(MatchError(HavePrefix("read Hives/Software_Delta hive: ")))
+		})
+	})
+
+	Context("when the file is not a layer", func() {
+		It("returns an error", func() {
+			Expect(os.WriteFile(layerFile, []byte("base-layer"), 0644)).To(Succeed())
+
+			_, err := winlayer.Thumbprints(layerFile)
+			Expect(err).To(MatchError(HavePrefix("read layer: ")))
+		})
+	})
+})
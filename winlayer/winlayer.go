@@ -0,0 +1,176 @@
+// Package winlayer writes the certificate layer of a Windows image directly,
+// without running a container to import the certificates.
+package winlayer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1" // #nosec G505 - the certificate store keys certificates by their SHA-1 hash
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/certs"
+	"code.cloudfoundry.org/cert-injector/hive"
+)
+
+// SoftwareHive is the path in the layer of the changes to HKLM\SOFTWARE.
+const SoftwareHive = "Hives/Software_Delta"
+
+// CertificatesKey is the path below HKLM\SOFTWARE of the keys that make up
+// Cert:\LocalMachine\Root.
+var CertificatesKey = []string{"Microsoft", "SystemCertificates", "ROOT", "Certificates"}
+
+// Properties of a certificate in a registry certificate store blob.
+const (
+	propSHA1Hash    = 3
+	propCertificate = 32
+)
+
+// Windows file attributes recorded for each entry of the layer.
+const (
+	fileAttributeDirectory = "16"
+	fileAttributeArchive   = "32"
+)
+
+type bundle interface {
+	Certificates(certDirectory string) ([]*x509.Certificate, error)
+}
+
+type Builder struct {
+	bundle bundle
+}
+
+func NewBuilder() Builder {
+	return Builder{
+		bundle: certs.NewBundle(),
+	}
+}
+
+// BuildLayer writes a gzipped layer tar to outputFile that adds the
+// certificates in certDirectory to Cert:\LocalMachine\Root, in the format
+// diff-exporter exports a container's changes in.
+func (b Builder) BuildLayer(outputFile, certDirectory string) error {
+	certificates, err := b.bundle.Certificates(certDirectory)
+	if err != nil {
+		return err
+	}
+	if len(certificates) == 0 {
+		return fmt.Errorf("no certificates in %s", certDirectory)
+	}
+
+	software, err := hive.Marshal(softwareDelta(certificates))
+	if err != nil {
+		return fmt.Errorf("write registry hive: %s", err)
+	}
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = writeLayer(f, software)
+	if err != nil {
+		return fmt.Errorf("write layer: %s", err)
+	}
+
+	return f.Close()
+}
+
+// softwareDelta returns the keys a container adds to HKLM\SOFTWARE when the
+// certificates are imported into Cert:\LocalMachine\Root.
+func softwareDelta(certificates []*x509.Certificate) *hive.Key {
+	store := &hive.Key{Name: CertificatesKey[len(CertificatesKey)-1]}
+	for _, cert := range certificates {
+		store.Subkeys = append(store.Subkeys, &hive.Key{
+			Name: certs.Thumbprint(cert),
+			Values: []hive.Value{
+				{Name: "Blob", Type: hive.TypeBinary, Data: blob(cert)},
+			},
+		})
+	}
+
+	// Wrap the store in the keys leading up to it.
+	key := store
+	for n := len(CertificatesKey) - 2; n >= 0; n-- {
+		key = &hive.Key{Name: CertificatesKey[n], Subkeys: []*hive.Key{key}}
+	}
+
+	return &hive.Key{Name: "ROOT", Subkeys: []*hive.Key{key}}
+}
+
+// blob encodes cert the way a registry certificate store saves it: as a
+// list of properties, each an id, flags, length and data.
+func blob(cert *x509.Certificate) []byte {
+	hash := sha1.Sum(cert.Raw) // #nosec G401 - the hash is an identifier, not a security control
+
+	var encoded bytes.Buffer
+	for _, property := range []struct {
+		id   uint32
+		data []byte
+	}{
+		{propSHA1Hash, hash[:]},
+		{propCertificate, cert.Raw},
+	} {
+		header := make([]byte, 12)
+		binary.LittleEndian.PutUint32(header, property.id)
+		binary.LittleEndian.PutUint32(header[4:], 1)
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(property.data)))
+		encoded.Write(header)
+		encoded.Write(property.data)
+	}
+
+	return encoded.Bytes()
+}
+
+// epoch is the modification time of every entry, so that the same
+// certificates always produce the same layer and layer digest.
+var epoch = time.Unix(0, 0).UTC()
+
+func writeLayer(f *os.File, software []byte) error {
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	for _, dir := range []string{"Files", "Hives"} {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeDir,
+			Name:       dir,
+			Mode:       0755,
+			ModTime:    epoch,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{"MSWINDOWS.fileattr": fileAttributeDirectory},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       SoftwareHive,
+		Mode:       0644,
+		Size:       int64(len(software)),
+		ModTime:    epoch,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{"MSWINDOWS.fileattr": fileAttributeArchive},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(software)
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
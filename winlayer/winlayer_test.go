@@ -0,0 +1,141 @@
+package winlayer_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cert-injector/hive"
+	"code.cloudfoundry.org/cert-injector/internal/testfixtures"
+	"code.cloudfoundry.org/cert-injector/winlayer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type entry struct {
+	header *tar.Header
+	data   []byte
+}
+
+var _ = Describe("Builder", func() {
+	var (
+		certDirectory string
+		outputFile    string
+		builder       winlayer.Builder
+	)
+
+	BeforeEach(func() {
+		certDirectory = GinkgoT().TempDir()
+		outputFile = filepath.Join(GinkgoT().TempDir(), "layer.tgz")
+		builder = winlayer.NewBuilder()
+	})
+
+	readLayer := func() []entry {
+		f, err := os.Open(outputFile)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		Expect(err).NotTo(HaveOccurred())
+
+		var entries []entry
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := io.ReadAll(tr)
+			Expect(err).NotTo(HaveOccurred())
+			entries = append(entries, entry{header, data})
+		}
+		return entries
+	}
+
+	It("writes a layer that adds the certificates to the root store", func() {
+		first := testfixtures.GenerateCA("first")
+		second := testfixtures.GenerateCA("second")
+		Expect(os.WriteFile(filepath.Join(certDirectory, "a.crt"), testfixtures.ToPEM(first, second), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(certDirectory, "b.crt"), testfixtures.ToPEM(first), 0644)).To(Succeed())
+
+		Expect(builder.BuildLayer(outputFile, certDirectory)).To(Succeed())
+
+		entries := readLayer()
+		Expect(entries).To(HaveLen(3))
+
+		Expect(entries[0].header.Name).To(Equal("Files"))
+		Expect(entries[0].header.Typeflag).To(Equal(byte(tar.TypeDir)))
+		Expect(entries[0].header.PAXRecords).To(HaveKeyWithValue("MSWINDOWS.fileattr", "16"))
+		Expect(entries[1].header.Name).To(Equal("Hives"))
+		Expect(entries[1].header.Typeflag).To(Equal(byte(tar.TypeDir)))
+		Expect(entries[2].header.Name).To(Equal(winlayer.SoftwareHive))
+		Expect(entries[2].header.PAXRecords).To(HaveKeyWithValue("MSWINDOWS.fileattr", "32"))
+		Expect(entries[2].header.ModTime).To(Equal(time.Unix(0, 0)))
+
+		root, err := hive.Unmarshal(entries[2].data)
+		Expect(err).NotTo(HaveOccurred())
+
+		store := root.Subkey(winlayer.CertificatesKey...)
+		Expect(store).NotTo(BeNil())
+		Expect(store.Subkeys).To(HaveLen(2))
+
+		for _, der := range [][]byte{first, second} {
+			hash := sha1.Sum(der)
+			key := store.Subkey(fmt.Sprintf("%X", hash))
+			Expect(key).NotTo(BeNil())
+
+			value, ok := key.Value("Blob")
+			Expect(ok).To(BeTrue())
+			Expect(value.Type).To(Equal(hive.TypeBinary))
+
+			blob := value.Data
+			Expect(binary.LittleEndian.Uint32(blob[0:])).To(Equal(uint32(3)))
+			Expect(binary.LittleEndian.Uint32(blob[4:])).To(Equal(uint32(1)))
+			Expect(binary.LittleEndian.Uint32(blob[8:])).To(Equal(uint32(20)))
+			Expect(blob[12:32]).To(Equal(hash[:]))
+
+			Expect(binary.LittleEndian.Uint32(blob[32:])).To(Equal(uint32(32)))
+			Expect(binary.LittleEndian.Uint32(blob[36:])).To(Equal(uint32(1)))
+			Expect(binary.LittleEndian.Uint32(blob[40:])).To(Equal(uint32(len(der))))
+			Expect(blob[44:]).To(Equal(der))
+		}
+	})
+
+	It("writes the same layer for the same certificates", func() {
+		Expect(os.WriteFile(filepath.Join(certDirectory, "a.crt"), testfixtures.ToPEM(testfixtures.GenerateCA("first")), 0644)).To(Succeed())
+
+		Expect(builder.BuildLayer(outputFile, certDirectory)).To(Succeed())
+		first, err := os.ReadFile(outputFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(builder.BuildLayer(outputFile, certDirectory)).To(Succeed())
+		second, err := os.ReadFile(outputFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first).To(Equal(second))
+	})
+
+	Context("when the directory has no certificates", func() {
+		It("returns an error", func() {
+			err := builder.BuildLayer(outputFile, certDirectory)
+			Expect(err).To(MatchError(fmt.Sprintf("no certificates in %s", certDirectory)))
+		})
+	})
+
+	Context("when a certificate cannot be parsed", func() {
+		It("returns an error", func() {
+			Expect(os.WriteFile(filepath.Join(certDirectory, "bad.crt"), []byte("garbage"), 0644)).To(Succeed())
+
+			err := builder.BuildLayer(outputFile, certDirectory)
+			Expect(err).To(MatchError(HavePrefix("bad.crt: ")))
+		})
+	})
+})